@@ -6,6 +6,7 @@ package v1
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -142,11 +143,129 @@ type CustomAnnotation struct {
 	Value string `json:"value" protobuf:"bytes,64,rep,name=value"`
 }
 
+// IBMSecurityVerifyAccessStorage defines the persistent volume which holds
+// the data of a configuration container.
+type IBMSecurityVerifyAccessStorage struct {
+	// Size is the requested size of the persistent volume.  Defaults to
+	// '1Gi'.
+	// +optional
+	Size *resource.Quantity `json:"size,omitempty"`
+
+	// StorageClassName is the name of the storage class which is used for
+	// the persistent volume.  The default storage class of the cluster is
+	// used if no storage class is specified.
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
+}
+
+// IBMSecurityVerifyAccessCanaryHTTPCheck defines an HTTP request which is
+// sent to each of the pods of a canary deployment to check the health of the
+// pod.
+type IBMSecurityVerifyAccessCanaryHTTPCheck struct {
+	// Path is the path of the request, for example '/pkmshealth'.
+	Path string `json:"path"`
+
+	//+kubebuilder:validation:Minimum=1
+	//+kubebuilder:validation:Maximum=65535
+	// Port is the port of the pod to which the request is sent.  Defaults to
+	// 9443.
+	// +optional
+	Port int32 `json:"port,omitempty"`
+
+	//+kubebuilder:validation:Enum=HTTP;HTTPS
+	// Scheme is the scheme of the request.  The certificate of the pod is not
+	// verified.  Defaults to HTTPS.
+	// +optional
+	Scheme corev1.URIScheme `json:"scheme,omitempty"`
+}
+
+// IBMSecurityVerifyAccessCanary defines the canary rollout of a candidate
+// snapshot.
+type IBMSecurityVerifyAccessCanary struct {
+	// SnapshotId is the identifier of the candidate snapshot.  The canary
+	// rollout is started whenever this differs from the snapshot identifier
+	// of the deployment.
+	SnapshotId string `json:"snapshotId"`
+
+	//+kubebuilder:validation:Minimum=1
+	// Replicas is the number of pods which will be started for the canary
+	// deployment.  Defaults to 1.
+	// +optional
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// Duration is the length of time for which the canary deployment must
+	// remain ready, and pass the HTTP check, before the candidate snapshot is
+	// promoted.  Defaults to '5m'.
+	// +optional
+	Duration *metav1.Duration `json:"duration,omitempty"`
+
+	// HTTPCheck is an optional HTTP request which is sent to each of the
+	// pods of the canary deployment while the canary is running.
+	// +optional
+	HTTPCheck *IBMSecurityVerifyAccessCanaryHTTPCheck `json:"httpCheck,omitempty"`
+}
+
+// UpgradeStrategy is the strategy which is used to replace the pods of a
+// deployment when the image is changed.
+type UpgradeStrategy string
+
+const (
+	RollingUpdate UpgradeStrategy = "RollingUpdate"
+	BlueGreen     UpgradeStrategy = "BlueGreen"
+)
+
+// IBMSecurityVerifyAccessBlueGreen defines the behaviour of the blue/green
+// upgrade strategy.
+type IBMSecurityVerifyAccessBlueGreen struct {
+	//+kubebuilder:default=true
+	// AutoPromote is a boolean which indicates whether the service is
+	// switched to the new deployment as soon as it is ready.  If set to
+	// false the new deployment is only promoted once the 'promote' action has
+	// been requested.
+	// +optional
+	AutoPromote bool `json:"autoPromote"`
+
+	// GracePeriod is the length of time for which the old deployment is kept
+	// after the service has been switched to the new deployment, so that the
+	// upgrade can be aborted.  Defaults to '5m'.
+	// +optional
+	GracePeriod *metav1.Duration `json:"gracePeriod,omitempty"`
+}
+
+// RestartPolicy is the policy which determines whether, and how, a
+// deployment is restarted when a new snapshot or fixpack is published.
+type RestartPolicy string
+
+const (
+	RestartAlways                RestartPolicy = "Always"
+	RestartOnlyIfSnapshotChanged RestartPolicy = "OnlyIfSnapshotChanged"
+	RestartFixpacksOnly          RestartPolicy = "FixpacksOnly"
+	RestartManual                RestartPolicy = "Manual"
+	RestartRecreate              RestartPolicy = "Recreate"
+)
+
+// IBMSecurityVerifyAccessRestartWindow defines the maintenance window in
+// which the deployment can be restarted.
+type IBMSecurityVerifyAccessRestartWindow struct {
+	// Schedule is a cron-style schedule, of the form 'minute hour
+	// day-of-month month day-of-week', at which the window opens, for
+	// example '0 2 * * *' for 2am each day.
+	Schedule string `json:"schedule"`
+
+	// Duration is the length of time for which the window remains open.
+	Duration metav1.Duration `json:"duration"`
+
+	// TimeZone is the IANA time zone of the schedule, for example
+	// 'Australia/Brisbane'.  Defaults to 'UTC'.
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
 // IBMSecurityVerifyAccessSpec defines the desired state of an
 // IBMSecurityVerifyAccess resource.
 type IBMSecurityVerifyAccessSpec struct {
 	// The name of the image which will be used in the deployment.
-	// Cannot be updated.
+	// Cannot be updated, unless the BlueGreen upgrade strategy is used.
 	Image string `json:"image"`
 
 	//+kubebuilder:validation:Minimum=0
@@ -161,11 +280,41 @@ type IBMSecurityVerifyAccessSpec struct {
 	// +optional
 	AutoRestart bool `json:"autoRestart"`
 
+	//+kubebuilder:validation:Enum=Always;OnlyIfSnapshotChanged;FixpacksOnly;Manual;Recreate
+	//+kubebuilder:default=Always
+	// RestartPolicy determines whether, and how, the deployment is restarted
+	// when a new snapshot or fixpack is published.  Always performs a rolling
+	// restart.  OnlyIfSnapshotChanged skips the restart if the snapshot is
+	// identical to the snapshot for which the deployment was last restarted.
+	// FixpacksOnly only restarts the deployment for a new fixpack.  Manual
+	// never restarts the deployment, but records the pending restart in the
+	// RestartPending condition.  Recreate deletes all of the pods at once,
+	// rather than performing a rolling restart, for changes which cannot be
+	// run by pods of different versions at the same time.  The policy only
+	// applies if AutoRestart is true.
+	// +optional
+	RestartPolicy RestartPolicy `json:"restartPolicy,omitempty"`
+
+	// RestartToken is an arbitrary string which, when changed, triggers a
+	// rolling restart of the deployment.  The 'ibm.com/restart-requested-at'
+	// annotation can be used instead, and takes precedence if both are set.
+	// +optional
+	RestartToken string `json:"restartToken,omitempty"`
+
+	// RestartWindow is the maintenance window in which the deployment can
+	// be restarted when a new snapshot is published.  A restart which is
+	// requested outside of the window is deferred, and the RestartPending
+	// condition is set, until the window next opens.  The deployment can be
+	// restarted at any time if no window is specified.
+	// +optional
+	RestartWindow *IBMSecurityVerifyAccessRestartWindow `json:"restartWindow,omitempty"`
+
 	//+kubebuilder:default=published
 	// SnapshotId is a string which is used to indicate the identifier of the
 	// snapshot which should be used.  If no identifier is specified a default
-	// snapshot of 'published' will be used.
-	// Cannot be updated.
+	// snapshot of 'published' will be used.  The candidate snapshot of a
+	// canary rollout is used instead once it has been promoted, for as long
+	// as it remains the candidate snapshot of the canary.
 	// +optional
 	SnapshotId string `json:"snapshotId"`
 
@@ -244,6 +393,40 @@ type IBMSecurityVerifyAccessSpec struct {
 	// +optional
 	LicenseAnnotations *ILMTAnnotations `json:"ilmtAnnotations,omitempty" protobuf:"bytes,64,opt,name=ilmt_annotations,casttype=ILMTAnnotations"`
 
+	// Storage defines the persistent volume which holds the data of the
+	// configuration container.  This value is only used for configuration
+	// deployments, which are created as a StatefulSet, and is ignored for
+	// all other deployments.
+	// Cannot be updated.
+	// +optional
+	Storage *IBMSecurityVerifyAccessStorage `json:"storage,omitempty"`
+
+	// Canary defines the canary rollout of a candidate snapshot.  A temporary
+	// canary deployment, which uses the candidate snapshot, is created
+	// alongside the deployment.  The candidate snapshot is promoted to be the
+	// snapshot of the deployment if the canary remains healthy for the
+	// duration of the canary, and is otherwise discarded.
+	// +optional
+	Canary *IBMSecurityVerifyAccessCanary `json:"canary,omitempty"`
+
+	//+kubebuilder:validation:Enum=RollingUpdate;BlueGreen
+	//+kubebuilder:validation:XValidation:rule="self == oldSelf",message="the upgrade strategy cannot be changed"
+	//+kubebuilder:default=RollingUpdate
+	// UpgradeStrategy is the strategy which is used when the image is
+	// changed.  The image of a RollingUpdate deployment cannot be updated.
+	// With the BlueGreen strategy the operator manages a blue and a green
+	// deployment, along with a service which selects the active deployment.
+	// When the image is changed a new deployment is started alongside the
+	// active deployment, and the service is switched to the new deployment
+	// once it is ready.  The strategy can only be set when the resource is
+	// created.  This value is ignored for configuration deployments.
+	// +optional
+	UpgradeStrategy UpgradeStrategy `json:"upgradeStrategy,omitempty"`
+
+	// BlueGreen defines the behaviour of the BlueGreen upgrade strategy.
+	// +optional
+	BlueGreen *IBMSecurityVerifyAccessBlueGreen `json:"blueGreen,omitempty"`
+
 	// The definition for the container which is being created.
 	// Cannot be updated.
 	// +optional
@@ -255,6 +438,74 @@ type IBMSecurityVerifyAccessSpec struct {
 type IBMSecurityVerifyAccessStatus struct {
 	// Conditions is the list of status conditions for this resource
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// LastRestartToken is the most recent restart token, or value of the
+	// 'ibm.com/restart-requested-at' annotation, for which a rolling restart
+	// of the deployment was started.
+	// +optional
+	LastRestartToken string `json:"lastRestartToken,omitempty"`
+
+	// Canary is the state of the most recent canary rollout.
+	// +optional
+	Canary *IBMSecurityVerifyAccessCanaryStatus `json:"canary,omitempty"`
+
+	// BlueGreen is the state of the BlueGreen upgrade strategy.
+	// +optional
+	BlueGreen *IBMSecurityVerifyAccessBlueGreenStatus `json:"blueGreen,omitempty"`
+}
+
+// IBMSecurityVerifyAccessBlueGreenStatus defines the observed state of the
+// BlueGreen upgrade strategy.
+type IBMSecurityVerifyAccessBlueGreenStatus struct {
+	// ActiveColor is the colour of the deployment, either blue or green,
+	// which is selected by the service.
+	ActiveColor string `json:"activeColor"`
+
+	// ActiveImage is the image of the active deployment.
+	ActiveImage string `json:"activeImage"`
+
+	// PreviousImage is the image of the previous deployment, which is kept
+	// until the grace period has ended.
+	// +optional
+	PreviousImage string `json:"previousImage,omitempty"`
+
+	// PromotedTime is the time at which the service was switched to the
+	// active deployment.
+	// +optional
+	PromotedTime *metav1.Time `json:"promotedTime,omitempty"`
+
+	// AbortedImage is the image of the most recent upgrade which was
+	// aborted.  The upgrade is not attempted again until the image is
+	// changed.
+	// +optional
+	AbortedImage string `json:"abortedImage,omitempty"`
+
+	// Message explains the state of the upgrade.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// IBMSecurityVerifyAccessCanaryStatus defines the observed state of the
+// canary rollout of a candidate snapshot.
+type IBMSecurityVerifyAccessCanaryStatus struct {
+	// SnapshotId is the identifier of the candidate snapshot.
+	SnapshotId string `json:"snapshotId"`
+
+	// Phase is the phase of the canary rollout, which is either Running,
+	// Promoted or Discarded.
+	Phase string `json:"phase"`
+
+	// StartTime is the time at which the canary rollout was started.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// ReadyTime is the time at which the canary deployment became ready.
+	// +optional
+	ReadyTime *metav1.Time `json:"readyTime,omitempty"`
+
+	// Message explains the phase of the canary rollout.
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 //+kubebuilder:object:root=true
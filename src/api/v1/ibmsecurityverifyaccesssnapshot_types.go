@@ -0,0 +1,204 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SnapshotPVCSource identifies a file which is held on a persistent volume.
+type SnapshotPVCSource struct {
+	// The name of the persistent volume claim, in the same namespace as the
+	// snapshot resource, which holds the file.
+	ClaimName string `json:"claimName"`
+
+	// The path of the file, relative to the root of the volume.
+	Path string `json:"path"`
+}
+
+// SnapshotURLSource identifies a file which is available from an HTTP
+// server.
+type SnapshotURLSource struct {
+	// The http or https URL of the file.
+	URL string `json:"url"`
+
+	// An optional reference to a key of a secret, in the same namespace as
+	// the snapshot resource, which holds the PEM encoded CA certificates that
+	// are used to verify the server.  The system CA certificates are used if
+	// no secret is specified.
+	// +optional
+	CACert *corev1.SecretKeySelector `json:"caCert,omitempty"`
+}
+
+// SnapshotOCISource identifies a file which has been published as an OCI
+// artifact.
+type SnapshotOCISource struct {
+	// The reference of the artifact, by tag or by digest, for example:
+	// 'registry.example.com/ivia/snapshots:11.0.0.0' or
+	// 'registry.example.com/ivia/snapshots@sha256:...'.
+	Reference string `json:"reference"`
+
+	// ImagePullSecrets is an optional list of references to secrets in the
+	// same namespace which hold the credentials for the registry.  Both
+	// kubernetes.io/dockerconfigjson and kubernetes.io/dockercfg secrets are
+	// supported.
+	// +optional
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+
+	// PollInterval is the interval at which the tag of the artifact is
+	// checked for changes.  The artifact is retrieved again, and the
+	// deployments restarted, whenever the tag is moved to a different
+	// artifact.  The tag is not polled if no interval is specified.
+	// +optional
+	PollInterval *metav1.Duration `json:"pollInterval,omitempty"`
+
+	// PlainHTTP indicates that the registry is accessed using HTTP rather
+	// than HTTPS, as is the case for a local 'registry:2' container.
+	// +optional
+	PlainHTTP bool `json:"plainHTTP,omitempty"`
+}
+
+// IBMSecurityVerifyAccessSnapshotSource defines the location from which the
+// content of the snapshot is retrieved.  Exactly one of the sources must be
+// specified.
+// +kubebuilder:validation:XValidation:rule="[has(self.configMap), has(self.secret), has(self.persistentVolumeClaim), has(self.http), has(self.oci)].filter(x, x).size() == 1",message="exactly one snapshot source must be specified"
+type IBMSecurityVerifyAccessSnapshotSource struct {
+	// A key of a config map, in the same namespace as the snapshot resource,
+	// which holds the snapshot in either its data or binaryData.
+	// +optional
+	ConfigMap *corev1.ConfigMapKeySelector `json:"configMap,omitempty"`
+
+	// A key of a secret, in the same namespace as the snapshot resource,
+	// which holds the snapshot.
+	// +optional
+	Secret *corev1.SecretKeySelector `json:"secret,omitempty"`
+
+	// A file on a persistent volume.  The file is read by a short-lived pod
+	// which mounts the volume.
+	// +optional
+	PersistentVolumeClaim *SnapshotPVCSource `json:"persistentVolumeClaim,omitempty"`
+
+	// A file which is available from an HTTP server.
+	// +optional
+	HTTP *SnapshotURLSource `json:"http,omitempty"`
+
+	// A file which has been published as an OCI artifact.
+	// +optional
+	OCI *SnapshotOCISource `json:"oci,omitempty"`
+}
+
+// IBMSecurityVerifyAccessSnapshotSpec defines the desired state of an
+// IBMSecurityVerifyAccessSnapshot resource.
+// +kubebuilder:validation:XValidation:rule="has(self.fixpack) || has(self.version)",message="either a version or a fixpack must be specified"
+type IBMSecurityVerifyAccessSnapshotSpec struct {
+	//+kubebuilder:default=published
+	//+kubebuilder:validation:Pattern=`^[A-Za-z0-9-]+$`
+	// SnapshotId is the identifier of the snapshot, which corresponds to the
+	// snapshotId of the IBMSecurityVerifyAccess resources that use it.
+	// +optional
+	SnapshotId string `json:"snapshotId"`
+
+	//+kubebuilder:validation:Pattern=`^[0-9][0-9.]*$`
+	// Version is the version of Verify Identity Access to which the snapshot
+	// applies, for example '11.0.0.0'.  The version is required unless a
+	// fixpack is specified.
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	//+kubebuilder:validation:Pattern=`^[A-Za-z0-9][A-Za-z0-9._-]*$`
+	// Fixpack is the name of a fixpack.  If a name is specified the resource
+	// declares a fixpack, which is stored in the fixpacks directory with the
+	// specified name, rather than a snapshot.  The snapshotId and version
+	// are ignored for a fixpack.
+	// +optional
+	Fixpack string `json:"fixpack,omitempty"`
+
+	// Source is the location from which the content of the snapshot is
+	// retrieved.
+	Source IBMSecurityVerifyAccessSnapshotSource `json:"source"`
+
+	//+kubebuilder:validation:Pattern=`^(sha256:)?[a-fA-F0-9]{64}$`
+	// Digest is the expected SHA-256 digest of the snapshot.  The snapshot
+	// is rejected if its content does not match the digest.
+	// +optional
+	Digest string `json:"digest,omitempty"`
+
+	// Modified is the comma-separated list of the services which are
+	// affected by the snapshot, for example 'wrp:default,runtime'.  This
+	// has the same meaning as the 'modified' argument of an upload, and
+	// all services are restarted if it is not specified.
+	// +optional
+	Modified string `json:"modified,omitempty"`
+}
+
+// IBMSecurityVerifyAccessSnapshotStatus defines the observed state of an
+// IBMSecurityVerifyAccessSnapshot resource.
+type IBMSecurityVerifyAccessSnapshotStatus struct {
+	// The name of the snapshot within the snapshot store.
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// The SHA-256 digest of the stored snapshot.
+	// +optional
+	Digest string `json:"digest,omitempty"`
+
+	// The size, in bytes, of the stored snapshot.
+	// +optional
+	Size int64 `json:"size,omitempty"`
+
+	// The revision of the stored snapshot within the history of the file.
+	// +optional
+	Revision int `json:"revision,omitempty"`
+
+	// The revision of the source from which the snapshot was retrieved, such
+	// as the digest of the manifest of an OCI artifact.
+	// +optional
+	SourceRevision string `json:"sourceRevision,omitempty"`
+
+	// Ready indicates whether the snapshot has been stored.
+	Ready bool `json:"ready"`
+
+	// The generation of the resource which was last stored.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions is the list of status conditions for this resource
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Snapshot Id",type=string,JSONPath=`.spec.snapshotId`
+//+kubebuilder:printcolumn:name="Version",type=string,JSONPath=`.spec.version`
+//+kubebuilder:printcolumn:name="Ready",type=boolean,JSONPath=`.status.ready`
+//+kubebuilder:printcolumn:name="Digest",type=string,JSONPath=`.status.digest`,priority=1
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// IBMSecurityVerifyAccessSnapshot is the Schema for the
+// ibmsecurityverifyaccesssnapshots API.
+type IBMSecurityVerifyAccessSnapshot struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   IBMSecurityVerifyAccessSnapshotSpec   `json:"spec,omitempty"`
+	Status IBMSecurityVerifyAccessSnapshotStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// IBMSecurityVerifyAccessSnapshotList contains a list of
+// IBMSecurityVerifyAccessSnapshot resources.
+type IBMSecurityVerifyAccessSnapshotList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IBMSecurityVerifyAccessSnapshot `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(
+		&IBMSecurityVerifyAccessSnapshot{},
+		&IBMSecurityVerifyAccessSnapshotList{})
+}
@@ -8,6 +8,8 @@ import (
 	"crypto/tls"
 	"flag"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -32,6 +34,9 @@ var (
 	setupLog = ctrl.Log.WithName("setup")
 )
 
+// The name of the lease which is used for leader election.
+const leaderElectionID = "0941aff7.ibm.com"
+
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
@@ -46,6 +51,11 @@ func main() {
 	var enableHTTP2 bool
 	var enableLeaderElection bool
 	var probeAddr string
+	var snapshotMgrOptions controllers.SnapshotMgrOptions
+	var tlsCipherSuites string
+	var restartOrder string
+	var gatedSnapshots string
+	var serveFile string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&secureMetrics, "metrics-secure", true,
 		"If set, the metrics endpoint is served securely via HTTPS. Use --metrics-secure=false to use HTTP instead.")
@@ -55,12 +65,142 @@ func main() {
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics service")
+	flag.StringVar(&snapshotMgrOptions.CertSource, "snapshot-cert-source", controllers.CertSourceOperator,
+		"The source of the snapshot service certificate, either 'operator' or 'cert-manager'.")
+	flag.StringVar(&snapshotMgrOptions.CertIssuerName, "snapshot-cert-issuer", "",
+		"The name of the cert-manager issuer used when --snapshot-cert-source=cert-manager.")
+	flag.StringVar(&snapshotMgrOptions.CertIssuerKind, "snapshot-cert-issuer-kind", "Issuer",
+		"The kind of the cert-manager issuer, either Issuer or ClusterIssuer.")
+	flag.StringVar(&snapshotMgrOptions.CertIssuerGroup, "snapshot-cert-issuer-group", "cert-manager.io",
+		"The API group of the cert-manager issuer.")
+	flag.StringVar(&snapshotMgrOptions.TLSPolicy.MinVersion, "tls-min-version", "1.2",
+		"The minimum TLS version for the snapshot service and the metrics endpoint, one of 1.0, 1.1, 1.2 or 1.3.")
+	flag.StringVar(&tlsCipherSuites, "tls-cipher-suites", "",
+		"A comma-separated list of the TLS 1.2 cipher suites for the snapshot service and the metrics endpoint. "+
+			"The Go defaults are used if no cipher suites are specified.")
+	flag.StringVar(&snapshotMgrOptions.TLSPolicy.KeyType, "tls-key-type", controllers.KeyTypeRSA,
+		"The type of key generated for the snapshot service certificates, either 'rsa' or 'ecdsa'.")
+	flag.IntVar(&snapshotMgrOptions.TLSPolicy.KeySize, "tls-key-size", 0,
+		"The size in bits of the generated key, or of the curve for ECDSA keys. "+
+			"Defaults to 2048 for RSA keys and 256 for ECDSA keys.")
+	flag.BoolVar(&snapshotMgrOptions.TLSPolicy.FIPS, "fips", false,
+		"If set, TLS and key generation are restricted to FIPS approved algorithms.")
+	flag.IntVar(&snapshotMgrOptions.SnapshotHistory, "snapshot-history", 5,
+		"The number of revisions of each uploaded snapshot and fixpack to keep for rollback. "+
+			"A value of 0 disables the history.")
+	flag.StringVar(&snapshotMgrOptions.StoreType, "snapshot-store", controllers.StoreTypeLocal,
+		"The type of store which holds the snapshots and fixpacks, either 'local', 's3' or 'kubernetes'.")
+	flag.BoolVar(&snapshotMgrOptions.StoreCompression, "snapshot-store-compress", false,
+		"If set, the files held in the 'kubernetes' snapshot store are compressed.")
+	flag.StringVar(&snapshotMgrOptions.S3.Endpoint, "s3-endpoint", "",
+		"The URL of the S3 compatible object store. Defaults to the AWS endpoint for the region.")
+	flag.StringVar(&snapshotMgrOptions.S3.Region, "s3-region", "us-east-1",
+		"The region of the S3 bucket.")
+	flag.StringVar(&snapshotMgrOptions.S3.Bucket, "s3-bucket", "",
+		"The name of the S3 bucket which holds the snapshots and fixpacks.")
+	flag.StringVar(&snapshotMgrOptions.S3.Prefix, "s3-prefix", "",
+		"An optional prefix which is added to the name of each object in the S3 bucket.")
+	flag.BoolVar(&snapshotMgrOptions.S3.PathStyle, "s3-path-style", false,
+		"If set, path style addressing is used for the S3 bucket, as is usually required by MinIO.")
+	flag.StringVar(&snapshotMgrOptions.S3.CAFile, "s3-ca-file", "",
+		"A file containing the CA certificates which are used to verify the S3 endpoint.")
+	flag.StringVar(&snapshotMgrOptions.Git.URL, "git-url", "",
+		"The http or https URL of a Git repository from which the snapshots and fixpacks are mirrored.")
+	flag.StringVar(&snapshotMgrOptions.Git.Branch, "git-branch", "main",
+		"The branch of the Git repository which is mirrored.")
+	flag.StringVar(&snapshotMgrOptions.Git.Path, "git-path", "",
+		"The directory of the Git repository which holds the 'snapshots' and 'fixpacks' directories.")
+	flag.StringVar(&snapshotMgrOptions.Git.SecretName, "git-secret", "",
+		"The name of a secret which holds the 'username' and 'password' for the Git repository.")
+	flag.DurationVar(&snapshotMgrOptions.Git.Interval, "git-interval", time.Minute,
+		"The interval at which the Git repository is checked for new commits.")
+	flag.StringVar(&snapshotMgrOptions.Git.CAFile, "git-ca-file", "",
+		"A file containing the CA certificates which are used to verify the Git repository.")
+	flag.DurationVar(&snapshotMgrOptions.RestartTimeout, "restart-timeout", 10*time.Minute,
+		"The length of time which a restart job waits for the restarted deployments to complete their rollout.")
+	flag.StringVar(&snapshotMgrOptions.RestartStrategy, "restart-strategy", controllers.RestartStrategyParallel,
+		"The strategy which is used to restart the deployments, either 'parallel' or 'staged'.")
+	flag.IntVar(&snapshotMgrOptions.RestartBatchSize, "restart-batch-size", 1,
+		"The number of deployments which are restarted at a time by the 'staged' restart strategy.")
+	flag.StringVar(&restartOrder, "restart-order", "dsc,runtime,wrp",
+		"A comma-separated list of the order in which the roles of the deployments are restarted. "+
+			"An empty list restarts all roles at the same time.")
+	flag.DurationVar(&snapshotMgrOptions.RestartQuietPeriod, "restart-quiet-period", 0,
+		"The length of time for which the restart of a deployment waits for further restarts, which are "+
+			"coalesced into a single restart. A value of 0 disables the coalescing of restarts.")
+	flag.BoolVar(&snapshotMgrOptions.AutoRollback, "auto-rollback", false,
+		"If set, a snapshot is automatically rolled back when a restarted deployment fails to complete its rollout.")
+	flag.StringVar(&gatedSnapshots, "gated-snapshots", "",
+		"A comma-separated list of the snapshot identifiers, for example 'published', whose uploads must be approved "+
+			"before the deployments are restarted.")
+	flag.StringVar(&serveFile, "serve-file", "",
+		"Serve the specified file, rather than running the manager. This is used by the snapshot reader pods.")
 	opts := zap.Options{
 		Development: true,
 	}
 	opts.BindFlags(flag.CommandLine)
 	flag.Parse()
 
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	// A snapshot reader pod runs the operator image to serve a single file from a volume.
+	if len(serveFile) > 0 {
+		if err := controllers.ServeFile(serveFile); err != nil {
+			setupLog.Error(err, "problem serving the file", "file", serveFile)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if len(tlsCipherSuites) > 0 {
+		snapshotMgrOptions.TLSPolicy.CipherSuites = strings.Split(tlsCipherSuites, ",")
+	}
+
+	if len(restartOrder) > 0 {
+		snapshotMgrOptions.RestartOrder = strings.Split(restartOrder, ",")
+	}
+
+	if len(gatedSnapshots) > 0 {
+		snapshotMgrOptions.GatedSnapshots = strings.Split(gatedSnapshots, ",")
+	}
+
+	// The credentials for the S3 snapshot store are obtained from the standard AWS environment variables.
+	snapshotMgrOptions.S3.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	snapshotMgrOptions.S3.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	snapshotMgrOptions.S3.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+
+	if err := snapshotMgrOptions.TLSPolicy.Validate(); err != nil {
+		setupLog.Error(err, "invalid TLS policy")
+		os.Exit(1)
+	}
+
+	if snapshotMgrOptions.Git.Interval <= 0 {
+		setupLog.Error(nil, "invalid Git interval", "interval", snapshotMgrOptions.Git.Interval)
+		os.Exit(1)
+	}
+
+	if snapshotMgrOptions.RestartTimeout <= 0 {
+		setupLog.Error(nil, "invalid restart timeout", "timeout", snapshotMgrOptions.RestartTimeout)
+		os.Exit(1)
+	}
+
+	if snapshotMgrOptions.RestartStrategy != controllers.RestartStrategyParallel &&
+		snapshotMgrOptions.RestartStrategy != controllers.RestartStrategyStaged {
+		setupLog.Error(nil, "invalid restart strategy", "strategy", snapshotMgrOptions.RestartStrategy)
+		os.Exit(1)
+	}
+
+	if snapshotMgrOptions.RestartQuietPeriod < 0 {
+		setupLog.Error(nil, "invalid restart quiet period", "period", snapshotMgrOptions.RestartQuietPeriod)
+		os.Exit(1)
+	}
+
+	if snapshotMgrOptions.RestartBatchSize <= 0 {
+		setupLog.Error(nil, "invalid restart batch size", "size", snapshotMgrOptions.RestartBatchSize)
+		os.Exit(1)
+	}
+
 	disableHTTP2 := func(c *tls.Config) {
 		setupLog.Info("disabling http/2")
 		c.NextProtos = []string{"http/1.1"}
@@ -68,8 +208,7 @@ func main() {
 	if !enableHTTP2 {
 		tlsOpts = append(tlsOpts, disableHTTP2)
 	}
-
-	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	tlsOpts = append(tlsOpts, snapshotMgrOptions.TLSPolicy.Apply)
 
 	metricsServerOptions := metricsserver.Options{
 		BindAddress:   metricsAddr,
@@ -88,26 +227,41 @@ func main() {
 		// this setup is not recommended for production.
 	}
 
+	if enableLeaderElection {
+		snapshotMgrOptions.LeaderElectionID = leaderElectionID
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		Metrics:                metricsServerOptions,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "0941aff7.ibm.com",
+		LeaderElectionID:       leaderElectionID,
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
-	if err = (&controllers.IBMSecurityVerifyAccessReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("IBMSecurityVerifyAccess"),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
+	verifyAccessReconciler := &controllers.IBMSecurityVerifyAccessReconciler{
+		Client:             mgr.GetClient(),
+		Log:                ctrl.Log.WithName("controllers").WithName("IBMSecurityVerifyAccess"),
+		Scheme:             mgr.GetScheme(),
+		SnapshotMgrOptions: snapshotMgrOptions,
+	}
+	if err = verifyAccessReconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "IBMSecurityVerifyAccess")
 		os.Exit(1)
 	}
+	if err = (&controllers.IBMSecurityVerifyAccessSnapshotReconciler{
+		Client:      mgr.GetClient(),
+		Log:         ctrl.Log.WithName("controllers").WithName("IBMSecurityVerifyAccessSnapshot"),
+		Scheme:      mgr.GetScheme(),
+		SnapshotMgr: verifyAccessReconciler.GetSnapshotMgr(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "IBMSecurityVerifyAccessSnapshot")
+		os.Exit(1)
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -0,0 +1,644 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	apiV1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ibmv1 "github.com/ibm-security/verify-access-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * A gated snapshot is not published straight away, whether it has been
+ * uploaded, declared by a snapshot resource, mirrored from a Git repository
+ * or rolled back.  Instead the snapshot is held in the pending directory of
+ * the store until it has been approved, either with the '/approve' action,
+ * which requires the approver credentials rather than the read-write
+ * credentials which are used to upload snapshots, or by annotating a custom
+ * resource which uses the snapshot.  The approved snapshot is then saved,
+ * exactly as if it had just been uploaded, and the deployments are
+ * restarted.  A rejected snapshot is kept in the pending directory, so that
+ * the rejection remains visible, until it is replaced by the next upload.
+ */
+
+/*****************************************************************************/
+
+/*
+ * The errors which are returned when a pending snapshot cannot be reviewed.
+ */
+
+var errNotReviewable = errors.New("The snapshot is not waiting to be approved")
+var errNotApprover = errors.New("A snapshot can only be approved, or " +
+	"rejected, with the approver credentials from the " + approverSecretName +
+	" secret")
+
+/*
+ * The error which is returned if a gated snapshot is saved without having
+ * been approved.
+ */
+
+var errNotApproved = errors.New("The gated snapshot must be approved " +
+	"before it is published")
+
+/*****************************************************************************/
+
+/*
+ * The following functions are used to return the name of the pending copy
+ * of a file, and to determine whether a name is that of a pending copy.
+ */
+
+func pendingName(name string) string {
+	return path.Join(pendingDirName, name)
+}
+
+func isPendingName(name string) bool {
+	return strings.HasPrefix(name, pendingDirName+"/")
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to determine whether uploads of the specified file
+ * must be approved before they are published.
+ */
+
+func (mgr *SnapshotMgr) isGated(name string) bool {
+	if path.Dir(name) != "snapshots" {
+		return false
+	}
+
+	snapshotId := snapshotIdFromName(path.Base(name))
+
+	return len(snapshotId) > 0 &&
+		slices.Contains(mgr.options.GatedSnapshots, snapshotId)
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to load the approver credentials from the approver
+ * secret, which is created with a random password if it does not already
+ * exist.  The approver password must differ from the read-write password,
+ * as otherwise the principal which uploads a snapshot could also approve it.
+ */
+
+func (mgr *SnapshotMgr) loadApproverSecret() (err error) {
+	mgr.log.V(9).Info("Entering a function", "Function", "loadApproverSecret")
+
+	clientset, err := kubernetes.NewForConfig(mgr.config)
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to create a new client")
+
+		return
+	}
+
+	secretsClient := clientset.CoreV1().Secrets(mgr.namespace)
+
+	secret, err := secretsClient.Get(
+		context.TODO(), approverSecretName, metaV1.GetOptions{})
+
+	if k8serrors.IsNotFound(err) {
+		mgr.log.V(5).Info("Creating the secret",
+			"Secret.Name", approverSecretName)
+
+		pwd, gerr := mgr.generateRandomString(pwdLength)
+
+		if gerr != nil {
+			mgr.log.Error(gerr, "Failed to generate a password")
+
+			return gerr
+		}
+
+		secret, err = secretsClient.Create(context.TODO(), &apiV1.Secret{
+			Type: apiV1.SecretTypeOpaque,
+			ObjectMeta: metaV1.ObjectMeta{
+				Name: approverSecretName,
+			},
+			StringData: map[string]string{
+				approverUserFieldName: approverUser,
+				approverPwdFieldName:  pwd,
+			},
+		}, metaV1.CreateOptions{})
+
+		/*
+		 * Another replica may have created the secret at the same time, in
+		 * which case we use the secret which it created.
+		 */
+
+		if k8serrors.IsAlreadyExists(err) {
+			secret, err = secretsClient.Get(
+				context.TODO(), approverSecretName, metaV1.GetOptions{})
+		}
+	}
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to retrieve the secret",
+			"Secret.Name", approverSecretName)
+
+		return
+	}
+
+	creds := map[string]string{}
+
+	for _, key := range []string{approverUserFieldName, approverPwdFieldName} {
+		value := string(secret.Data[key])
+
+		if len(value) == 0 {
+			err = fmt.Errorf("The %s secret is missing the %s field",
+				approverSecretName, key)
+
+			mgr.log.Error(err, "The secret is missing a required field",
+				"Secret.Name", approverSecretName, "Field.Name", key)
+
+			return
+		}
+
+		creds[key] = value
+	}
+
+	if creds[approverPwdFieldName] == mgr.getCred(rwPwdFieldName) {
+		err = fmt.Errorf("The approver password in the %s secret must "+
+			"differ from the read-write password", approverSecretName)
+
+		mgr.log.Error(err, "The approver credentials are not valid")
+
+		return
+	}
+
+	mgr.setCreds(creds)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to determine whether the supplied credentials are
+ * the approver credentials.
+ */
+
+func (mgr *SnapshotMgr) isApprover(username string, password string) bool {
+	approverPwd := mgr.getCred(approverPwdFieldName)
+
+	return len(approverPwd) > 0 && password == approverPwd &&
+		username == mgr.getCred(approverUserFieldName)
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to save a file which is to be published.  A gated
+ * snapshot is saved as a pending snapshot instead, in which case the
+ * approval of the supplied metadata is set to pending and the deployments
+ * must not be restarted.
+ */
+
+func (mgr *SnapshotMgr) submitFile(
+	ctx context.Context,
+	name string,
+	src io.Reader,
+	expectedSize int64,
+	expectedDigest string,
+	metadata *fileMetadata) (err error) {
+
+	if mgr.isGated(name) {
+		return mgr.savePending(ctx, name, src, expectedSize, expectedDigest,
+			metadata)
+	}
+
+	return mgr.saveFile(ctx, name, src, expectedSize, expectedDigest,
+		metadata)
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the metadata of the pending, or
+ * rejected, copy of a gated snapshot if it has the specified digest.  This
+ * allows a snapshot which is retrieved repeatedly from the same source to
+ * be submitted for approval only once.  Nil is returned if there is no such
+ * copy.
+ */
+
+func (mgr *SnapshotMgr) heldSnapshot(
+	ctx context.Context, name string, digest string) *fileMetadata {
+
+	if !mgr.isGated(name) {
+		return nil
+	}
+
+	mgr.webMutex.RLock()
+	held, err := mgr.store.Stat(ctx, pendingName(name))
+	mgr.webMutex.RUnlock()
+
+	if err != nil || held.Digest != digest {
+		return nil
+	}
+
+	return held
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to save an upload of a gated snapshot as a pending
+ * snapshot, which replaces any existing pending snapshot of the same name.
+ */
+
+func (mgr *SnapshotMgr) savePending(
+	ctx context.Context,
+	name string,
+	src io.Reader,
+	expectedSize int64,
+	expectedDigest string,
+	metadata *fileMetadata) (err error) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "savePending")
+
+	metadata.Approval = approvalPending
+
+	mgr.reviewMutex.Lock()
+	defer mgr.reviewMutex.Unlock()
+
+	err = mgr.saveFile(ctx, pendingName(name), src, expectedSize,
+		expectedDigest, metadata)
+
+	if err != nil {
+		return
+	}
+
+	mgr.recordReview(name, apiV1.EventTypeNormal, "SnapshotPending",
+		fmt.Sprintf("The snapshot, %s, which was uploaded by %s, is waiting "+
+			"to be approved", metadata.Name, metadata.Client))
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to approve, or reject, the pending snapshot of the
+ * specified name.  If a digest is supplied it must match the digest of the
+ * pending snapshot, so that the reviewer can be sure of what is being
+ * approved.  An approved snapshot is published and the deployments are
+ * restarted, in which case the restart job is returned.
+ */
+
+func (mgr *SnapshotMgr) reviewPending(
+	ctx context.Context,
+	name string,
+	action string,
+	reviewer string,
+	digest string) (metadata *fileMetadata, job *restartJob, err error) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "reviewPending")
+
+	mgr.reviewMutex.Lock()
+	defer mgr.reviewMutex.Unlock()
+
+	mgr.webMutex.RLock()
+	src, pending, err := mgr.store.Get(ctx, pendingName(name))
+	mgr.webMutex.RUnlock()
+
+	if err != nil {
+		return
+	}
+
+	defer src.Close()
+
+	switch {
+	case pending.Approval != approvalPending:
+		err = fmt.Errorf("%w: the snapshot has been %s", errNotReviewable,
+			pending.Approval)
+
+	case len(digest) > 0 && digest != pending.Digest:
+		err = fmt.Errorf("%w: the SHA-256 digest of the pending snapshot, "+
+			"%s, does not match the supplied digest, %s", errNotReviewable,
+			pending.Digest, digest)
+	}
+
+	if err != nil {
+		return
+	}
+
+	metadata = &fileMetadata{
+		Client:   pending.Client,
+		Modified: pending.Modified,
+		Reviewer: reviewer,
+	}
+
+	/*
+	 * A rejected snapshot simply replaces the pending snapshot, so that the
+	 * rejection is recorded.
+	 */
+
+	if action == rejectAction {
+		metadata.Approval = approvalRejected
+
+		err = mgr.saveFile(ctx, pendingName(name), src, pending.Size,
+			pending.Digest, metadata)
+
+		if err == nil {
+			mgr.recordReview(name, apiV1.EventTypeWarning, "SnapshotRejected",
+				fmt.Sprintf("The snapshot, %s, which was uploaded by %s, has "+
+					"been rejected by %s", metadata.Name, metadata.Client,
+					reviewer))
+		}
+
+		return
+	}
+
+	/*
+	 * An approved snapshot is saved in exactly the same way as an uploaded
+	 * file, and the pending snapshot is then removed.  The digest of the
+	 * pending snapshot is checked to ensure that it has not been corrupted.
+	 */
+
+	metadata.Approval = approvalApproved
+
+	err = mgr.saveFile(ctx, name, src, pending.Size, pending.Digest, metadata)
+
+	if err != nil {
+		return
+	}
+
+	mgr.webMutex.Lock()
+	derr := mgr.store.Delete(ctx, pendingName(name))
+	mgr.webMutex.Unlock()
+
+	if derr != nil {
+		mgr.log.Error(derr, "Failed to remove the pending snapshot",
+			"File", name)
+	}
+
+	mgr.recordReview(name, apiV1.EventTypeNormal, "SnapshotApproved",
+		fmt.Sprintf("The snapshot, %s, which was uploaded by %s, has been "+
+			"approved by %s", metadata.Name, metadata.Client, reviewer))
+
+	job = mgr.rollingRestart("/"+name, metadata.Modified,
+		snapshotClientNamespace(metadata.Client), reviewer)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the metadata of the pending, and
+ * rejected, snapshots which are held for the specified directory.
+ */
+
+func (mgr *SnapshotMgr) listPending(
+	ctx context.Context, dir string) []*fileMetadata {
+
+	files, _ := mgr.store.List(ctx, pendingName(dir))
+
+	return files
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to find the name of the pending snapshot with the
+ * specified snapshot identifier and digest.  An empty string is returned if
+ * there is no such snapshot.
+ */
+
+func (mgr *SnapshotMgr) findPending(
+	ctx context.Context, snapshotId string, digest string) string {
+
+	mgr.webMutex.RLock()
+	files := mgr.listPending(ctx, "snapshots")
+	mgr.webMutex.RUnlock()
+
+	for _, file := range files {
+		if file.Approval == approvalPending && file.Digest == digest &&
+			snapshotIdFromName(file.Name) == snapshotId {
+			return path.Join("snapshots", file.Name)
+		}
+	}
+
+	return ""
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to record an event, which describes the review of a
+ * snapshot, against each of the custom resources which use the snapshot.
+ */
+
+func (mgr *SnapshotMgr) recordReview(name string, eventType string,
+	reason string, message string) {
+
+	mgr.log.Info(message, "File", name, "Reason", reason)
+
+	if mgr.recorder == nil {
+		return
+	}
+
+	rtClient, err := client.New(mgr.config,
+		client.Options{
+			Scheme: mgr.scheme,
+		})
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to create a new controller runtime client")
+
+		return
+	}
+
+	list := &ibmv1.IBMSecurityVerifyAccessList{}
+
+	err = rtClient.List(context.TODO(), list)
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to retrieve the custom resources")
+
+		return
+	}
+
+	snapshotId := snapshotIdFromName(path.Base(name))
+
+	for i := range list.Items {
+		if activeSnapshotId(&list.Items[i]) == snapshotId {
+			mgr.recorder.Event(&list.Items[i], eventType, reason, message)
+		}
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to handle a request to approve, or reject, a
+ * pending snapshot.  The request has been authenticated with the approver
+ * credentials, and so the approver is recorded as the reviewer rather than
+ * the client of the request, which is supplied by the caller.
+ */
+
+func (mgr *SnapshotMgr) serveReview(
+	w http.ResponseWriter,
+	r *http.Request,
+	action string,
+	urlPath string,
+	client string) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "serveReview")
+
+	reviewer, _, _ := r.BasicAuth()
+
+	mgr.log.Info("Processing a review", "Path", urlPath, "Action", action,
+		"Reviewer", reviewer, "Client", client)
+
+	digest, err := expectedDigest(r)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	metadata, job, err := mgr.reviewPending(r.Context(), storeName(urlPath),
+		action, reviewer, digest)
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, "The snapshot is not waiting to be approved",
+			http.StatusNotFound)
+
+		return
+
+	case errors.Is(err, errNotReviewable):
+		http.Error(w, err.Error(), http.StatusConflict)
+
+		return
+
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		mgr.log.Error(err, "Failed to review the snapshot", "Path", urlPath)
+
+		return
+	}
+
+	/*
+	 * An approved snapshot has been published, and so a '201 Created'
+	 * response is returned, along with the identifier of the restart job.
+	 */
+
+	response := jobResponse{fileMetadata: metadata}
+	status := http.StatusOK
+
+	if action == approveAction {
+		status = http.StatusCreated
+
+		if job != nil {
+			response.Job = job.Id
+		}
+	}
+
+	jsonStr, _ := json.Marshal(response)
+
+	setDigestHeaders(w, metadata)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonStr)
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to approve, or reject, a pending snapshot
+ * when the custom resource has been annotated with the digest of the
+ * snapshot.  Only a snapshot which is used by the custom resource can be
+ * reviewed, and the annotation is removed once it has been processed.
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) reviewSnapshots(
+	ctx context.Context,
+	m *ibmv1.IBMSecurityVerifyAccess) (err error) {
+
+	reviews := []struct {
+		annotation string
+		action     string
+	}{
+		{approveSnapshotAnnotation, approveAction},
+		{rejectSnapshotAnnotation, rejectAction},
+	}
+
+	processed := false
+
+	for _, review := range reviews {
+		digest, found := m.Annotations[review.annotation]
+
+		if !found {
+			continue
+		}
+
+		processed = true
+		reviewer := fmt.Sprintf("%s/%s/%s", kindName, m.Namespace, m.Name)
+		digest = strings.ToLower(strings.TrimSpace(digest))
+
+		snapshotId := activeSnapshotId(m)
+		name := r.snapshotMgr.findPending(ctx, snapshotId, digest)
+
+		var rerr error
+
+		if len(name) == 0 {
+			rerr = fmt.Errorf("%w: no snapshot with the identifier %s and "+
+				"the digest %s is pending", errNotReviewable, snapshotId,
+				digest)
+		} else {
+			_, _, rerr = r.snapshotMgr.reviewPending(ctx, name, review.action,
+				reviewer, digest)
+		}
+
+		if rerr != nil {
+			r.Log.Error(rerr, "Failed to review the snapshot",
+				"Annotation", review.annotation, "Digest", digest)
+
+			if r.snapshotMgr.recorder != nil {
+				r.snapshotMgr.recorder.Event(m, apiV1.EventTypeWarning,
+					"SnapshotReviewFailed", rerr.Error())
+			}
+		}
+
+		delete(m.Annotations, review.annotation)
+	}
+
+	if !processed {
+		return
+	}
+
+	saved := m.Status
+
+	err = r.Update(ctx, m)
+
+	m.Status = saved
+
+	return
+}
+
+/*****************************************************************************/
@@ -0,0 +1,162 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+)
+
+/*****************************************************************************/
+
+/*
+ * This function is used to create a snapshot manager, with a local store,
+ * which gates the 'published' snapshot.
+ */
+
+func newTestGatedMgr(t *testing.T) *SnapshotMgr {
+	mgr := &SnapshotMgr{
+		log:         logr.Discard(),
+		store:       &localStore{root: t.TempDir()},
+		webMutex:    &sync.RWMutex{},
+		saveMutex:   &sync.Mutex{},
+		reviewMutex: &sync.Mutex{},
+		credsMutex:  &sync.RWMutex{},
+	}
+
+	mgr.setCreds(map[string]string{
+		userFieldName:         snapshotMgrUser,
+		rwPwdFieldName:        "rw-password",
+		roPwdFieldName:        "ro-password",
+		approverUserFieldName: approverUser,
+		approverPwdFieldName:  "approver-password",
+	})
+
+	mgr.options.GatedSnapshots = []string{"published"}
+
+	if err := mgr.store.Initialize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return mgr
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify that a gated snapshot can never be published without having been
+ * approved, whichever path is used to publish it.
+ */
+
+func TestSaveFileGated(t *testing.T) {
+	mgr := newTestGatedMgr(t)
+
+	name := "snapshots/ivia_11.0.0.0_published.snapshot"
+
+	for _, approval := range []string{"", approvalPending, approvalRejected} {
+		err := mgr.saveFile(context.Background(), name,
+			strings.NewReader("snapshot"), 0, "",
+			&fileMetadata{Approval: approval})
+
+		if !errors.Is(err, errNotApproved) {
+			t.Errorf("saveFile(%q) = %v, want %v", approval, err,
+				errNotApproved)
+		}
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify that the pending copy of a gated snapshot is only found if it has
+ * the same digest.
+ */
+
+func TestHeldSnapshot(t *testing.T) {
+	ctx := context.Background()
+	mgr := newTestGatedMgr(t)
+
+	gated := "snapshots/ivia_11.0.0.0_published.snapshot"
+	ungated := "snapshots/ivia_11.0.0.0_test.snapshot"
+
+	for _, name := range []string{gated, ungated} {
+		staged, metadata := stageTestFile(t, "snapshot")
+		metadata.Approval = approvalRejected
+
+		if err := mgr.store.Put(ctx, pendingName(name), staged,
+			metadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, metadata := stageTestFile(t, "snapshot")
+
+	if held := mgr.heldSnapshot(ctx, gated, metadata.Digest); held == nil ||
+		held.Approval != approvalRejected {
+		t.Errorf("the rejected snapshot was not found: %+v", held)
+	}
+
+	if held := mgr.heldSnapshot(ctx, gated, "0123"); held != nil {
+		t.Errorf("a snapshot with a different digest was found: %+v", held)
+	}
+
+	if held := mgr.heldSnapshot(ctx, ungated, metadata.Digest); held != nil {
+		t.Errorf("a snapshot which is not gated was found: %+v", held)
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify that a snapshot can only be reviewed with the approver credentials,
+ * whatever client is claimed by the request.
+ */
+
+func TestServeReviewCredentials(t *testing.T) {
+	mgr := newTestGatedMgr(t)
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		action   string
+		status   int
+	}{
+		{"uploader approves", snapshotMgrUser, "rw-password", "approve", http.StatusForbidden},
+		{"uploader rejects", snapshotMgrUser, "rw-password", "reject", http.StatusForbidden},
+		{"read-only approves", snapshotMgrUser, "ro-password", "approve", http.StatusUnauthorized},
+		{"wrong password", approverUser, "rw-password", "approve", http.StatusUnauthorized},
+		{"approver approves", approverUser, "approver-password", "approve", http.StatusNotFound},
+		{"approver rejects", approverUser, "approver-password", "reject", http.StatusNotFound},
+		{"approver rolls back", approverUser, "approver-password", "rollback", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost,
+				"/snapshots/ivia_11.0.0.0_published.snapshot/"+test.action+
+					"?client=release-manager&revision=1", nil)
+			r.SetBasicAuth(test.username, test.password)
+
+			w := httptest.NewRecorder()
+
+			mgr.serve(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, test.status,
+					w.Body.String())
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
@@ -0,0 +1,204 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	apiV1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+/*****************************************************************************/
+
+/*
+ * This function is used to automatically roll back a snapshot when one or
+ * more of the deployments which were restarted for the snapshot failed to
+ * complete their rollout.  The snapshot is only rolled back if it is still
+ * the snapshot which was published for the job.  The most recent revision of
+ * the snapshot which differs from the current revision is re-published, and
+ * the deployments are restarted again.  The Degraded condition of the
+ * custom resource of each failed deployment is set, and an event is
+ * recorded, to explain the rollback.
+ */
+
+func (mgr *SnapshotMgr) autoRollback(request restartRequest,
+	job *restartJob, failed []failedRollout) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "autoRollback")
+
+	/*
+	 * Only snapshots are rolled back, and a rollback is never itself rolled
+	 * back.
+	 */
+
+	if !mgr.options.AutoRollback || request.rollback ||
+		!strings.HasPrefix(request.path, "/snapshots/") {
+		return
+	}
+
+	ctx := context.TODO()
+	name := storeName(request.path)
+
+	reason := "RolloutFailed"
+	message := ""
+
+	current, err := mgr.statFile(ctx, name)
+
+	if err != nil {
+		message = fmt.Sprintf("The snapshot, %s, could not be rolled back: %v",
+			name, err)
+	} else if strings.HasPrefix(current.Client, snapshotKindName+"/") {
+		/*
+		 * A snapshot which is declared by a snapshot resource would simply
+		 * be restored by the resource, and so is not rolled back.
+		 */
+
+		message = fmt.Sprintf("The snapshot, %s, has not been rolled back "+
+			"as it is managed by the %s resource", name,
+			strings.TrimPrefix(current.Client, snapshotKindName+"/"))
+	} else if len(request.digest) == 0 || current.Digest != request.digest {
+		/*
+		 * A different snapshot has been published since the job was
+		 * started, and we must not roll back a snapshot which we have not
+		 * seen fail.
+		 */
+
+		message = fmt.Sprintf("The snapshot, %s, has not been rolled back "+
+			"as it has been replaced since the restart was started", name)
+	} else {
+		var previous *fileMetadata
+
+		for _, revision := range mgr.listRevisions(ctx, name) {
+			if revision.Revision < current.Revision &&
+				revision.Digest != current.Digest {
+				previous = revision
+
+				break
+			}
+		}
+
+		if previous == nil {
+			message = fmt.Sprintf("The snapshot, %s, could not be rolled "+
+				"back as there is no previous revision", name)
+		} else {
+			message, err = mgr.rollbackSnapshot(request, job, name,
+				previous.Revision)
+
+			if err == nil {
+				reason = "RolledBack"
+			}
+		}
+	}
+
+	mgr.log.Info("A rollout has failed", "Job", job.Id, "Reason", reason,
+		"Message", message)
+
+	/*
+	 * Record the Degraded condition, and an event, for each of the failed
+	 * deployments.
+	 */
+
+	rtClient, err := client.New(mgr.config,
+		client.Options{
+			Scheme: mgr.scheme,
+		})
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to create a new controller runtime client")
+
+		return
+	}
+
+	for _, rollout := range failed {
+		namespace, _, _ := strings.Cut(rollout.deployment, "/")
+
+		detail := fmt.Sprintf("The rollout of the %s deployment failed: %s.  "+
+			"%s.", rollout.deployment, strings.TrimSuffix(rollout.reason, "."),
+			message)
+
+		verifyaccess := mgr.updateConditions(rtClient, namespace,
+			rollout.resource, func(conditions *[]metaV1.Condition) {
+				apimeta.SetStatusCondition(conditions, metaV1.Condition{
+					Type:    degradedConditionType,
+					Status:  metaV1.ConditionTrue,
+					Reason:  reason,
+					Message: detail,
+				})
+			})
+
+		if verifyaccess != nil && mgr.recorder != nil {
+			mgr.recorder.Event(verifyaccess, apiV1.EventTypeWarning, reason,
+				detail)
+		}
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to re-publish the specified revision of a snapshot
+ * and to start a job which restarts the deployments again.  A message which
+ * describes the rollback is returned.
+ */
+
+func (mgr *SnapshotMgr) rollbackSnapshot(request restartRequest,
+	job *restartJob, name string, revision int) (message string, err error) {
+
+	client := fmt.Sprintf("rollback:%s", job.Id)
+
+	mgr.log.Info("Rolling back the snapshot", "Job", job.Id,
+		"File", name, "Revision", revision)
+
+	metadata, err := mgr.rollback(context.TODO(), name, revision, client)
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to roll back the snapshot", "File", name,
+			"Revision", revision)
+
+		message = fmt.Sprintf("The snapshot, %s, could not be rolled back "+
+			"to revision %d: %v", name, revision, err)
+
+		return
+	}
+
+	if metadata.Approval == approvalPending {
+		message = fmt.Sprintf("The snapshot, %s, has been rolled back to "+
+			"revision %d, which is waiting to be approved", name, revision)
+
+		job.rolledBack(revision, "")
+
+		return
+	}
+
+	rollbackJob := mgr.startRestart(restartRequest{
+		path:       request.path,
+		snapshotId: request.snapshotId,
+		services:   request.services,
+		client:     client,
+		rollback:   true,
+	})
+
+	jobId := ""
+
+	if rollbackJob != nil {
+		jobId = rollbackJob.Id
+	}
+
+	job.rolledBack(revision, jobId)
+
+	message = fmt.Sprintf("The snapshot, %s, has been rolled back to "+
+		"revision %d as revision %d", name, revision, metadata.Revision)
+
+	return
+}
+
+/*****************************************************************************/
@@ -0,0 +1,113 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr/funcr"
+)
+
+/*****************************************************************************/
+
+/*
+ * The unreadableStore structure is a local store from which no file can be
+ * read, so that a rollback is attempted without re-publishing any file.
+ */
+
+type unreadableStore struct {
+	*localStore
+}
+
+func (s unreadableStore) Get(ctx context.Context, name string) (
+	io.ReadCloser, *fileMetadata, error) {
+
+	return nil, nil, os.ErrNotExist
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify that a snapshot is only rolled back if it is still the snapshot
+ * which was published for the failed job.
+ */
+
+func TestAutoRollbackReplacedSnapshot(t *testing.T) {
+	ctx := context.Background()
+	name := "snapshots/ivia.snapshot"
+
+	mgr := &SnapshotMgr{
+		store:     unreadableStore{&localStore{root: t.TempDir()}},
+		webMutex:  &sync.RWMutex{},
+		saveMutex: &sync.Mutex{},
+	}
+
+	mgr.options.AutoRollback = true
+	mgr.options.SnapshotHistory = 5
+
+	var logged strings.Builder
+
+	mgr.log = funcr.New(func(prefix, args string) {
+		logged.WriteString(args + "\n")
+	}, funcr.Options{})
+
+	if err := mgr.store.Initialize(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	/*
+	 * The working snapshot, the failed snapshot and then the corrected
+	 * snapshot.
+	 */
+
+	digests := []string{}
+
+	for revision, content := range []string{"working", "failed", "fixed"} {
+		staged, metadata := stageTestFile(t, content)
+		metadata.Revision = revision + 1
+
+		if err := mgr.store.Put(ctx, name, staged, metadata); err != nil {
+			t.Fatal(err)
+		}
+
+		mgr.addRevision(ctx, name, metadata.Revision)
+
+		digests = append(digests, metadata.Digest)
+	}
+
+	tests := []struct {
+		name       string
+		digest     string
+		rolledBack bool
+	}{
+		{"replaced snapshot", digests[1], false},
+		{"unknown snapshot", "", false},
+		{"current snapshot", digests[2], true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logged.Reset()
+
+			mgr.autoRollback(restartRequest{
+				path:   "/" + name,
+				digest: test.digest,
+			}, &restartJob{Id: "test", mutex: &sync.Mutex{}}, nil)
+
+			if rolledBack := strings.Contains(logged.String(),
+				"Rolling back the snapshot"); rolledBack != test.rolledBack {
+				t.Errorf("rolled back = %v, want %v: %s", rolledBack,
+					test.rolledBack, logged.String())
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
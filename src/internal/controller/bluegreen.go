@@ -0,0 +1,483 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ibmv1 "github.com/ibm-security/verify-access-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * With the BlueGreen upgrade strategy a custom resource is deployed as a
+ * blue and a green deployment, named '<name>-blue' and '<name>-green', along
+ * with a service, named '<name>', which selects the pods of the active
+ * deployment.  When the image of the custom resource is changed the new
+ * image is deployed as the inactive colour, and the service is switched to
+ * the new deployment once it is ready.  The old deployment is kept for a
+ * grace period, during which the upgrade can be aborted, and is then
+ * removed.  The upgrade can be promoted, or aborted, by setting the
+ * 'ibm.com/blue-green-action' annotation of the custom resource to
+ * 'promote' or 'abort'.  The annotation is removed once it has been
+ * processed.
+ */
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to reconcile a custom resource which uses
+ * the BlueGreen upgrade strategy.
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) reconcileBlueGreen(
+	ctx context.Context,
+	m *ibmv1.IBMSecurityVerifyAccess) (ctrl.Result, error) {
+
+	r.Log.V(9).Info("Entering a function", "Function", "reconcileBlueGreen")
+
+	status := m.Status.BlueGreen
+
+	if status == nil {
+		status = &ibmv1.IBMSecurityVerifyAccessBlueGreenStatus{
+			ActiveColor: blueGreenBlue,
+			ActiveImage: m.Spec.Image,
+		}
+	}
+
+	/*
+	 * The deployments require the secret which contains the snapshot
+	 * manager credentials.
+	 */
+
+	var active *appsv1.Deployment
+
+	err := r.createSecret(ctx, m)
+
+	if err == nil {
+		active, err = r.applyColor(ctx, m, status.ActiveColor,
+			status.ActiveImage)
+	}
+
+	if err != nil {
+		r.setCondition(err, true, ctx, m)
+
+		return ctrl.Result{}, err
+	}
+
+	/*
+	 * Work out what needs to be done next.
+	 */
+
+	action := m.Annotations[blueGreenActionAnnotation]
+	inactive := otherColor(status.ActiveColor)
+	result := ctrl.Result{}
+	teardown := false
+
+	gracePeriod := blueGreenDefaultGracePeriod
+	autoPromote := true
+
+	if m.Spec.BlueGreen != nil {
+		autoPromote = m.Spec.BlueGreen.AutoPromote
+
+		if m.Spec.BlueGreen.GracePeriod != nil {
+			gracePeriod = m.Spec.BlueGreen.GracePeriod.Duration
+		}
+	}
+
+	switch {
+	case len(status.PreviousImage) > 0:
+		/*
+		 * The service has been switched to the active deployment, and the
+		 * previous deployment is being kept for the grace period.
+		 */
+
+		elapsed := time.Since(status.PromotedTime.Time)
+
+		if action == blueGreenActionAbort {
+			status.Message = fmt.Sprintf("The upgrade to %s was aborted, "+
+				"and the service has been switched back to the %s "+
+				"deployment.", status.ActiveImage, inactive)
+			status.AbortedImage = status.ActiveImage
+			status.ActiveColor = inactive
+			status.ActiveImage = status.PreviousImage
+			status.PreviousImage = ""
+			status.PromotedTime = nil
+			teardown = true
+		} else if action == blueGreenActionPromote || elapsed >= gracePeriod {
+			status.Message = fmt.Sprintf("The upgrade to %s is complete.",
+				status.ActiveImage)
+			status.PreviousImage = ""
+			teardown = true
+		} else {
+			result.RequeueAfter = gracePeriod - elapsed
+		}
+
+	case m.Spec.Image != status.ActiveImage &&
+		m.Spec.Image != status.AbortedImage:
+		/*
+		 * The image has been changed, and so the new image is deployed as
+		 * the inactive colour.
+		 */
+
+		if action == blueGreenActionAbort {
+			status.Message = fmt.Sprintf("The upgrade to %s was aborted.",
+				m.Spec.Image)
+			status.AbortedImage = m.Spec.Image
+			teardown = true
+
+			break
+		}
+
+		preview, perr := r.applyColor(ctx, m, inactive, m.Spec.Image)
+
+		if perr != nil {
+			r.setCondition(perr, true, ctx, m)
+
+			return ctrl.Result{}, perr
+		}
+
+		result.RequeueAfter = blueGreenCheckInterval
+
+		done, failure := rolloutStatus(preview, preview.Generation)
+
+		switch {
+		case len(failure) > 0:
+			status.Message = failure
+
+		case !done:
+			status.Message = fmt.Sprintf("Waiting for the %s deployment, "+
+				"which uses %s, to become ready.", inactive, m.Spec.Image)
+
+		case !autoPromote && action != blueGreenActionPromote:
+			status.Message = fmt.Sprintf("The %s deployment, which uses %s, "+
+				"is ready and is waiting to be promoted.", inactive,
+				m.Spec.Image)
+
+		default:
+			r.Log.Info("Switching the service to the new deployment",
+				"Deployment.Namespace", preview.Namespace,
+				"Deployment.Name", preview.Name)
+
+			now := metav1.Now()
+
+			status.Message = fmt.Sprintf("The service has been switched to "+
+				"the %s deployment, which uses %s.", inactive, m.Spec.Image)
+			status.PreviousImage = status.ActiveImage
+			status.ActiveColor = inactive
+			status.ActiveImage = m.Spec.Image
+			status.AbortedImage = ""
+			status.PromotedTime = &now
+
+			result.RequeueAfter = gracePeriod
+		}
+
+	default:
+		/*
+		 * There is no upgrade in progress, and so the inactive deployment
+		 * should not exist.
+		 */
+
+		teardown = true
+	}
+
+	/*
+	 * Point the service at the active deployment, and only then remove the
+	 * inactive deployment.
+	 */
+
+	err = r.applyService(ctx, m, status.ActiveColor)
+
+	if err == nil && teardown {
+		err = r.deleteColor(ctx, m, otherColor(status.ActiveColor))
+	}
+
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	/*
+	 * Remove the action annotation, now that it has been processed, and
+	 * save the status.
+	 */
+
+	if len(action) > 0 {
+		saved := m.Status
+
+		delete(m.Annotations, blueGreenActionAnnotation)
+
+		if err = r.Update(ctx, m); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		m.Status = saved
+	}
+
+	m.Status.BlueGreen = status
+
+	if err = r.Status().Update(ctx, m); err != nil {
+		r.Log.Error(err, "Failed to update the status for the resource",
+			"Deployment.Namespace", m.Namespace,
+			"Deployment.Name", m.Name)
+
+		return ctrl.Result{}, err
+	}
+
+	/*
+	 * A canary rollout is run against the active deployment.
+	 */
+
+	canaryResult, err := r.reconcileCanary(ctx, m, active)
+
+	return earliestResult(result, canaryResult), err
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to return the other colour.
+ */
+
+func otherColor(color string) string {
+	if color == blueGreenBlue {
+		return blueGreenGreen
+	}
+
+	return blueGreenBlue
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to return the name of the deployment of
+ * the specified colour.
+ */
+
+func colorNameForVerifyAccess(
+	m *ibmv1.IBMSecurityVerifyAccess, color string) string {
+	return m.Name + "-" + color
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to return the deployment of the specified
+ * colour, which uses the specified image.  The deployment is the same as the
+ * deployment of the custom resource, other than the name, the image and the
+ * colour label.
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) colorDeploymentForVerifyAccess(
+	m *ibmv1.IBMSecurityVerifyAccess,
+	color string,
+	image string) *appsv1.Deployment {
+
+	colored := m.DeepCopyObject().(*ibmv1.IBMSecurityVerifyAccess)
+	colored.Spec.Image = image
+
+	dep := r.deploymentForVerifyAccess(colored)
+
+	labels := map[string]string{}
+
+	for key, value := range dep.Labels {
+		labels[key] = value
+	}
+
+	labels["VerifyAccess_color"] = color
+
+	dep.Name = colorNameForVerifyAccess(m, color)
+	dep.Labels = labels
+	dep.Spec.Selector = &metav1.LabelSelector{MatchLabels: labels}
+	dep.Spec.Template.Labels = labels
+
+	return dep
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to create, or update, the deployment of
+ * the specified colour.  An existing deployment is only updated if it uses
+ * a different image, or a different number of replicas.
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) applyColor(
+	ctx context.Context,
+	m *ibmv1.IBMSecurityVerifyAccess,
+	color string,
+	image string) (*appsv1.Deployment, error) {
+
+	desired := r.colorDeploymentForVerifyAccess(m, color, image)
+
+	dep := &appsv1.Deployment{}
+	err := r.Get(ctx,
+		types.NamespacedName{Name: desired.Name, Namespace: desired.Namespace},
+		dep)
+
+	if errors.IsNotFound(err) {
+		r.Log.Info("Creating a new deployment",
+			"Deployment.Namespace", desired.Namespace,
+			"Deployment.Name", desired.Name,
+			"Image", image)
+
+		err = r.Create(ctx, desired)
+
+		if err != nil {
+			r.Log.Error(err, "Failed to create the new deployment",
+				"Deployment.Namespace", desired.Namespace,
+				"Deployment.Name", desired.Name)
+		}
+
+		return desired, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	if dep.Spec.Template.Spec.Containers[0].Image != image {
+		dep.Spec.Template = desired.Spec.Template
+	} else if *dep.Spec.Replicas == *desired.Spec.Replicas {
+		return dep, nil
+	}
+
+	dep.Spec.Replicas = desired.Spec.Replicas
+
+	err = r.Update(ctx, dep)
+
+	if err != nil {
+		r.Log.Error(err, "Failed to update deployment",
+			"Deployment.Namespace", dep.Namespace,
+			"Deployment.Name", dep.Name)
+	} else {
+		r.Log.Info("Updated an existing deployment",
+			"Deployment.Namespace", dep.Namespace,
+			"Deployment.Name", dep.Name)
+	}
+
+	return dep, err
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to delete the deployment of the specified
+ * colour, if it exists.
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) deleteColor(
+	ctx context.Context,
+	m *ibmv1.IBMSecurityVerifyAccess,
+	color string) error {
+
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      colorNameForVerifyAccess(m, color),
+			Namespace: m.Namespace,
+		},
+	}
+
+	err := r.Delete(ctx, dep,
+		client.PropagationPolicy(metav1.DeletePropagationBackground))
+
+	if errors.IsNotFound(err) {
+		return nil
+	}
+
+	if err == nil {
+		r.Log.Info("Deleted the inactive deployment",
+			"Deployment.Namespace", dep.Namespace,
+			"Deployment.Name", dep.Name)
+	}
+
+	return err
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to create, or update, the service of a
+ * custom resource so that it selects the pods of the specified colour.  An
+ * existing service which is not owned by the custom resource is never
+ * modified.
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) applyService(
+	ctx context.Context,
+	m *ibmv1.IBMSecurityVerifyAccess,
+	color string) error {
+
+	selector := map[string]string{
+		"VerifyAccess_cr":    m.Name,
+		"VerifyAccess_color": color,
+	}
+
+	svc := &corev1.Service{}
+	err := r.Get(ctx,
+		types.NamespacedName{Name: m.Name, Namespace: m.Namespace}, svc)
+
+	if errors.IsNotFound(err) {
+		svc = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      m.Name,
+				Namespace: m.Namespace,
+				Labels: map[string]string{
+					"kind":            kindName,
+					"app":             m.Name,
+					"VerifyAccess_cr": m.Name,
+				},
+			},
+			Spec: corev1.ServiceSpec{
+				Selector: selector,
+				Ports: []corev1.ServicePort{{
+					Name:       "https",
+					Port:       9443,
+					Protocol:   corev1.ProtocolTCP,
+					TargetPort: intstr.FromString("https"),
+				}},
+			},
+		}
+
+		ctrl.SetControllerReference(m, svc, r.Scheme)
+
+		r.Log.Info("Creating a new service",
+			"Service.Namespace", svc.Namespace,
+			"Service.Name", svc.Name)
+
+		return r.Create(ctx, svc)
+	} else if err != nil {
+		return err
+	}
+
+	if !metav1.IsControlledBy(svc, m) {
+		return fmt.Errorf("The service, %s, already exists and is not "+
+			"managed by the operator", svc.Name)
+	}
+
+	if svc.Spec.Selector["VerifyAccess_color"] == color {
+		return nil
+	}
+
+	r.Log.Info("Switching the service", "Service.Namespace", svc.Namespace,
+		"Service.Name", svc.Name, "Color", color)
+
+	svc.Spec.Selector = selector
+
+	return r.Update(ctx, svc)
+}
+
+/*****************************************************************************/
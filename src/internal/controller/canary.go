@@ -0,0 +1,504 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ibmv1 "github.com/ibm-security/verify-access-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * A canary rollout runs a candidate snapshot in a temporary canary
+ * deployment alongside the deployment of a custom resource.  The pods of the
+ * canary deployment share the 'app' label of the deployment, and so receive
+ * a share of the traffic of a service which selects the 'app' label, but do
+ * not have the VerifyAccess_cr label, and so are never restarted when a
+ * snapshot is published.  The candidate snapshot is promoted once the canary
+ * deployment has been ready, and has passed the optional HTTP check, for the
+ * duration of the canary.  Otherwise the candidate snapshot is discarded.
+ */
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to reconcile the canary rollout of a
+ * custom resource, once the deployment of the custom resource exists.
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) reconcileCanary(
+	ctx context.Context,
+	m *ibmv1.IBMSecurityVerifyAccess,
+	found *appsv1.Deployment) (ctrl.Result, error) {
+
+	r.Log.V(9).Info("Entering a function", "Function", "reconcileCanary")
+
+	canary := m.Spec.Canary
+	status := m.Status.Canary
+
+	/*
+	 * The canary deployment is removed if there is no candidate snapshot,
+	 * or if the candidate snapshot has already been promoted or discarded.
+	 */
+
+	if canary == nil || canary.SnapshotId == m.Spec.SnapshotId ||
+		(status != nil && status.SnapshotId == canary.SnapshotId &&
+			status.Phase != canaryPhaseRunning) {
+		return ctrl.Result{}, r.deleteCanary(ctx, m)
+	}
+
+	/*
+	 * Start the canary rollout of a new candidate snapshot.
+	 */
+
+	if status == nil || status.SnapshotId != canary.SnapshotId {
+		now := metav1.Now()
+
+		status = &ibmv1.IBMSecurityVerifyAccessCanaryStatus{
+			SnapshotId: canary.SnapshotId,
+			Phase:      canaryPhaseRunning,
+			StartTime:  &now,
+			Message:    "The canary deployment has been started.",
+		}
+
+		r.Log.Info("Starting a canary rollout",
+			"Deployment.Namespace", m.Namespace,
+			"Deployment.Name", m.Name,
+			"Snapshot.Id", canary.SnapshotId)
+	}
+
+	dep, err := r.applyCanary(ctx, m)
+
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	/*
+	 * Check the health of the canary deployment.
+	 */
+
+	duration := canaryDefaultDuration
+
+	if canary.Duration != nil {
+		duration = canary.Duration.Duration
+	}
+
+	done, failure := rolloutStatus(dep, dep.Generation)
+
+	switch {
+	case len(failure) > 0:
+		/*
+		 * The canary deployment has exceeded its progress deadline.
+		 */
+
+	case !done && status.ReadyTime != nil:
+		failure = "The canary deployment is no longer available"
+
+	case !done &&
+		time.Since(status.StartTime.Time) > r.SnapshotMgrOptions.RestartTimeout:
+		failure = fmt.Sprintf("The canary deployment did not become ready "+
+			"within %s", r.SnapshotMgrOptions.RestartTimeout)
+
+	case done:
+		if status.ReadyTime == nil {
+			now := metav1.Now()
+			status.ReadyTime = &now
+			status.Message = "The canary deployment is ready."
+		}
+
+		if canary.HTTPCheck != nil {
+			if cerr := r.checkCanary(ctx, m, canary.HTTPCheck); cerr != nil {
+				failure = fmt.Sprintf("The HTTP check of the canary "+
+					"deployment failed: %v", cerr)
+			}
+		}
+	}
+
+	/*
+	 * Discard the candidate snapshot if the canary has failed, or promote
+	 * the candidate snapshot once the canary has been healthy for long
+	 * enough.
+	 */
+
+	result := ctrl.Result{RequeueAfter: canaryCheckInterval}
+
+	if len(failure) > 0 {
+		r.Log.Info("Discarding the candidate snapshot",
+			"Deployment.Namespace", m.Namespace,
+			"Deployment.Name", m.Name,
+			"Snapshot.Id", canary.SnapshotId,
+			"Reason", failure)
+
+		status.Phase = canaryPhaseDiscarded
+		status.Message = failure
+		result = ctrl.Result{}
+
+		err = r.deleteCanary(ctx, m)
+	} else if status.ReadyTime != nil &&
+		time.Since(status.ReadyTime.Time) >= duration {
+		r.Log.Info("Promoting the candidate snapshot",
+			"Deployment.Namespace", m.Namespace,
+			"Deployment.Name", m.Name,
+			"Snapshot.Id", canary.SnapshotId)
+
+		err = r.promoteCanary(ctx, m, found)
+
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		status.Phase = canaryPhasePromoted
+		status.Message = fmt.Sprintf("The candidate snapshot, %s, has been "+
+			"promoted.", canary.SnapshotId)
+		result = ctrl.Result{}
+
+		err = r.deleteCanary(ctx, m)
+	}
+
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	m.Status.Canary = status
+
+	if err = r.Status().Update(ctx, m); err != nil {
+		r.Log.Error(err, "Failed to update the canary status for the resource",
+			"Deployment.Namespace", m.Namespace,
+			"Deployment.Name", m.Name)
+
+		return ctrl.Result{}, err
+	}
+
+	return result, nil
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to create, or update, the canary
+ * deployment of a custom resource so that it uses the candidate snapshot.
+ * The canary deployment is returned.
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) applyCanary(
+	ctx context.Context,
+	m *ibmv1.IBMSecurityVerifyAccess) (*appsv1.Deployment, error) {
+
+	desired := r.canaryDeploymentForVerifyAccess(m)
+
+	dep := &appsv1.Deployment{}
+	err := r.Get(ctx,
+		types.NamespacedName{Name: desired.Name, Namespace: desired.Namespace},
+		dep)
+
+	if errors.IsNotFound(err) {
+		r.Log.Info("Creating a new canary deployment",
+			"Deployment.Namespace", desired.Namespace,
+			"Deployment.Name", desired.Name)
+
+		err = r.Create(ctx, desired)
+
+		return desired, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	/*
+	 * The canary deployment is replaced if it uses a different candidate
+	 * snapshot, or a different number of replicas.
+	 */
+
+	if snapshotIdOf(dep) != snapshotIdOf(desired) ||
+		*dep.Spec.Replicas != *desired.Spec.Replicas {
+		r.Log.Info("Updating the canary deployment",
+			"Deployment.Namespace", dep.Namespace,
+			"Deployment.Name", dep.Name)
+
+		dep.Spec.Replicas = desired.Spec.Replicas
+		dep.Spec.Template = desired.Spec.Template
+
+		err = r.Update(ctx, dep)
+	}
+
+	return dep, err
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to return the canary deployment of a
+ * custom resource.  The canary deployment is the same as the deployment of
+ * the custom resource, other than the snapshot, the number of replicas, the
+ * name and the labels.
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) canaryDeploymentForVerifyAccess(
+	m *ibmv1.IBMSecurityVerifyAccess) *appsv1.Deployment {
+
+	candidate := m.DeepCopyObject().(*ibmv1.IBMSecurityVerifyAccess)
+
+	candidate.Spec.SnapshotId = m.Spec.Canary.SnapshotId
+	candidate.Spec.Replicas = m.Spec.Canary.Replicas
+
+	if candidate.Spec.Replicas <= 0 {
+		candidate.Spec.Replicas = 1
+	}
+
+	dep := r.deploymentForVerifyAccess(candidate)
+
+	labels := map[string]string{
+		"app":                 m.Name,
+		"VerifyAccess_canary": m.Name,
+	}
+
+	dep.Name = canaryNameForVerifyAccess(m)
+	dep.Labels = labels
+	dep.Spec.Selector = &metav1.LabelSelector{MatchLabels: labels}
+	dep.Spec.Template.Labels = labels
+
+	return dep
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to return the name of the canary
+ * deployment of a custom resource.
+ */
+
+func canaryNameForVerifyAccess(m *ibmv1.IBMSecurityVerifyAccess) string {
+	return m.Name + canaryNameSuffix
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to return the snapshot identifier which is
+ * used by a deployment.
+ */
+
+func snapshotIdOf(dep *appsv1.Deployment) (snapshotId string) {
+	for _, env := range dep.Spec.Template.Spec.Containers[0].Env {
+		if env.Name == "SNAPSHOT_ID" {
+			snapshotId = env.Value
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to delete the canary deployment of a
+ * custom resource, if it exists.
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) deleteCanary(
+	ctx context.Context,
+	m *ibmv1.IBMSecurityVerifyAccess) error {
+
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      canaryNameForVerifyAccess(m),
+			Namespace: m.Namespace,
+		},
+	}
+
+	err := r.Delete(ctx, dep,
+		client.PropagationPolicy(metav1.DeletePropagationBackground))
+
+	if errors.IsNotFound(err) {
+		return nil
+	}
+
+	if err == nil {
+		r.Log.Info("Deleted the canary deployment",
+			"Deployment.Namespace", dep.Namespace,
+			"Deployment.Name", dep.Name)
+	}
+
+	return err
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to promote the candidate snapshot of a
+ * custom resource.  The snapshot identifier of the deployment is replaced by
+ * the candidate snapshot identifier, which triggers a rolling update of the
+ * deployment.  The specification of the custom resource is left alone, so
+ * that it is not reverted by GitOps tooling, and the promotion is instead
+ * recorded in the canary status of the custom resource.
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) promoteCanary(
+	ctx context.Context,
+	m *ibmv1.IBMSecurityVerifyAccess,
+	found *appsv1.Deployment) (err error) {
+
+	snapshotId := m.Spec.Canary.SnapshotId
+
+	if snapshotIdOf(found) != snapshotId {
+		container := &found.Spec.Template.Spec.Containers[0]
+		replaced := false
+
+		for idx := range container.Env {
+			if container.Env[idx].Name == "SNAPSHOT_ID" {
+				container.Env[idx].Value = snapshotId
+				replaced = true
+			}
+		}
+
+		if !replaced {
+			container.Env = append(container.Env,
+				corev1.EnvVar{Name: "SNAPSHOT_ID", Value: snapshotId})
+		}
+
+		err = r.Update(ctx, found)
+
+		if err != nil {
+			r.Log.Error(err, "Failed to update deployment",
+				"Deployment.Namespace", found.Namespace,
+				"Deployment.Name", found.Name)
+
+			return
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to return the identifier of the snapshot
+ * which is used by the deployment of a custom resource.  This is the
+ * candidate snapshot of the canary once it has been promoted, and otherwise
+ * the snapshot identifier of the custom resource.
+ */
+
+func activeSnapshotId(m *ibmv1.IBMSecurityVerifyAccess) string {
+	canary := m.Spec.Canary
+	status := m.Status.Canary
+
+	if canary != nil && status != nil &&
+		status.Phase == canaryPhasePromoted &&
+		status.SnapshotId == canary.SnapshotId {
+		return canary.SnapshotId
+	}
+
+	return m.Spec.SnapshotId
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to send the HTTP check of a canary to each
+ * of the ready pods of the canary deployment.  An error is returned if a
+ * request fails, or returns an error status.
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) checkCanary(
+	ctx context.Context,
+	m *ibmv1.IBMSecurityVerifyAccess,
+	check *ibmv1.IBMSecurityVerifyAccessCanaryHTTPCheck) error {
+
+	pods := &corev1.PodList{}
+
+	err := r.List(ctx, pods,
+		client.InNamespace(m.Namespace),
+		client.MatchingLabels{"VerifyAccess_canary": m.Name})
+
+	if err != nil {
+		return err
+	}
+
+	scheme := "https"
+
+	if check.Scheme == corev1.URISchemeHTTP {
+		scheme = "http"
+	}
+
+	port := check.Port
+
+	if port == 0 {
+		port = canaryDefaultPort
+	}
+
+	httpClient := &http.Client{
+		Timeout: canaryCheckTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	for _, pod := range pods.Items {
+		if len(pod.Status.PodIP) == 0 || pod.DeletionTimestamp != nil ||
+			!podReady(&pod) {
+			continue
+		}
+
+		url := fmt.Sprintf("%s://%s%s", scheme,
+			net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(int(port))),
+			check.Path)
+
+		req, rerr := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+		if rerr != nil {
+			return rerr
+		}
+
+		rsp, rerr := httpClient.Do(req)
+
+		if rerr != nil {
+			return fmt.Errorf("%s: %w", pod.Name, rerr)
+		}
+
+		rsp.Body.Close()
+
+		if rsp.StatusCode >= http.StatusBadRequest {
+			return fmt.Errorf("%s: %s", pod.Name, rsp.Status)
+		}
+	}
+
+	return nil
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to determine whether a pod is ready.
+ */
+
+func podReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+/*****************************************************************************/
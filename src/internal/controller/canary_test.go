@@ -0,0 +1,144 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	ibmv1 "github.com/ibm-security/verify-access-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * Verify that the candidate snapshot of a canary is only used once it has
+ * been promoted, and for as long as it remains the candidate snapshot.
+ */
+
+func TestActiveSnapshotId(t *testing.T) {
+	canary := &ibmv1.IBMSecurityVerifyAccessCanary{SnapshotId: "candidate"}
+
+	status := func(snapshotId string,
+		phase string) *ibmv1.IBMSecurityVerifyAccessCanaryStatus {
+		return &ibmv1.IBMSecurityVerifyAccessCanaryStatus{
+			SnapshotId: snapshotId,
+			Phase:      phase,
+		}
+	}
+
+	tests := []struct {
+		name   string
+		canary *ibmv1.IBMSecurityVerifyAccessCanary
+		status *ibmv1.IBMSecurityVerifyAccessCanaryStatus
+		want   string
+	}{
+		{"no canary", nil, nil, "published"},
+		{"running", canary, status("candidate", canaryPhaseRunning),
+			"published"},
+		{"discarded", canary, status("candidate", canaryPhaseDiscarded),
+			"published"},
+		{"promoted", canary, status("candidate", canaryPhasePromoted),
+			"candidate"},
+		{"previous candidate promoted", canary,
+			status("previous", canaryPhasePromoted), "published"},
+		{"canary removed", nil, status("candidate", canaryPhasePromoted),
+			"published"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &ibmv1.IBMSecurityVerifyAccess{}
+			m.Spec.SnapshotId = "published"
+			m.Spec.Canary = test.canary
+			m.Status.Canary = test.status
+
+			if snapshotId := activeSnapshotId(m); snapshotId != test.want {
+				t.Errorf("activeSnapshotId = %q, want %q", snapshotId,
+					test.want)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify that the promotion of a candidate snapshot updates the deployment,
+ * but not the specification of the custom resource.
+ */
+
+func TestPromoteCanary(t *testing.T) {
+	ctx := context.Background()
+
+	m := &ibmv1.IBMSecurityVerifyAccess{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "wrp"},
+		Spec: ibmv1.IBMSecurityVerifyAccessSpec{
+			SnapshotId: "published",
+			Canary: &ibmv1.IBMSecurityVerifyAccessCanary{
+				SnapshotId: "candidate",
+			},
+		},
+	}
+
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "wrp"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name: "wrp",
+						Env: []corev1.EnvVar{
+							{Name: "SNAPSHOT_ID", Value: "published"},
+						},
+					}},
+				},
+			},
+		},
+	}
+
+	r := &IBMSecurityVerifyAccessReconciler{
+		Client: fake.NewClientBuilder().
+			WithScheme(newTestScheme(t)).
+			WithObjects(m, dep).
+			Build(),
+		Log: logr.Discard(),
+	}
+
+	if err := r.promoteCanary(ctx, m, dep); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := &ibmv1.IBMSecurityVerifyAccess{}
+
+	if err := r.Get(ctx, client.ObjectKeyFromObject(m), saved); err != nil {
+		t.Fatal(err)
+	}
+
+	if saved.Spec.SnapshotId != "published" {
+		t.Errorf("the snapshot identifier of the resource was changed to %q",
+			saved.Spec.SnapshotId)
+	}
+
+	updated := &appsv1.Deployment{}
+
+	if err := r.Get(ctx, client.ObjectKeyFromObject(dep), updated); err != nil {
+		t.Fatal(err)
+	}
+
+	if snapshotId := snapshotIdOf(updated); snapshotId != "candidate" {
+		t.Errorf("the snapshot identifier of the deployment = %q, want %q",
+			snapshotId, "candidate")
+	}
+}
+
+/*****************************************************************************/
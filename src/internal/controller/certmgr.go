@@ -0,0 +1,1238 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiV1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+
+	ibmv1 "github.com/ibm-security/verify-access-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * This function is used to generate a new private key, returning both the
+ * key and the PEM encoding of the key.
+ */
+
+func (mgr *SnapshotMgr) generatePrivateKey() (
+	priv crypto.Signer, keyPem string, err error) {
+
+	priv, err = mgr.options.TLSPolicy.generateKey()
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to generate a private key",
+			"Key.Type", mgr.options.TLSPolicy.KeyType,
+			"Key.Size", mgr.options.TLSPolicy.KeySize)
+
+		return
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to marshal the private key")
+
+		return
+	}
+
+	keyPem = encodePem("PRIVATE KEY", der)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to generate a random serial number for a new
+ * certificate.
+ */
+
+func generateSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to PEM encode the supplied DER bytes.  The trailing
+ * new line is removed as it is sometimes stripped when the value is stored
+ * in a secret, which would in turn break the comparisons which are performed
+ * when checking whether a secret needs to be updated.
+ */
+
+func encodePem(blockType string, der []byte) string {
+	out := &bytes.Buffer{}
+
+	pem.Encode(out, &pem.Block{
+		Type:  blockType,
+		Bytes: der,
+	})
+
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to parse the first certificate contained within the
+ * supplied PEM data.
+ */
+
+func parseCertificate(certPem string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPem))
+
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("No certificate was found in the PEM data")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to parse each of the certificates contained within
+ * the supplied PEM data.  Any other PEM blocks are ignored.
+ */
+
+func parseCertificates(certPem string) (certs []*x509.Certificate) {
+	rest := []byte(certPem)
+
+	for {
+		var block *pem.Block
+
+		block, rest = pem.Decode(rest)
+
+		if block == nil {
+			return
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return a CA bundle which contains the supplied
+ * PEM encoded CA certificate, followed by each of the supplied certificates.
+ */
+
+func encodeBundle(caCert string, others []*x509.Certificate) string {
+	bundle := []string{caCert}
+
+	for _, cert := range others {
+		bundle = append(bundle, encodePem("CERTIFICATE", cert.Raw))
+	}
+
+	return strings.Join(bundle, "\n")
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to determine whether the supplied certificate has
+ * been signed by any of the supplied CA certificates.
+ */
+
+func signedByAny(cert *x509.Certificate, cas []*x509.Certificate) bool {
+	for _, ca := range cas {
+		if cert.CheckSignatureFrom(ca) == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to determine whether the CA rotation overlap period
+ * has elapsed for a certificate which is valid from the supplied time.  The
+ * start of the validity period of a generated certificate is back-dated to
+ * allow for clock skew, and so this is taken into account.
+ */
+
+func overlapElapsed(notBefore time.Time) bool {
+	return time.Since(notBefore.Add(certClockSkew)) >= caRotationOverlap
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to parse a PEM encoded private key.  Keys generated
+ * by earlier versions of the operator were stored in the PKCS#1 format, and
+ * so we continue to accept this format.
+ */
+
+func parsePrivateKey(keyPem string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(keyPem))
+
+	if block == nil {
+		return nil, errors.New("No private key was found in the PEM data")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		signer, ok := key.(crypto.Signer)
+
+		if !ok {
+			return nil, errors.New("The private key type is not supported")
+		}
+
+		return signer, nil
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to generate the certificate authority
+ * which is used to sign the certificate of the snapshot manager.
+ */
+
+func (mgr *SnapshotMgr) generateCA() (cert string, key string, err error) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "generateCA")
+
+	priv, key, err := mgr.generatePrivateKey()
+
+	if err != nil {
+		return
+	}
+
+	serial, err := generateSerialNumber()
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to generate a serial number")
+
+		return
+	}
+
+	now := time.Now()
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   caCommonName,
+			Organization: []string{"IBM"},
+		},
+		NotBefore:             now.Add(-certClockSkew),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		priv.Public(), priv)
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to generate the CA certificate")
+
+		return
+	}
+
+	cert = encodePem("CERTIFICATE", derBytes)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to return the DNS names by which the
+ * snapshot manager service can be reached.
+ */
+
+func serviceDNSNames(namespace string) []string {
+	return []string{
+		serviceName,
+		fmt.Sprintf("%s.%s", serviceName, namespace),
+		fmt.Sprintf("%s.%s.svc", serviceName, namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", serviceName, namespace),
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to generate the serving certificate for the
+ * snapshot manager, signed by the supplied certificate authority.
+ */
+
+func (mgr *SnapshotMgr) generateServingCert(caCert string, caKey string) (
+	cert string, key string, err error) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "generateServingCert")
+
+	ca, err := parseCertificate(caCert)
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to parse the CA certificate")
+
+		return
+	}
+
+	caPriv, err := parsePrivateKey(caKey)
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to parse the CA key")
+
+		return
+	}
+
+	priv, key, err := mgr.generatePrivateKey()
+
+	if err != nil {
+		return
+	}
+
+	serial, err := generateSerialNumber()
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to generate a serial number")
+
+		return
+	}
+
+	dnsNames := serviceDNSNames(mgr.namespace)
+	now := time.Now()
+
+	keyUsage := x509.KeyUsageDigitalSignature
+
+	if _, isRSA := priv.(*rsa.PrivateKey); isRSA {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   dnsNames[len(dnsNames)-1],
+			Organization: []string{"IBM"},
+		},
+		DNSNames:              dnsNames,
+		NotBefore:             now.Add(-certClockSkew),
+		NotAfter:              now.Add(certValidity),
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, ca,
+		priv.Public(), caPriv)
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to generate the serving certificate")
+
+		return
+	}
+
+	cert = encodePem("CERTIFICATE", derBytes)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * Earlier versions of the operator generated a single self-signed
+ * certificate which acted as both the CA and the server certificate.  This
+ * function is used to detect such a certificate so that it can be replaced
+ * with a proper CA and serving certificate.  Certificates which have been
+ * supplied by the administrator are left untouched.
+ */
+
+func isLegacyCertificate(cert *x509.Certificate) bool {
+	if !cert.IsCA || cert.Subject.String() != cert.Issuer.String() {
+		return false
+	}
+
+	for _, name := range cert.DNSNames {
+		if strings.HasSuffix(name, fmt.Sprintf(":%d", httpsPort)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to determine whether the supplied certificate is
+ * close enough to its expiry that it should be renewed.
+ */
+
+func needsRenewal(cert *x509.Certificate, renewBefore time.Duration) bool {
+	return time.Now().Add(renewBefore).After(cert.NotAfter)
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to check the certificates which are held in our
+ * credentials, generating a new CA and/or serving certificate if they are
+ * missing, have been generated by an earlier version of the operator, or are
+ * about to expire.  The returned map contains the fields which have been
+ * changed, and will be empty if no change was required.
+ */
+
+func (mgr *SnapshotMgr) checkCertificates(creds map[string]string) (
+	updates map[string]string, err error) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "checkCertificates")
+
+	updates = make(map[string]string)
+
+	caCert := creds[caCertFieldName]
+	caKey := creds[caKeyFieldName]
+
+	/*
+	 * The CA bundle contains the current CA, followed by the previous CA
+	 * while the CA is being rotated.
+	 */
+
+	var previous []*x509.Certificate
+
+	if len(caKey) == 0 {
+		/*
+		 * We don't own the CA.  If the certificate was generated by an earlier
+		 * version of the operator we migrate to a CA and serving certificate,
+		 * otherwise the certificate has been supplied by the administrator
+		 * and we must leave it alone.  If there is no certificate, for
+		 * example because it was previously issued by cert-manager, a CA and
+		 * serving certificate are generated now.
+		 */
+
+		cert, perr := parseCertificate(creds[certFieldName])
+
+		if len(creds[certFieldName]) == 0 || len(creds[keyFieldName]) == 0 {
+			mgr.log.Info("Generating a CA signed certificate")
+		} else if perr == nil && !isLegacyCertificate(cert) {
+			return
+		} else {
+			mgr.log.Info("Replacing the legacy self-signed certificate with " +
+				"a CA signed certificate")
+		}
+
+		caCert = ""
+	} else if bundle := parseCertificates(caCert); len(bundle) == 0 ||
+		needsRenewal(bundle[0], caRenewBefore) {
+		mgr.log.Info("Renewing the CA certificate")
+
+		if len(bundle) > 0 {
+			previous = bundle[:1]
+		}
+
+		caCert = ""
+	} else {
+		previous = bundle[1:]
+	}
+
+	/*
+	 * Generate a new CA if required.  The CA which is being renewed remains
+	 * in the CA bundle, so that the clients which have not yet loaded the
+	 * new CA bundle continue to trust the current serving certificate.
+	 */
+
+	if len(caCert) == 0 {
+		caCert, caKey, err = mgr.generateCA()
+
+		if err != nil {
+			return
+		}
+
+		updates[caCertFieldName] = encodeBundle(caCert, previous)
+		updates[caKeyFieldName] = caKey
+	}
+
+	/*
+	 * Now check the serving certificate.  It needs to be re-issued if it is
+	 * about to expire, if the key doesn't match our TLS policy, or if it
+	 * hasn't been signed by the current CA.  A certificate which has been
+	 * signed by the previous CA is only re-issued once the current CA has
+	 * been in the CA bundle for the overlap period.
+	 */
+
+	ca, err := parseCertificate(caCert)
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to parse the CA certificate")
+
+		return
+	}
+
+	cert, perr := parseCertificate(creds[certFieldName])
+
+	reissue := perr != nil || len(creds[keyFieldName]) == 0 ||
+		needsRenewal(cert, certRenewBefore) ||
+		!mgr.options.TLSPolicy.matchesKey(cert)
+
+	if !reissue && cert.CheckSignatureFrom(ca) != nil {
+		reissue = !signedByAny(cert, previous) ||
+			overlapElapsed(ca.NotBefore)
+	}
+
+	if reissue {
+		mgr.log.Info("Issuing a new serving certificate")
+
+		var newCert, newKey string
+
+		newCert, newKey, err = mgr.generateServingCert(caCert, caKey)
+
+		if err != nil {
+			return
+		}
+
+		updates[certFieldName] = newCert
+		updates[keyFieldName] = newKey
+	} else if len(previous) > 0 && cert.CheckSignatureFrom(ca) == nil &&
+		overlapElapsed(cert.NotBefore) {
+		/*
+		 * The serving certificate which was issued by the current CA has
+		 * been in use for the overlap period, and so the previous CA is no
+		 * longer required.
+		 */
+
+		mgr.log.Info("Removing the previous CA certificate from the CA bundle")
+
+		updates[caCertFieldName] = encodePem("CERTIFICATE", ca.Raw)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to load the serving certificate from our credentials
+ * so that it can be presented by the Web server.  The certificate is
+ * retrieved on each TLS handshake, which allows us to renew the certificate
+ * without restarting the server.
+ */
+
+func (mgr *SnapshotMgr) loadCertificate() (err error) {
+	pair, err := tls.X509KeyPair(
+		[]byte(mgr.getCred(certFieldName)),
+		[]byte(mgr.getCred(keyFieldName)))
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to generate the X509 key pair")
+
+		return
+	}
+
+	mgr.credsMutex.Lock()
+	mgr.certificate = &pair
+	mgr.credsMutex.Unlock()
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used by the TLS server to retrieve the current serving
+ * certificate.
+ */
+
+func (mgr *SnapshotMgr) getCertificate(
+	hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	mgr.credsMutex.RLock()
+	defer mgr.credsMutex.RUnlock()
+
+	if mgr.certificate == nil {
+		return nil, errors.New("The server certificate is not yet available")
+	}
+
+	return mgr.certificate, nil
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to save the supplied fields to our secret, and then
+ * update our cached copy of the credentials.
+ */
+
+func (mgr *SnapshotMgr) updateSecret(updates map[string]string) (err error) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "updateSecret")
+
+	clientset, err := kubernetes.NewForConfig(mgr.config)
+	if err != nil {
+		mgr.log.Error(err, "Failed to create a new client")
+
+		return
+	}
+
+	secretsClient := clientset.CoreV1().Secrets(mgr.namespace)
+
+	secret, err := secretsClient.Get(
+		context.TODO(), operatorName, metaV1.GetOptions{})
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to retrieve the secret",
+			"Secret.Name", operatorName)
+
+		return
+	}
+
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+
+	for key, value := range updates {
+		secret.Data[key] = []byte(value)
+	}
+
+	_, err = secretsClient.Update(context.TODO(), secret, metaV1.UpdateOptions{})
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to update the secret",
+			"Secret.Name", operatorName)
+
+		return
+	}
+
+	mgr.setCreds(updates)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the CA bundle which should be trusted by
+ * clients of the snapshot manager.  If the administrator has supplied their
+ * own certificate without a CA bundle we fall back to the certificate itself.
+ */
+
+func (mgr *SnapshotMgr) caBundle() string {
+	caCert := mgr.getCred(caCertFieldName)
+
+	if len(caCert) == 0 {
+		caCert = mgr.getCred(certFieldName)
+	}
+
+	return caCert
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the data which should be held in the
+ * secret which is created in the namespace of each deployment.  The runtime
+ * containers only ever need to trust the CA bundle, and so the serving
+ * certificate itself is not included.  The tls.cert field is populated with
+ * the CA bundle for deployments which were created by an earlier version of
+ * the operator and which still mount this field.
+ */
+
+func (mgr *SnapshotMgr) namespaceSecretData() map[string]string {
+	caCert := mgr.caBundle()
+
+	return map[string]string{
+		userFieldName:   snapshotMgrUser,
+		urlFieldName:    mgr.getCred(urlFieldName),
+		roPwdFieldName:  mgr.getCred(roPwdFieldName),
+		caCertFieldName: caCert,
+		certFieldName:   caCert,
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to push the current CA bundle to the secret in each
+ * namespace which contains a VerifyAccess deployment.  This is required
+ * whenever the CA changes.
+ */
+
+func (mgr *SnapshotMgr) propagateCACert() (err error) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "propagateCACert")
+
+	rtClient, err := client.New(mgr.config,
+		client.Options{
+			Scheme: mgr.scheme,
+		})
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to create a new controller runtime client")
+
+		return
+	}
+
+	list := &ibmv1.IBMSecurityVerifyAccessList{}
+
+	err = rtClient.List(context.TODO(), list)
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to list the IBMSecurityVerifyAccess resources")
+
+		return
+	}
+
+	data := mgr.namespaceSecretData()
+	namespaces := make(map[string]bool)
+
+	for _, item := range list.Items {
+		if namespaces[item.Namespace] || item.Namespace == mgr.namespace {
+			continue
+		}
+
+		namespaces[item.Namespace] = true
+
+		secret := &apiV1.Secret{}
+
+		err = rtClient.Get(context.TODO(),
+			client.ObjectKey{
+				Namespace: item.Namespace,
+				Name:      operatorName,
+			},
+			secret)
+
+		if k8serrors.IsNotFound(err) {
+			err = nil
+
+			continue
+		} else if err != nil {
+			mgr.log.Error(err, "Failed to retrieve the secret",
+				"Secret.Namespace", item.Namespace,
+				"Secret.Name", operatorName)
+
+			continue
+		}
+
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+
+		secret.Data[caCertFieldName] = []byte(data[caCertFieldName])
+		secret.Data[certFieldName] = []byte(data[certFieldName])
+
+		err = rtClient.Update(context.TODO(), secret)
+
+		if err != nil {
+			mgr.log.Error(err, "Failed to update the secret",
+				"Secret.Namespace", item.Namespace,
+				"Secret.Name", operatorName)
+
+			continue
+		}
+
+		mgr.log.Info("Updated the CA certificate in the secret",
+			"Secret.Namespace", item.Namespace,
+			"Secret.Name", operatorName)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to determine whether the deployment of the supplied
+ * custom resource mounts the CA bundle of the snapshot manager.
+ */
+
+func mountsOperatorCA(m *ibmv1.IBMSecurityVerifyAccess) bool {
+	return m.Spec.SnapshotTLSCacert == "" ||
+		m.Spec.SnapshotTLSCacert == "operator"
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to restart each of the workloads which mount the CA
+ * bundle, so that they load a CA bundle which has changed.  The CA bundle is
+ * mounted as a single file, which is never refreshed by the kubelet, and so
+ * the pods must be re-created.  The deployments of each custom resource are
+ * restarted by a restart job, which honours the AutoRestart field, restart
+ * policy and restart window of the custom resource, and so a deployment
+ * which is not allowed to be restarted now loads the new CA bundle when it
+ * is next restarted.  The StatefulSet
+ * of a configuration container, which is never restarted by a restart job,
+ * is restarted by updating the CA bundle digest in its pod template.
+ */
+
+func (mgr *SnapshotMgr) restartCAClients() (err error) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "restartCAClients")
+
+	rtClient, err := client.New(mgr.config,
+		client.Options{
+			Scheme: mgr.scheme,
+		})
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to create a new controller runtime client")
+
+		return
+	}
+
+	list := &ibmv1.IBMSecurityVerifyAccessList{}
+
+	err = rtClient.List(context.TODO(), list)
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to list the IBMSecurityVerifyAccess resources")
+
+		return
+	}
+
+	digest := sha256.Sum256([]byte(mgr.caBundle()))
+
+	payload := fmt.Sprintf(
+		`{"spec":{"template":{"metadata":{"annotations":{"%s":"%s"}}}}}`,
+		caBundleDigestAnnotation, hex.EncodeToString(digest[:]))
+
+	for idx := range list.Items {
+		item := &list.Items[idx]
+
+		if !mountsOperatorCA(item) {
+			continue
+		}
+
+		if serviceNameForVerifyAccess(item) != configServiceName {
+			mgr.startRestart(restartRequest{
+				namespace: item.Namespace,
+				name:      item.Name,
+				client:    caRotationClient,
+			})
+
+			continue
+		}
+
+		sts := &appsv1.StatefulSet{}
+
+		sts.Namespace = item.Namespace
+		sts.Name = item.Name
+
+		perr := rtClient.Patch(context.TODO(), sts,
+			client.RawPatch(types.StrategicMergePatchType, []byte(payload)))
+
+		if perr != nil && !k8serrors.IsNotFound(perr) {
+			mgr.log.Error(perr, "Failed to restart the StatefulSet",
+				"StatefulSet.Namespace", item.Namespace,
+				"StatefulSet.Name", item.Name)
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to renew our certificates, if required, and is
+ * called on a regular basis by the snapshot manager.
+ */
+
+func (mgr *SnapshotMgr) renewCertificates() {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "renewCertificates")
+
+	/*
+	 * The certificates are only renewed by the leader.  The other replicas
+	 * simply load the certificates which have been saved by the leader.
+	 */
+
+	if !mgr.isLeader() {
+		if mgr.reloadSecret() == nil {
+			mgr.loadCertificate()
+		}
+
+		return
+	}
+
+	updates, err := mgr.checkCertificates(mgr.getCreds())
+
+	if err != nil || len(updates) == 0 {
+		return
+	}
+
+	err = mgr.updateSecret(updates)
+
+	if err != nil {
+		return
+	}
+
+	if _, ok := updates[certFieldName]; ok {
+		if mgr.loadCertificate() == nil {
+			mgr.log.Info("The serving certificate has been renewed")
+		}
+	}
+
+	if _, ok := updates[caCertFieldName]; ok {
+		mgr.propagateCACert()
+	}
+
+	/*
+	 * The clients only need to be restarted when a new CA has been added
+	 * to the CA bundle, and not when the previous CA is removed.
+	 */
+
+	if _, ok := updates[caKeyFieldName]; ok {
+		mgr.restartCAClients()
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to reload the certificates from our secret, which
+ * may have been updated by another replica.
+ */
+
+func (mgr *SnapshotMgr) reloadSecret() (err error) {
+	clientset, err := kubernetes.NewForConfig(mgr.config)
+
+	if err != nil {
+		return
+	}
+
+	secret, err := clientset.CoreV1().Secrets(mgr.namespace).Get(
+		context.TODO(), operatorName, metaV1.GetOptions{})
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to retrieve the secret",
+			"Secret.Name", operatorName)
+
+		return
+	}
+
+	updates := make(map[string]string)
+
+	for _, key := range []string{certFieldName, keyFieldName,
+		caCertFieldName, caKeyFieldName} {
+		if value, ok := secret.Data[key]; ok {
+			updates[key] = string(value)
+		}
+	}
+
+	mgr.setCreds(updates)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to periodically check whether our certificates need
+ * to be renewed, until the supplied channel is closed.
+ */
+
+func (mgr *SnapshotMgr) certificateRenewalLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(certCheckInterval)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			mgr.renewCertificates()
+		}
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to create, or update, the cert-manager Certificate
+ * resource which is used to request the certificate of the snapshot manager.
+ * We use an unstructured object so that the operator doesn't have a hard
+ * dependency on the cert-manager API.
+ */
+
+func (mgr *SnapshotMgr) requestCertificate() (err error) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "requestCertificate")
+
+	rtClient, err := client.New(mgr.config,
+		client.Options{
+			Scheme: mgr.scheme,
+		})
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to create a new controller runtime client")
+
+		return
+	}
+
+	issuerKind := mgr.options.CertIssuerKind
+
+	if len(issuerKind) == 0 {
+		issuerKind = "Issuer"
+	}
+
+	issuerGroup := mgr.options.CertIssuerGroup
+
+	if len(issuerGroup) == 0 {
+		issuerGroup = certManagerGroup
+	}
+
+	dnsNames := []interface{}{}
+
+	for _, name := range serviceDNSNames(mgr.namespace) {
+		dnsNames = append(dnsNames, name)
+	}
+
+	spec := map[string]interface{}{
+		"secretName":  certManagerSecretName,
+		"commonName":  dnsNames[len(dnsNames)-1],
+		"dnsNames":    dnsNames,
+		"duration":    certValidity.String(),
+		"renewBefore": certRenewBefore.String(),
+		"usages":      mgr.options.TLSPolicy.certManagerUsages(),
+		"privateKey": map[string]interface{}{
+			"algorithm":      mgr.options.TLSPolicy.certManagerAlgorithm(),
+			"size":           int64(mgr.options.TLSPolicy.KeySize),
+			"rotationPolicy": "Always",
+		},
+		"issuerRef": map[string]interface{}{
+			"name":  mgr.options.CertIssuerName,
+			"kind":  issuerKind,
+			"group": issuerGroup,
+		},
+	}
+
+	certificate := &unstructured.Unstructured{}
+	certificate.SetGroupVersionKind(certManagerCertificateGVK)
+
+	err = rtClient.Get(context.TODO(),
+		client.ObjectKey{
+			Namespace: mgr.namespace,
+			Name:      certManagerSecretName,
+		},
+		certificate)
+
+	if k8serrors.IsNotFound(err) {
+		certificate.SetName(certManagerSecretName)
+		certificate.SetNamespace(mgr.namespace)
+		certificate.Object["spec"] = spec
+
+		mgr.log.Info("Creating the cert-manager certificate",
+			"Certificate.Name", certManagerSecretName,
+			"Issuer.Name", mgr.options.CertIssuerName,
+			"Issuer.Kind", issuerKind)
+
+		err = rtClient.Create(context.TODO(), certificate)
+	} else if err == nil {
+		certificate.Object["spec"] = spec
+
+		err = rtClient.Update(context.TODO(), certificate)
+	}
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to save the cert-manager certificate",
+			"Certificate.Name", certManagerSecretName)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to save the cert-manager Certificate resource.  It
+ * is added to the controller manager as a runnable, and so is only run by
+ * the leader when leader election is enabled.  A conflict with another
+ * replica, which was previously the leader, is retried straight away, and
+ * any other failure is retried until the supplied context is cancelled.
+ */
+
+func (mgr *SnapshotMgr) requestCertificates(ctx context.Context) error {
+	mgr.log.V(9).Info("Entering a function", "Function", "requestCertificates")
+
+	for {
+		err := retry.OnError(retry.DefaultRetry, func(err error) bool {
+			return k8serrors.IsConflict(err) || k8serrors.IsAlreadyExists(err)
+		}, mgr.requestCertificate)
+
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(certWatchRetryInterval):
+		}
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to load the certificate which has been issued by
+ * cert-manager.  If the CA has changed it will be pushed to the secret in
+ * each namespace which contains a VerifyAccess deployment.
+ */
+
+func (mgr *SnapshotMgr) loadCertManagerSecret(secret *apiV1.Secret) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "loadCertManagerSecret")
+
+	cert := string(secret.Data[apiV1.TLSCertKey])
+	key := string(secret.Data[apiV1.TLSPrivateKeyKey])
+
+	if len(cert) == 0 || len(key) == 0 {
+		mgr.log.V(5).Info("The cert-manager secret does not yet contain a "+
+			"certificate", "Secret.Name", secret.Name)
+
+		return
+	}
+
+	if cert == mgr.getCred(certFieldName) && key == mgr.getCred(keyFieldName) {
+		return
+	}
+
+	previousCA := mgr.caBundle()
+
+	mgr.setCreds(map[string]string{
+		certFieldName:   cert,
+		keyFieldName:    key,
+		caCertFieldName: string(secret.Data[certManagerCAKey]),
+	})
+
+	if mgr.loadCertificate() != nil {
+		return
+	}
+
+	mgr.log.Info("Loaded the certificate issued by cert-manager",
+		"Secret.Name", secret.Name)
+
+	/*
+	 * Save the CA bundle to our own secret, and to the secret in each of
+	 * the other namespaces, if it has changed.  This is only performed by
+	 * the leader.
+	 */
+
+	caCert := mgr.caBundle()
+
+	if caCert != previousCA && mgr.isLeader() {
+		if mgr.updateSecret(map[string]string{caCertFieldName: caCert}) == nil {
+			mgr.propagateCACert()
+			mgr.restartCAClients()
+		}
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to watch the secret which is populated by
+ * cert-manager, reloading our certificate whenever the secret changes.  The
+ * watch is re-established if it is closed by the server, until the supplied
+ * channel is closed.
+ */
+
+func (mgr *SnapshotMgr) watchCertificateSecret(stop <-chan struct{}) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "watchCertificateSecret")
+
+	clientset, err := kubernetes.NewForConfig(mgr.config)
+	if err != nil {
+		mgr.log.Error(err, "Failed to create a new client")
+
+		return
+	}
+
+	secretsClient := clientset.CoreV1().Secrets(mgr.namespace)
+
+	for {
+		watcher, err := secretsClient.Watch(context.TODO(), metaV1.ListOptions{
+			FieldSelector: fmt.Sprintf("metadata.name=%s", certManagerSecretName),
+		})
+
+		if err != nil {
+			mgr.log.Error(err, "Failed to watch the cert-manager secret",
+				"Secret.Name", certManagerSecretName)
+
+			select {
+			case <-stop:
+				return
+			case <-time.After(certWatchRetryInterval):
+				continue
+			}
+		}
+
+	events:
+		for {
+			select {
+			case <-stop:
+				watcher.Stop()
+
+				return
+
+			case event, ok := <-watcher.ResultChan():
+				if !ok {
+					break events
+				}
+
+				if event.Type != watch.Added && event.Type != watch.Modified {
+					continue
+				}
+
+				if secret, ok := event.Object.(*apiV1.Secret); ok {
+					mgr.loadCertManagerSecret(secret)
+				}
+			}
+		}
+	}
+}
+
+/*****************************************************************************/
@@ -0,0 +1,318 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+/*****************************************************************************/
+
+/*
+ * The testCert structure holds a certificate, and its key, which has been
+ * created by a test.
+ */
+
+type testCert struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	pem    string
+	keyPem string
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to create a certificate which is valid for the
+ * supplied period, signed by the supplied CA, or self-signed if the CA is
+ * nil.
+ */
+
+func newTestCert(t *testing.T, isCA bool, signer *testCert,
+	notBefore time.Time, notAfter time.Time) *testCert {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "test"},
+		DNSNames:              []string{"test"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+
+	parent, parentKey := template, key
+
+	if signer != nil {
+		parent, parentKey = signer.cert, signer.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent,
+		key.Public(), parentKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	return &testCert{
+		cert:   cert,
+		key:    key,
+		pem:    encodePem("CERTIFICATE", der),
+		keyPem: encodePem("PRIVATE KEY", keyDer),
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to create a snapshot manager which can generate
+ * certificates.
+ */
+
+func newTestCertMgr(t *testing.T) *SnapshotMgr {
+	mgr := &SnapshotMgr{
+		log:       logr.Discard(),
+		namespace: "test",
+	}
+
+	mgr.options.TLSPolicy = TLSPolicy{KeyType: KeyTypeECDSA}
+
+	if err := mgr.options.TLSPolicy.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	return mgr
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify that the previous CA remains in the CA bundle, and continues to
+ * sign the serving certificate, for the overlap period of a CA rotation.
+ */
+
+func TestCheckCertificatesRotation(t *testing.T) {
+	mgr := newTestCertMgr(t)
+	now := time.Now()
+	day := time.Hour * 24
+
+	expiring := newTestCert(t, true, nil, now.Add(-9*365*day),
+		now.Add(30*day))
+	oldLeaf := newTestCert(t, false, expiring, now.Add(-day), now.Add(80*day))
+
+	recent := newTestCert(t, true, nil, now.Add(-day), now.Add(3000*day))
+	established := newTestCert(t, true, nil, now.Add(-40*day),
+		now.Add(3000*day))
+
+	newLeaf := newTestCert(t, false, established, now.Add(-day),
+		now.Add(80*day))
+	agedLeaf := newTestCert(t, false, established, now.Add(-40*day),
+		now.Add(80*day))
+
+	tests := []struct {
+		name       string
+		ca         *testCert
+		previous   *testCert
+		leaf       *testCert
+		newCA      bool
+		newLeaf    bool
+		bundleSize int
+	}{
+		{
+			name:       "expiring CA is renewed and kept in the bundle",
+			ca:         expiring,
+			leaf:       oldLeaf,
+			newCA:      true,
+			bundleSize: 2,
+		},
+		{
+			name:     "leaf is kept within the overlap period",
+			ca:       recent,
+			previous: expiring,
+			leaf:     oldLeaf,
+		},
+		{
+			name:     "leaf is re-issued after the overlap period",
+			ca:       established,
+			previous: expiring,
+			leaf:     oldLeaf,
+			newLeaf:  true,
+		},
+		{
+			name:     "previous CA is kept while the new leaf is recent",
+			ca:       established,
+			previous: expiring,
+			leaf:     newLeaf,
+		},
+		{
+			name:       "previous CA is removed once the new leaf has aged",
+			ca:         established,
+			previous:   expiring,
+			leaf:       agedLeaf,
+			bundleSize: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bundle := test.ca.pem
+
+			if test.previous != nil {
+				bundle += "\n" + test.previous.pem
+			}
+
+			updates, err := mgr.checkCertificates(map[string]string{
+				caCertFieldName: bundle,
+				caKeyFieldName:  test.ca.keyPem,
+				certFieldName:   test.leaf.pem,
+				keyFieldName:    test.leaf.keyPem,
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, ok := updates[caKeyFieldName]; ok != test.newCA {
+				t.Errorf("new CA = %v, want %v", ok, test.newCA)
+			}
+
+			if _, ok := updates[certFieldName]; ok != test.newLeaf {
+				t.Errorf("new serving certificate = %v, want %v", ok,
+					test.newLeaf)
+			}
+
+			newBundle, ok := updates[caCertFieldName]
+
+			if !ok {
+				if test.bundleSize != 0 {
+					t.Fatalf("the CA bundle was not updated")
+				}
+
+				return
+			}
+
+			certs := parseCertificates(newBundle)
+
+			if len(certs) != test.bundleSize {
+				t.Fatalf("CA bundle size = %d, want %d", len(certs),
+					test.bundleSize)
+			}
+
+			if test.bundleSize == 2 && !certs[1].Equal(test.ca.cert) {
+				t.Errorf("the previous CA is not the second certificate " +
+					"in the CA bundle")
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify that a CA and serving certificate are generated when there are no
+ * certificates, and that the serving certificate is signed by the CA.
+ */
+
+func TestCheckCertificatesInitial(t *testing.T) {
+	mgr := newTestCertMgr(t)
+
+	updates, err := mgr.checkCertificates(map[string]string{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cas := parseCertificates(updates[caCertFieldName])
+
+	if len(cas) != 1 {
+		t.Fatalf("CA bundle size = %d, want 1", len(cas))
+	}
+
+	cert, err := parseCertificate(updates[certFieldName])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = cert.CheckSignatureFrom(cas[0]); err != nil {
+		t.Errorf("the serving certificate is not signed by the CA: %v", err)
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify that a serving certificate is generated when the certificate, or
+ * its key, is missing from the secret, for example after cert-manager has
+ * been used to issue the certificate.
+ */
+
+func TestCheckCertificatesMissing(t *testing.T) {
+	mgr := newTestCertMgr(t)
+
+	initial, err := mgr.checkCertificates(map[string]string{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		creds map[string]string
+	}{
+		{"no key", map[string]string{
+			certFieldName: initial[certFieldName],
+		}},
+		{"no key with a CA", map[string]string{
+			caCertFieldName: initial[caCertFieldName],
+			caKeyFieldName:  initial[caKeyFieldName],
+			certFieldName:   initial[certFieldName],
+		}},
+		{"no certificate with a CA", map[string]string{
+			caCertFieldName: initial[caCertFieldName],
+			caKeyFieldName:  initial[caKeyFieldName],
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			updates, err := mgr.checkCertificates(test.creds)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(updates[certFieldName]) == 0 ||
+				len(updates[keyFieldName]) == 0 {
+				t.Errorf("a serving certificate was not generated: %v",
+					updates)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
@@ -0,0 +1,246 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * When a quiet period has been configured the restarts of each deployment
+ * are coalesced.  The first job which selects a deployment becomes the
+ * owner of the restart of the deployment, and waits until no other job has
+ * selected the deployment for the quiet period.  Any other job which selects
+ * the deployment before it has been restarted simply follows the restart of
+ * the owner, and so a burst of uploads only restarts each deployment once,
+ * with all of the uploaded files.  The quiet period is never extended beyond
+ * maxRestartQuietPeriods quiet periods, so that a steady stream of uploads
+ * cannot postpone the restart indefinitely.  The outcome of the restart is
+ * recorded in the owner and in each of the followers.
+ */
+
+type coalescedRestart struct {
+	// The job which restarts the deployment.
+	owner *restartJob
+
+	// The jobs which follow the restart of the deployment.
+	followers []*restartJob
+
+	// The time at which the quiet period of the deployment ends.
+	due time.Time
+
+	// The time beyond which the quiet period is no longer extended.
+	deadline time.Time
+
+	// The digest of the most recent snapshot for which the deployment is
+	// restarted by the owner or by one of the followers.
+	digest string
+
+	// The channel which is closed once the deployment has been restarted.
+	done chan struct{}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to coalesce the restarts of the supplied
+ * deployments, for the supplied request.  The deployments which are owned
+ * by the job are returned once the quiet period of each of them has ended,
+ * along with a channel for each of the deployments which are restarted by
+ * other jobs.  The deployments are returned unchanged if no quiet period
+ * has been configured.
+ */
+
+func (mgr *SnapshotMgr) coalesceRestarts(request restartRequest,
+	job *restartJob, deployments []appsv1.Deployment) (
+	owned []appsv1.Deployment, followed []chan struct{}) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "coalesceRestarts")
+
+	quietPeriod := mgr.options.RestartQuietPeriod
+
+	if quietPeriod <= 0 {
+		return deployments, nil
+	}
+
+	maxWait := quietPeriod * time.Duration(maxRestartQuietPeriods)
+
+	var entries []*coalescedRestart
+
+	mgr.coalesceMutex.Lock()
+
+	for _, deployment := range deployments {
+		key := deployment.Namespace + "/" + deployment.Name
+		now := time.Now()
+		due := now.Add(quietPeriod)
+
+		if entry := mgr.coalesced[key]; entry != nil {
+			mgr.log.Info("Coalescing the restart of the deployment",
+				"Deployment.Namespace", deployment.Namespace,
+				"Deployment.Name", deployment.Name,
+				"Job", job.Id,
+				"Owner", entry.owner.Id)
+
+			entry.followers = append(entry.followers, job)
+
+			if due.After(entry.deadline) {
+				due = entry.deadline
+			}
+
+			if due.After(entry.due) {
+				entry.due = due
+			}
+
+			if len(request.digest) > 0 {
+				entry.digest = request.digest
+			}
+
+			followed = append(followed, entry.done)
+
+			continue
+		}
+
+		entry := &coalescedRestart{
+			owner:    job,
+			due:      due,
+			deadline: now.Add(maxWait),
+			digest:   request.digest,
+			done:     make(chan struct{}),
+		}
+
+		mgr.coalesced[key] = entry
+
+		entries = append(entries, entry)
+		owned = append(owned, deployment)
+	}
+
+	mgr.coalesceMutex.Unlock()
+
+	/*
+	 * Wait until the quiet period of each of the owned deployments has
+	 * ended.  The quiet period is extended each time that another job
+	 * selects the deployment, up until the deadline of the deployment.
+	 */
+
+	for {
+		var due time.Time
+
+		mgr.coalesceMutex.Lock()
+
+		for _, entry := range entries {
+			if entry.due.After(due) {
+				due = entry.due
+			}
+		}
+
+		mgr.coalesceMutex.Unlock()
+
+		wait := time.Until(due)
+
+		if wait <= 0 {
+			break
+		}
+
+		time.Sleep(wait)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the digest of the snapshot which is to be
+ * recorded against the deployment with the supplied key when it is
+ * restarted by the supplied job.  This is the digest of the most recent
+ * snapshot of all of the restarts which have been coalesced, or the digest
+ * of the supplied request if the restart has not been coalesced.
+ */
+
+func (mgr *SnapshotMgr) coalescedDigest(job *restartJob, key string,
+	digest string) string {
+
+	mgr.coalesceMutex.Lock()
+	defer mgr.coalesceMutex.Unlock()
+
+	if entry := mgr.coalesced[key]; entry != nil && entry.owner == job &&
+		len(entry.digest) > 0 {
+		return entry.digest
+	}
+
+	return digest
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to record the outcome of the restart of a
+ * deployment, which is owned by the supplied job, in each of the jobs which
+ * follow the restart.  A generation of 0 indicates that the deployment was
+ * not restarted, for the supplied reason.
+ */
+
+func (mgr *SnapshotMgr) settleCoalesced(job *restartJob, key string,
+	generation int64, resource string, reason string) {
+
+	mgr.coalesceMutex.Lock()
+
+	entry := mgr.coalesced[key]
+
+	if entry == nil || entry.owner != job {
+		mgr.coalesceMutex.Unlock()
+
+		return
+	}
+
+	delete(mgr.coalesced, key)
+
+	mgr.coalesceMutex.Unlock()
+
+	for _, follower := range entry.followers {
+		if generation > 0 {
+			follower.patch(key, generation, resource)
+		} else {
+			follower.skip(key, fmt.Sprintf("The deployment was not restarted "+
+				"by job %s: %s", job.Id, reason))
+		}
+	}
+
+	close(entry.done)
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to record that each of the remaining deployments
+ * which are owned by the supplied job have not been restarted.
+ */
+
+func (mgr *SnapshotMgr) abandonCoalesced(job *restartJob, reason string) {
+	var keys []string
+
+	mgr.coalesceMutex.Lock()
+
+	for key, entry := range mgr.coalesced {
+		if entry.owner == job {
+			keys = append(keys, key)
+		}
+	}
+
+	mgr.coalesceMutex.Unlock()
+
+	for _, key := range keys {
+		mgr.settleCoalesced(job, key, 0, "", reason)
+	}
+}
+
+/*****************************************************************************/
@@ -0,0 +1,154 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * This function is used to create a snapshot manager which coalesces
+ * restarts for the supplied quiet period.
+ */
+
+func newTestCoalescingMgr(quietPeriod time.Duration) *SnapshotMgr {
+	mgr := &SnapshotMgr{
+		log:           logr.Discard(),
+		coalesced:     map[string]*coalescedRestart{},
+		coalesceMutex: &sync.Mutex{},
+	}
+
+	mgr.options.RestartQuietPeriod = quietPeriod
+
+	return mgr
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify that a steady stream of restarts cannot postpone the restart of a
+ * deployment beyond the maximum number of quiet periods.
+ */
+
+func TestCoalesceRestartsDeadline(t *testing.T) {
+	quietPeriod := 20 * time.Millisecond
+
+	mgr := newTestCoalescingMgr(quietPeriod)
+
+	deployments := []appsv1.Deployment{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "wrp"},
+	}}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	start := time.Now()
+	returned := make(chan time.Duration)
+
+	go func() {
+		owned, _ := mgr.coalesceRestarts(restartRequest{},
+			&restartJob{Id: "owner"}, deployments)
+
+		if len(owned) != 1 {
+			t.Errorf("owned = %d deployments, want 1", len(owned))
+		}
+
+		returned <- time.Since(start)
+	}()
+
+	/*
+	 * Select the deployment from another job more frequently than the quiet
+	 * period until the owner returns.
+	 */
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+
+			case <-time.After(quietPeriod / 4):
+				mgr.coalesceRestarts(restartRequest{},
+					&restartJob{Id: "follower"}, deployments)
+			}
+		}
+	}()
+
+	maxWait := quietPeriod * time.Duration(maxRestartQuietPeriods)
+
+	select {
+	case waited := <-returned:
+		if waited < maxWait {
+			t.Errorf("the restart was not delayed for %s: %s", maxWait, waited)
+		}
+
+	case <-time.After(maxWait * 5):
+		t.Fatalf("the restart was delayed for more than %s", maxWait*5)
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify that the digest of the most recent snapshot of the coalesced
+ * restarts is recorded against the deployment.
+ */
+
+func TestCoalescedDigest(t *testing.T) {
+	deployments := []appsv1.Deployment{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "wrp"},
+	}}
+
+	key := "default/wrp"
+
+	tests := []struct {
+		name    string
+		owner   string
+		follows []string
+		want    string
+	}{
+		{"owner only", "owner", nil, "owner"},
+		{"fixpack owner", "", nil, ""},
+		{"fixpack owner with a snapshot", "", []string{"first"}, "first"},
+		{"most recent snapshot", "owner", []string{"first", "second"}, "second"},
+		{"followed by a fixpack", "owner", []string{"first", ""}, "first"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mgr := newTestCoalescingMgr(time.Hour)
+
+			owner := &restartJob{Id: "owner"}
+
+			mgr.coalesced[key] = &coalescedRestart{
+				owner:    owner,
+				due:      time.Now(),
+				deadline: time.Now(),
+				digest:   test.owner,
+				done:     make(chan struct{}),
+			}
+
+			for _, digest := range test.follows {
+				mgr.coalesceRestarts(restartRequest{digest: digest},
+					&restartJob{Id: "follower"}, deployments)
+			}
+
+			if digest := mgr.coalescedDigest(owner, key,
+				test.owner); digest != test.want {
+				t.Errorf("digest = %q, want %q", digest, test.want)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
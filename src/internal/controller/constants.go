@@ -4,6 +4,12 @@
 
 package controllers
 
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
 /*****************************************************************************/
 
 /*
@@ -55,6 +61,20 @@ const roPwdFieldName string = "ro.pwd"
 const rwPwdFieldName string = "rw.pwd"
 const certFieldName string = "tls.cert"
 const keyFieldName string = "tls.key"
+const caCertFieldName string = "ca.cert"
+const caKeyFieldName string = "ca.key"
+
+/*
+ * The name of the secret which holds the credentials of the approver of
+ * gated snapshots, the name of the approver and the fields of the secret.
+ * The approver credentials are held in a separate secret so that access to
+ * them can be granted independently of the read-write credentials.
+ */
+
+const approverSecretName string = operatorName + "-approver"
+const approverUser string = "approver"
+const approverUserFieldName string = "approver.user"
+const approverPwdFieldName string = "approver.pwd"
 
 /*
  * The length of our generated passwords.
@@ -63,10 +83,87 @@ const keyFieldName string = "tls.key"
 const pwdLength int = 36
 
 /*
- * The length of the generated X509 key.
+ * The default length of a generated RSA key, and the default curve size of a
+ * generated ECDSA key.
  */
 
 const keyLength int = 2048
+const ecdsaKeyLength int = 256
+
+/*
+ * The common name which is given to the generated CA certificate.
+ */
+
+const caCommonName string = "verify-access-operator-ca"
+
+/*
+ * The validity period of the generated CA certificate, and the time before
+ * expiry at which the CA will be renewed.
+ */
+
+const caValidity time.Duration = time.Hour * 24 * 365 * 10
+const caRenewBefore time.Duration = time.Hour * 24 * 365
+
+/*
+ * The validity period of the generated serving certificate, and the time
+ * before expiry at which the certificate will be renewed.
+ */
+
+const certValidity time.Duration = time.Hour * 24 * 90
+const certRenewBefore time.Duration = time.Hour * 24 * 30
+
+/*
+ * The amount by which the start of the validity period of a generated
+ * certificate is back-dated, to allow for clock skew between nodes.
+ */
+
+const certClockSkew time.Duration = time.Minute * 5
+
+/*
+ * When the CA is renewed the previous CA remains in the CA bundle, and
+ * continues to sign the serving certificate, for this period, so that each
+ * client has time to load the new CA bundle before the serving certificate
+ * is re-issued by the new CA.  The previous CA is removed from the bundle
+ * once the re-issued serving certificate has been in use for the same
+ * period.  The client which is recorded against the restart jobs which load
+ * a new CA bundle, and the annotation which is used to restart a StatefulSet
+ * when the CA bundle changes, are also defined.
+ */
+
+const caRotationOverlap time.Duration = time.Hour * 24 * 30
+const caRotationClient string = "ca-rotation"
+const caBundleDigestAnnotation string = "ibm.com/ca-bundle-digest"
+
+/*
+ * How often the snapshot manager checks whether its certificates need to be
+ * renewed.
+ */
+
+const certCheckInterval time.Duration = time.Hour
+
+/*
+ * The details of the cert-manager resources which are used when the
+ * certificate of the snapshot manager is issued by cert-manager.  The name of
+ * the Certificate resource is the same as the name of the secret which will
+ * be populated by cert-manager.
+ */
+
+const certManagerGroup string = "cert-manager.io"
+const certManagerSecretName string = "verify-access-operator-tls"
+const certManagerCAKey string = "ca.crt"
+
+var certManagerCertificateGVK = schema.GroupVersionKind{
+	Group:   certManagerGroup,
+	Version: "v1",
+	Kind:    "Certificate",
+}
+
+/*
+ * How long to wait before re-establishing a failed watch of the cert-manager
+ * secret.
+ */
+
+const certWatchRetryInterval time.Duration = time.Second * 30
 
 /*
  * The port on which the snapshot manager will listen for requests.
@@ -86,3 +183,244 @@ const dataRoot string = "/data"
  */
 
 const maxMemory int64 = 1024
+
+/*
+ * The suffix which is given to the temporary file which is used while a file
+ * is being uploaded.
+ */
+
+const tmpFileSuffix string = ".tmp"
+
+/*
+ * The suffix which is given to the file which holds the metadata of an
+ * uploaded file.
+ */
+
+const metadataFileSuffix string = ".meta"
+
+/*
+ * The name of the directory, within the data root, which holds the previous
+ * revisions of each uploaded file, along with the actions which can be
+ * performed against the history of a file.
+ */
+
+const historyDirName string = ".history"
+
+const (
+	historyAction  string = "history"
+	rollbackAction string = "rollback"
+)
+
+/*
+ * The name of the directory, within the data root, which holds the uploads
+ * of gated snapshots which have not yet been approved, the approval states
+ * of an upload, the actions which approve or reject an upload, and the
+ * annotations which approve or reject an upload from a custom resource.
+ */
+
+const pendingDirName string = ".pending"
+
+const (
+	approvalPending  string = "pending"
+	approvalApproved string = "approved"
+	approvalRejected string = "rejected"
+)
+
+const (
+	approveAction string = "approve"
+	rejectAction  string = "reject"
+)
+
+const approveSnapshotAnnotation string = "ibm.com/approve-snapshot"
+const rejectSnapshotAnnotation string = "ibm.com/reject-snapshot"
+
+/*
+ * The directory, within the data root, which is used to stage uploaded
+ * files before they are stored.
+ */
+
+const stagingDir string = dataRoot + "/.staging"
+
+/*
+ * The default region of an S3 object store, and the name of the user
+ * metadata which holds the metadata of an object.
+ */
+
+const s3DefaultRegion string = "us-east-1"
+const s3MetadataKey string = "Snapshot-Metadata"
+
+/*
+ * The labels, annotations and keys which are used by the objects of the
+ * Kubernetes snapshot store, along with the maximum size of each chunk of a
+ * file.  The chunk size leaves plenty of room below the 1 MiB object size
+ * limit of Kubernetes.
+ */
+
+const storeDirLabel string = "VerifyAccess_store_dir"
+const storeChunkLabel string = "VerifyAccess_store_chunk"
+const storeNameAnnotation string = "VerifyAccess_store_name"
+const storeMetadataAnnotation string = "VerifyAccess_store_metadata"
+const storeManifestKey string = "manifest"
+const storeDataKey string = "data"
+const storeChunkSize int = 768 * 1024
+const storeCompressionGzip string = "gzip"
+const storeChunkGracePeriod time.Duration = time.Hour
+
+/*
+ * The header which is added to a request which has been forwarded to the
+ * leader, the period for which the location of the leader is cached, and
+ * the number of seconds after which a client should retry a request if the
+ * leader is not available.
+ */
+
+const forwardedHeader string = "X-Verify-Access-Forwarded-By"
+const leaderCacheDuration time.Duration = time.Second * 10
+const leaderRetryAfter int = 5
+
+/*
+ * The kind of the snapshot resource, the annotation which records the
+ * generation of the snapshot resource for which a reader pod was created,
+ * and the suffix which is added to the name of the resource to form the
+ * name of the reader pod.
+ */
+
+const snapshotKindName string = "IBMSecurityVerifyAccessSnapshot"
+const snapshotGenerationAnnotation string = "VerifyAccess_snapshot_generation"
+const snapshotReaderSuffix string = "-snapshot-reader"
+
+/*
+ * The maximum time allowed to retrieve a snapshot from its source, the
+ * interval at which a source which is not yet available is checked, the
+ * interval at which a snapshot which is waiting to be approved is checked,
+ * and the maximum lifetime of a reader pod.
+ */
+
+const snapshotSourceTimeout time.Duration = time.Minute * 10
+const snapshotSourceRetryInterval time.Duration = time.Second * 5
+const snapshotApprovalInterval time.Duration = time.Minute
+const snapshotReaderDeadline time.Duration = time.Minute * 15
+
+/*
+ * The port on which a reader pod serves its file, the environment variable
+ * which holds the token that is required to retrieve the file, and the path
+ * at which the volume is mounted.
+ */
+
+const fileServerPort int = 7080
+const fileServerTokenEnv string = "SNAPSHOT_READER_TOKEN"
+const fileServerMountPath string = "/source"
+
+/*
+ * The registry which is used for OCI references which do not include a
+ * registry, the Docker manifest media type which we accept along with the
+ * OCI image manifest, and the maximum size of a manifest.
+ */
+
+const ociDockerHubRegistry string = "registry-1.docker.io"
+const dockerManifestMediaType string = "application/vnd.docker.distribution.manifest.v2+json"
+const ociMaxManifestSize int64 = 4 * 1024 * 1024
+
+/*
+ * The name of the optional manifest file, within the mirrored directory of
+ * a Git repository, which supplies the modified services for each file.
+ */
+
+const gitManifestName string = "verify-access.yaml"
+
+/*
+ * The name of the service which is provided by a configuration container,
+ * the secret which holds the read-write credential for the snapshot manager
+ * in the namespace of a configuration container, and the name, mount path
+ * and default size of the persistent volume of a configuration container.
+ */
+
+const configServiceName string = "config"
+const publishSecretName string = "verify-access-operator-publish"
+const configVolumeName string = "config-data"
+const configVolumeMountPath string = "/var/shared"
+const configDefaultStorageSize string = "1Gi"
+
+/*
+ * The length of the identifier of a restart job, the maximum number of
+ * restart jobs which are retained, the period for which a completed job is
+ * retained, and the interval at which the rollout of a restarted deployment
+ * is checked.
+ */
+
+const jobIdLength int = 16
+const maxRestartJobs int = 100
+const restartJobRetention time.Duration = time.Hour
+const restartPollInterval time.Duration = time.Second * 5
+
+/*
+ * The type of the condition which records the outcome of the most recent
+ * rolling restart of the deployment of a custom resource, and the type of
+ * the condition which records a failed rollout which caused the snapshot to
+ * be automatically rolled back.
+ */
+
+const restartedConditionType string = "Restarted"
+const degradedConditionType string = "Degraded"
+
+/*
+ * The type of the condition which records a restart which has been deferred
+ * until the restart window of a custom resource opens, and the client which
+ * is recorded against the deferred restart job.
+ */
+
+const restartPendingConditionType string = "RestartPending"
+const restartWindowClient string = "restart-window"
+
+/*
+ * The annotation which can be used in place of the restart token of a
+ * custom resource, and the client which is recorded against the restart job
+ * which is started for a new restart token.
+ */
+
+const restartRequestedAnnotation string = "ibm.com/restart-requested-at"
+const restartTokenClient string = "restart-token"
+
+/*
+ * The annotation of the pod template of a deployment which records the
+ * digest of the snapshot for which the deployment was last restarted.
+ */
+
+const snapshotDigestAnnotation string = "ibm.com/snapshot-digest"
+
+/*
+ * The maximum number of quiet periods for which the restart of a deployment
+ * can be delayed while further restarts of the deployment are coalesced.
+ */
+
+const maxRestartQuietPeriods int = 10
+
+/*
+ * The phases of a canary rollout, the suffix of the name of a canary
+ * deployment, the default duration of a canary rollout, the interval at
+ * which a canary deployment is checked, and the default port and timeout of
+ * the HTTP check of a canary deployment.
+ */
+
+const canaryPhaseRunning string = "Running"
+const canaryPhasePromoted string = "Promoted"
+const canaryPhaseDiscarded string = "Discarded"
+const canaryNameSuffix string = "-canary"
+const canaryDefaultDuration time.Duration = time.Minute * 5
+const canaryCheckInterval time.Duration = time.Second * 15
+const canaryDefaultPort int32 = 9443
+const canaryCheckTimeout time.Duration = time.Second * 5
+
+/*
+ * The colours of the deployments of the BlueGreen upgrade strategy, the
+ * annotation which is used to promote, or abort, an upgrade, the values of
+ * the annotation, the default grace period before the previous deployment is
+ * removed, and the interval at which a new deployment is checked.
+ */
+
+const blueGreenBlue string = "blue"
+const blueGreenGreen string = "green"
+const blueGreenActionAnnotation string = "ibm.com/blue-green-action"
+const blueGreenActionPromote string = "promote"
+const blueGreenActionAbort string = "abort"
+const blueGreenDefaultGracePeriod time.Duration = time.Minute * 5
+const blueGreenCheckInterval time.Duration = time.Second * 15
@@ -0,0 +1,267 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// The time zone database is embedded so that the time zone of a restart
+	// window can be loaded in a minimal container image.
+	_ "time/tzdata"
+)
+
+/*****************************************************************************/
+
+/*
+ * The cronSchedule structure holds a parsed cron-style schedule, of the
+ * form 'minute hour day-of-month month day-of-week'.  Each field is held as
+ * a bit set of the matching values.  Each field can be '*', a value, a
+ * range (e.g. '1-5'), or a comma-separated list of these, and each can be
+ * followed by a step (e.g. '0-30/15').  The names of the months and of the
+ * days of the week (e.g. 'JAN' or 'MON') can be used in place of numbers.
+ */
+
+type cronSchedule struct {
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+
+	// Whether the day-of-month, or day-of-week, field starts with '*'.  As
+	// for cron, if both fields are restricted a day matches either field.
+	anyDay     bool
+	anyWeekday bool
+}
+
+/*
+ * The names which can be used for the months and the days of the week.
+ */
+
+var cronMonthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronWeekdayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to parse a cron-style schedule.
+ */
+
+func parseCronSchedule(spec string) (schedule *cronSchedule, err error) {
+	fields := strings.Fields(spec)
+
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("The schedule, %s, must contain 5 fields", spec)
+	}
+
+	schedule = &cronSchedule{
+		anyDay:     strings.HasPrefix(fields[2], "*"),
+		anyWeekday: strings.HasPrefix(fields[4], "*"),
+	}
+
+	ranges := []struct {
+		bits  *uint64
+		min   int
+		max   int
+		names map[string]int
+	}{
+		{&schedule.minutes, 0, 59, nil},
+		{&schedule.hours, 0, 23, nil},
+		{&schedule.days, 1, 31, nil},
+		{&schedule.months, 1, 12, cronMonthNames},
+		{&schedule.weekdays, 0, 7, cronWeekdayNames},
+	}
+
+	for idx, field := range fields {
+		*ranges[idx].bits, err = parseCronField(field, ranges[idx].min,
+			ranges[idx].max, ranges[idx].names)
+
+		if err != nil {
+			return nil, fmt.Errorf("The schedule, %s, is not valid: %w",
+				spec, err)
+		}
+	}
+
+	/*
+	 * Sunday can be specified as either 0 or 7.
+	 */
+
+	if schedule.weekdays&(1<<7) != 0 {
+		schedule.weekdays |= 1
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to parse a single field of a cron-style schedule
+ * into a bit set of the matching values.
+ */
+
+func parseCronField(field string, min int, max int,
+	names map[string]int) (bits uint64, err error) {
+
+	for _, part := range strings.Split(field, ",") {
+		expr, stepStr, hasStep := strings.Cut(part, "/")
+
+		step := 1
+
+		if hasStep {
+			step, err = strconv.Atoi(stepStr)
+
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("the step, %s, is not valid", stepStr)
+			}
+		}
+
+		low, high := min, max
+
+		if expr != "*" {
+			lowStr, highStr, isRange := strings.Cut(expr, "-")
+
+			low, err = parseCronValue(lowStr, names)
+
+			if err != nil {
+				return
+			}
+
+			high = low
+
+			if isRange {
+				high, err = parseCronValue(highStr, names)
+
+				if err != nil {
+					return
+				}
+			} else if hasStep {
+				high = max
+			}
+		}
+
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("the value, %s, is not in the range %d-%d",
+				expr, min, max)
+		}
+
+		for value := low; value <= high; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to parse a single value of a cron-style schedule,
+ * which is either a number or a name.
+ */
+
+func parseCronValue(value string, names map[string]int) (int, error) {
+	if number, found := names[strings.ToLower(value)]; found {
+		return number, nil
+	}
+
+	number, err := strconv.Atoi(value)
+
+	if err != nil {
+		return 0, fmt.Errorf("the value, %s, is not valid", value)
+	}
+
+	return number, nil
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the first time, after the supplied time,
+ * which matches the schedule.  The schedule is evaluated in the location of
+ * the supplied time.  The zero time is returned if the schedule does not
+ * match any time in the next five years.
+ */
+
+func (schedule *cronSchedule) next(after time.Time) time.Time {
+	loc := after.Location()
+
+	t := time.Date(after.Year(), after.Month(), after.Day(), after.Hour(),
+		after.Minute()+1, 0, 0, loc)
+
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		var next time.Time
+
+		switch {
+		case schedule.months&(1<<uint(t.Month())) == 0:
+			next = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+
+		case !schedule.dayMatches(t):
+			next = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+
+		case schedule.hours&(1<<uint(t.Hour())) == 0:
+			next = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0,
+				0, loc)
+
+		case schedule.minutes&(1<<uint(t.Minute())) == 0:
+			next = t.Add(time.Minute)
+
+		default:
+			return t
+		}
+
+		/*
+		 * A time which is skipped by a daylight saving change is normalised
+		 * to a time which can precede the current time, and so we always
+		 * move forward by at least a minute.
+		 */
+
+		if !next.After(t) {
+			next = t.Add(time.Minute)
+		}
+
+		t = next
+	}
+
+	return time.Time{}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to determine whether the day of the supplied time
+ * matches the schedule.
+ */
+
+func (schedule *cronSchedule) dayMatches(t time.Time) bool {
+	day := schedule.days&(1<<uint(t.Day())) != 0
+	weekday := schedule.weekdays&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case schedule.anyDay && schedule.anyWeekday:
+		return true
+	case schedule.anyDay:
+		return weekday
+	case schedule.anyWeekday:
+		return day
+	}
+
+	return day || weekday
+}
+
+/*****************************************************************************/
@@ -0,0 +1,260 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	ibmv1 "github.com/ibm-security/verify-access-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the bit set of the supplied values.
+ */
+
+func cronBits(values ...int) (bits uint64) {
+	for _, value := range values {
+		bits |= 1 << uint(value)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to load a location for a test.
+ */
+
+func testLocation(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return loc
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify the parsing of cron-style schedules.
+ */
+
+func TestParseCronSchedule(t *testing.T) {
+	tests := []struct {
+		spec     string
+		minutes  uint64
+		hours    uint64
+		days     uint64
+		months   uint64
+		weekdays uint64
+	}{
+		{"*/15 2 * * *", cronBits(0, 15, 30, 45), cronBits(2), 0, 0, 0},
+		{"5-20/5 1,13 * * *", cronBits(5, 10, 15, 20), cronBits(1, 13), 0, 0, 0},
+		{"10/20 0 * * *", cronBits(10, 30, 50), cronBits(0), 0, 0, 0},
+		{"0 0 1,15 jan,Jul *", cronBits(0), cronBits(0), cronBits(1, 15), cronBits(1, 7), 0},
+		{"0 0 * * MON-FRI", cronBits(0), cronBits(0), 0, 0, cronBits(1, 2, 3, 4, 5)},
+		{"0 0 * * 7", cronBits(0), cronBits(0), 0, 0, cronBits(0, 7)},
+		{"0 0 * * 5-7", cronBits(0), cronBits(0), 0, 0, cronBits(0, 5, 6, 7)},
+		{"0 0 * * sun", cronBits(0), cronBits(0), 0, 0, cronBits(0)},
+	}
+
+	for _, test := range tests {
+		schedule, err := parseCronSchedule(test.spec)
+
+		if err != nil {
+			t.Errorf("parseCronSchedule(%q): %v", test.spec, err)
+
+			continue
+		}
+
+		if schedule.minutes != test.minutes || schedule.hours != test.hours {
+			t.Errorf("parseCronSchedule(%q) minutes = %b, hours = %b",
+				test.spec, schedule.minutes, schedule.hours)
+		}
+
+		if test.days != 0 && schedule.days != test.days {
+			t.Errorf("parseCronSchedule(%q) days = %b", test.spec,
+				schedule.days)
+		}
+
+		if test.months != 0 && schedule.months != test.months {
+			t.Errorf("parseCronSchedule(%q) months = %b", test.spec,
+				schedule.months)
+		}
+
+		if test.weekdays != 0 && schedule.weekdays != test.weekdays {
+			t.Errorf("parseCronSchedule(%q) weekdays = %b", test.spec,
+				schedule.weekdays)
+		}
+	}
+
+	invalid := []string{
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"x * * * *",
+		"* * * FOO *",
+		"* * * * MON-",
+	}
+
+	for _, spec := range invalid {
+		if _, err := parseCronSchedule(spec); err == nil {
+			t.Errorf("parseCronSchedule(%q) succeeded", spec)
+		}
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify the calculation of the next time which matches a schedule,
+ * including the day-of-month and day-of-week rule, time zones and daylight
+ * saving changes.
+ */
+
+func TestCronNext(t *testing.T) {
+	newYork := testLocation(t, "America/New_York")
+	brisbane := testLocation(t, "Australia/Brisbane")
+
+	// 1 January 2026 is a Thursday.
+	utc := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2026, month, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name  string
+		spec  string
+		after time.Time
+		want  time.Time
+	}{
+		{"step", "*/15 * * * *",
+			utc(1, 1, 10, 7).Add(30 * time.Second), utc(1, 1, 10, 15)},
+		{"strictly after", "0 2 * * *", utc(1, 1, 2, 0), utc(1, 2, 2, 0)},
+		{"sunday as 0", "0 0 * * 0", utc(1, 1, 0, 0), utc(1, 4, 0, 0)},
+		{"sunday as 7", "0 0 * * 7", utc(1, 1, 0, 0), utc(1, 4, 0, 0)},
+		{"sunday by name", "0 0 * * Sun", utc(1, 1, 0, 0), utc(1, 4, 0, 0)},
+		{"day of month", "0 0 13 * *", utc(1, 1, 0, 0), utc(1, 13, 0, 0)},
+		{"day of month or week", "0 0 13 * FRI", utc(1, 3, 0, 0),
+			utc(1, 9, 0, 0)},
+		{"day of month or week, by month", "0 0 13 * FRI", utc(1, 10, 0, 0),
+			utc(1, 13, 0, 0)},
+		{"unrestricted day of month", "0 0 */5 * FRI", utc(1, 2, 0, 0),
+			utc(1, 9, 0, 0)},
+		{"month name", "30 4 1 FEB *", utc(3, 1, 0, 0),
+			time.Date(2027, 2, 1, 4, 30, 0, 0, time.UTC)},
+		{"leap day", "0 0 29 2 *", utc(3, 1, 0, 0),
+			time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"never", "0 0 30 2 *", utc(1, 1, 0, 0), time.Time{}},
+		{"time zone", "0 2 * * *", utc(1, 1, 0, 0).In(brisbane),
+			utc(1, 1, 16, 0)},
+		{"skipped by daylight saving", "30 2 * * *",
+			time.Date(2026, 3, 7, 3, 0, 0, 0, newYork),
+			time.Date(2026, 3, 9, 2, 30, 0, 0, newYork)},
+		{"after daylight saving", "0 3 * * *",
+			time.Date(2026, 3, 7, 4, 0, 0, 0, newYork),
+			time.Date(2026, 3, 8, 3, 0, 0, 0, newYork)},
+		{"repeated by daylight saving", "0 0 * * *",
+			time.Date(2026, 11, 1, 0, 30, 0, 0, newYork),
+			time.Date(2026, 11, 2, 0, 0, 0, 0, newYork)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := parseCronSchedule(test.spec)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := schedule.next(test.after); !got.Equal(test.want) {
+				t.Errorf("next(%s) = %s, want %s", test.after, got, test.want)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify that the time at which the restart window next opens is
+ * calculated in the time zone of the window.
+ */
+
+func TestNextRestartWindow(t *testing.T) {
+	utc := func(day, hour, min int) time.Time {
+		return time.Date(2026, 1, day, hour, min, 0, 0, time.UTC)
+	}
+
+	window := func(schedule string, duration time.Duration,
+		timeZone string) *ibmv1.IBMSecurityVerifyAccessRestartWindow {
+		return &ibmv1.IBMSecurityVerifyAccessRestartWindow{
+			Schedule: schedule,
+			Duration: metav1.Duration{Duration: duration},
+			TimeZone: timeZone,
+		}
+	}
+
+	tests := []struct {
+		name   string
+		window *ibmv1.IBMSecurityVerifyAccessRestartWindow
+		now    time.Time
+		opens  time.Time
+		valid  bool
+	}{
+		{"no window", nil, utc(1, 12, 0), utc(1, 12, 0), true},
+		{"before the window", window("0 2 * * *", 2*time.Hour, ""),
+			utc(1, 1, 0), utc(1, 2, 0), true},
+		{"window open", window("0 2 * * *", 2*time.Hour, ""),
+			utc(1, 3, 59), utc(1, 3, 59), true},
+		{"window closed", window("0 2 * * *", 2*time.Hour, ""),
+			utc(1, 4, 0), utc(2, 2, 0), true},
+		{"window open in time zone",
+			window("0 2 * * *", 2*time.Hour, "Australia/Brisbane"),
+			utc(1, 16, 30), utc(1, 16, 30), true},
+		{"window closed in time zone",
+			window("0 2 * * *", 2*time.Hour, "Australia/Brisbane"),
+			utc(1, 2, 30), utc(1, 16, 0), true},
+		{"invalid schedule", window("0 2 * *", time.Hour, ""),
+			utc(1, 0, 0), time.Time{}, false},
+		{"invalid time zone", window("0 2 * * *", time.Hour, "Nowhere/City"),
+			utc(1, 0, 0), time.Time{}, false},
+		{"no duration", window("0 2 * * *", 0, ""),
+			utc(1, 0, 0), time.Time{}, false},
+		{"never opens", window("0 0 30 2 *", time.Hour, ""),
+			utc(1, 0, 0), time.Time{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opens, err := nextRestartWindow(test.window, test.now)
+
+			if (err == nil) != test.valid {
+				t.Fatalf("nextRestartWindow error = %v", err)
+			}
+
+			if test.valid && !opens.Equal(test.opens) {
+				t.Errorf("nextRestartWindow = %s, want %s", opens, test.opens)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
@@ -0,0 +1,88 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+/*****************************************************************************/
+
+/*
+ * A snapshot which is held on a persistent volume cannot be read directly
+ * by the operator, as the volume is not mounted into the operator pod.
+ * Instead the operator starts a short-lived pod, using its own image, which
+ * mounts the volume and serves the single requested file over HTTP.  The
+ * file is only served to a client which presents the token which was
+ * generated for the pod.
+ */
+
+/*****************************************************************************/
+
+/*
+ * This function is used to serve the specified file until the process is
+ * terminated.  It is invoked by the main function of the operator when the
+ * operator is started as a snapshot reader pod.
+ */
+
+func ServeFile(fileName string) error {
+	token := os.Getenv(fileServerTokenEnv)
+
+	if len(token) == 0 {
+		return fmt.Errorf("The %s environment variable has not been set",
+			fileServerTokenEnv)
+	}
+
+	fileName = filepath.Clean(fileName)
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		authz := []byte(r.Header.Get("Authorization"))
+
+		if subtle.ConstantTimeCompare(authz, []byte("Bearer "+token)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized),
+				http.StatusUnauthorized)
+
+			return
+		}
+
+		file, err := os.Open(fileName)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+
+			return
+		}
+
+		defer file.Close()
+
+		info, err := file.Stat()
+
+		if err != nil || !info.Mode().IsRegular() {
+			http.Error(w, "The file is not a regular file", http.StatusNotFound)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+
+		http.ServeContent(w, r, "", info.ModTime(), file)
+	})
+
+	return http.ListenAndServe(fmt.Sprintf(":%d", fileServerPort), mux)
+}
+
+/*****************************************************************************/
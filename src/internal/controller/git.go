@@ -0,0 +1,180 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+/*****************************************************************************/
+
+/*
+ * Snapshots and fixpacks can be mirrored from a Git repository.  The
+ * gitClient structure uses go-git to resolve the head of a branch, and then
+ * to perform a shallow clone of the branch into memory.
+ */
+
+type gitClient struct {
+	// The URL of the repository.
+	url string
+
+	// The credentials for the repository, if any.
+	auth transport.AuthMethod
+
+	// The PEM encoded CA certificates which are used to verify the
+	// certificate of the repository, if any.
+	caBundle []byte
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to resolve the commit at the head of a branch,
+ * without fetching the commit.
+ */
+
+func (c *gitClient) resolveBranch(ctx context.Context, branch string) (
+	commit string, err error) {
+
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{c.url},
+	})
+
+	refs, err := remote.ListContext(ctx, &git.ListOptions{
+		Auth:     c.auth,
+		CABundle: c.caBundle,
+	})
+
+	if err != nil {
+		return
+	}
+
+	refName := plumbing.NewBranchReferenceName(branch)
+
+	for _, ref := range refs {
+		if ref.Name() == refName {
+			return ref.Hash().String(), nil
+		}
+	}
+
+	err = fmt.Errorf("The branch, %s, does not exist in the Git "+
+		"repository, %s", branch, c.url)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to fetch the commit at the head of a branch, along
+ * with the trees and blobs which it references.  A shallow clone is used so
+ * that the history of the branch is not retrieved.
+ */
+
+func (c *gitClient) fetchBranch(ctx context.Context, branch string) (
+	commit *object.Commit, err error) {
+
+	repository, err := git.CloneContext(ctx, memory.NewStorage(), nil,
+		&git.CloneOptions{
+			URL:           c.url,
+			Auth:          c.auth,
+			CABundle:      c.caBundle,
+			ReferenceName: plumbing.NewBranchReferenceName(branch),
+			SingleBranch:  true,
+			Depth:         1,
+			Tags:          git.NoTags,
+		})
+
+	if err != nil {
+		return
+	}
+
+	head, err := repository.Head()
+
+	if err != nil {
+		return
+	}
+
+	return repository.CommitObject(head.Hash())
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to locate the tree of a directory within a commit.
+ * The root tree of the commit is returned for an empty path.
+ */
+
+func gitFindTree(commit *object.Commit, dir string) (
+	tree *object.Tree, err error) {
+
+	tree, err = commit.Tree()
+
+	if err != nil {
+		return
+	}
+
+	dir = strings.Trim(path.Clean("/"+dir), "/")
+
+	if len(dir) == 0 {
+		return
+	}
+
+	tree, err = tree.Tree(dir)
+
+	if errors.Is(err, object.ErrDirectoryNotFound) {
+		err = fmt.Errorf("The directory, %s, does not exist in the Git "+
+			"commit, %s", dir, commit.Hash)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to determine whether a tree entry is a regular
+ * file.  Symbolic links and submodules are not mirrored.
+ */
+
+func gitIsFile(mode filemode.FileMode) bool {
+	return mode.IsRegular() || mode == filemode.Executable
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to read the content of a file.
+ */
+
+func gitReadFile(file *object.File) (data []byte, err error) {
+	reader, err := file.Reader()
+
+	if err != nil {
+		return
+	}
+
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+/*****************************************************************************/
@@ -0,0 +1,224 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+/*****************************************************************************/
+
+/*
+ * This function is used to create a repository, on the 'main' branch, with
+ * a commit for each of the supplied sets of files.  The identifiers of the
+ * commits are returned.
+ */
+
+func newTestGitRepository(t *testing.T, dir string,
+	commits ...map[string]string) (ids []string) {
+
+	repository, err := git.PlainInitWithOptions(dir, &git.PlainInitOptions{
+		InitOptions: git.InitOptions{
+			DefaultBranch: plumbing.NewBranchReferenceName("main"),
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	worktree, err := repository.Worktree()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, files := range commits {
+		for name, content := range files {
+			file := filepath.Join(dir, name)
+
+			if err = os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = os.WriteFile(file, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = worktree.Add(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		id, err := worktree.Commit("test", &git.CommitOptions{
+			Author: &object.Signature{
+				Name:  "test",
+				Email: "test@example.com",
+				When:  time.Now(),
+			},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, id.String())
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to serve the repositories within the supplied
+ * directory with 'git http-backend', which requires the supplied
+ * credentials.  The test is skipped if git is not installed.
+ */
+
+func newTestGitServer(t *testing.T, root string, username string,
+	password string) *httptest.Server {
+
+	gitPath, err := exec.LookPath("git")
+
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+
+	backend := &cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + root,
+			"GIT_HTTP_EXPORT_ALL=1",
+			"HOME=" + t.TempDir(),
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			user, pass, ok := r.BasicAuth()
+
+			if !ok || user != username || pass != password {
+				w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+				w.WriteHeader(http.StatusUnauthorized)
+
+				return
+			}
+
+			backend.ServeHTTP(w, r)
+		}))
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify that the head of a branch is resolved and fetched, and that only
+ * the head commit is fetched.
+ */
+
+func TestGitClient(t *testing.T) {
+	root := t.TempDir()
+
+	ids := newTestGitRepository(t, filepath.Join(root, "config"),
+		map[string]string{
+			"snapshots/ivia_old.snapshot": "old",
+		},
+		map[string]string{
+			"ivia/snapshots/ivia_11.0.0.0_published.snapshot": "snapshot",
+			"ivia/fixpacks/fixpack.fixpack":                   "fixpack",
+			"ivia/" + gitManifestName:                         "modified: {}",
+		})
+
+	server := newTestGitServer(t, root, "user", "passw0rd")
+
+	ctx := context.Background()
+
+	client := &gitClient{
+		url:  server.URL + "/config",
+		auth: &githttp.BasicAuth{Username: "user", Password: "passw0rd"},
+	}
+
+	commit, err := client.resolveBranch(ctx, "main")
+
+	if err != nil || commit != ids[1] {
+		t.Fatalf("resolveBranch returned %q, %v, want %q", commit, err, ids[1])
+	}
+
+	if _, err = client.resolveBranch(ctx, "missing"); err == nil {
+		t.Errorf("resolveBranch of a missing branch succeeded")
+	}
+
+	head, err := client.fetchBranch(ctx, "main")
+
+	if err != nil {
+		t.Fatalf("fetchBranch: %v", err)
+	}
+
+	if head.Hash.String() != ids[1] {
+		t.Errorf("fetchBranch returned %s, want %s", head.Hash, ids[1])
+	}
+
+	if _, err = head.Parent(0); err == nil {
+		t.Errorf("the parent of the head commit was fetched")
+	}
+
+	/*
+	 * Locate the directory, and read a file from it.
+	 */
+
+	for _, dir := range []string{"ivia", "/ivia/", "./ivia"} {
+		tree, err := gitFindTree(head, dir)
+
+		if err != nil {
+			t.Fatalf("gitFindTree(%q): %v", dir, err)
+		}
+
+		file, err := tree.File("snapshots/ivia_11.0.0.0_published.snapshot")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := gitReadFile(file)
+
+		if err != nil || string(data) != "snapshot" {
+			t.Errorf("gitReadFile returned %q, %v", data, err)
+		}
+	}
+
+	if _, err = gitFindTree(head, "missing"); err == nil {
+		t.Errorf("gitFindTree of a missing directory succeeded")
+	}
+
+	/*
+	 * The repository rejects the wrong credentials.
+	 */
+
+	client.auth = &githttp.BasicAuth{Username: "user", Password: "wrong"}
+
+	if _, err = client.resolveBranch(ctx, "main"); err == nil {
+		t.Errorf("resolveBranch succeeded with the wrong credentials")
+	}
+}
+
+/*****************************************************************************/
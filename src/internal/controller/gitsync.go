@@ -0,0 +1,373 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+/*****************************************************************************/
+
+/*
+ * The GitOptions structure contains the options which are used to mirror
+ * the snapshots and fixpacks from a Git repository.  The repository is not
+ * mirrored if no URL is specified.
+ */
+
+type GitOptions struct {
+	// The http or https URL of the repository, for example
+	// 'https://github.com/example/ivia-config.git'.
+	URL string
+
+	// The branch which is mirrored.
+	Branch string
+
+	// The directory, within the repository, which holds the 'snapshots' and
+	// 'fixpacks' directories.  The root of the repository is used if no
+	// directory is specified.
+	Path string
+
+	// The name of a secret, in the namespace of the operator, which holds
+	// the 'username' and 'password' (or access token) for the repository.
+	SecretName string
+
+	// The interval at which the branch is checked for new commits.
+	Interval time.Duration
+
+	// The file which contains the CA certificates which are used to verify
+	// the certificate of the repository.
+	CAFile string
+}
+
+/*****************************************************************************/
+
+/*
+ * The gitManifest structure holds the optional manifest file which can be
+ * included in the mirrored directory of the repository.  The manifest
+ * supplies the list of modified services for each file, keyed by the name
+ * of the file relative to the directory, for example:
+ *
+ *   modified:
+ *     snapshots/ivia_11.0.0.0_published.snapshot: wrp:default,runtime
+ */
+
+type gitManifest struct {
+	Modified map[string]string `json:"modified,omitempty"`
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to mirror the Git repository until the supplied
+ * context is cancelled.  It is added to the controller manager as a
+ * runnable, and so is only run by the leader when leader election is
+ * enabled.
+ */
+
+func (mgr *SnapshotMgr) syncRepository(ctx context.Context) error {
+	mgr.log.V(9).Info("Entering a function", "Function", "syncRepository")
+
+	mgr.log.Info("Mirroring the Git repository", "URL", mgr.options.Git.URL,
+		"Branch", mgr.options.Git.Branch)
+
+	ticker := time.NewTicker(mgr.options.Git.Interval)
+	defer ticker.Stop()
+
+	commit := ""
+
+	for {
+		latest, err := mgr.syncCommit(ctx, commit)
+
+		if err != nil {
+			mgr.log.Error(err, "Failed to mirror the Git repository",
+				"URL", mgr.options.Git.URL)
+		} else {
+			commit = latest
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to create the client for the Git repository.  The
+ * credentials are read from the secret on each call so that they can be
+ * rotated without restarting the operator.
+ */
+
+func (mgr *SnapshotMgr) newGitClient(ctx context.Context) (
+	client *gitClient, err error) {
+
+	options := mgr.options.Git
+
+	if !strings.HasPrefix(options.URL, "https://") &&
+		!strings.HasPrefix(options.URL, "http://") {
+		err = fmt.Errorf("The URL of the Git repository, %s, must be an "+
+			"http or https URL", options.URL)
+
+		return
+	}
+
+	client = &gitClient{
+		url: strings.TrimSuffix(options.URL, "/"),
+	}
+
+	if len(options.CAFile) > 0 {
+		client.caBundle, err = os.ReadFile(options.CAFile)
+
+		if err != nil {
+			return
+		}
+
+		if !x509.NewCertPool().AppendCertsFromPEM(client.caBundle) {
+			err = fmt.Errorf("The CA file, %s, does not contain any "+
+				"certificates", options.CAFile)
+
+			return
+		}
+	}
+
+	if len(options.SecretName) > 0 {
+		clientset, cerr := kubernetes.NewForConfig(mgr.config)
+
+		if cerr != nil {
+			return nil, cerr
+		}
+
+		secret, serr := clientset.CoreV1().Secrets(mgr.namespace).Get(
+			ctx, options.SecretName, metav1.GetOptions{})
+
+		if serr != nil {
+			return nil, serr
+		}
+
+		client.auth = &githttp.BasicAuth{
+			Username: string(secret.Data[corev1.BasicAuthUsernameKey]),
+			Password: string(secret.Data[corev1.BasicAuthPasswordKey]),
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to mirror the commit at the head of the branch,
+ * unless it is the commit which was last mirrored.  Each file which differs
+ * from the stored file is saved, and the deployments which use the file are
+ * then restarted.  Files which have been removed from the repository are not
+ * removed from the store.  The commit which was mirrored is returned.
+ */
+
+func (mgr *SnapshotMgr) syncCommit(ctx context.Context, last string) (
+	commit string, err error) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "syncCommit")
+
+	ctx, cancel := context.WithTimeout(ctx, snapshotSourceTimeout)
+	defer cancel()
+
+	client, err := mgr.newGitClient(ctx)
+
+	if err != nil {
+		return
+	}
+
+	commit, err = client.resolveBranch(ctx, mgr.options.Git.Branch)
+
+	if err != nil || commit == last {
+		return
+	}
+
+	mgr.log.V(5).Info("Fetching the Git commit", "Commit", commit)
+
+	/*
+	 * The branch may have moved since it was resolved, and so the commit
+	 * which is mirrored is the commit which was fetched.
+	 */
+
+	head, err := client.fetchBranch(ctx, mgr.options.Git.Branch)
+
+	if err != nil {
+		return "", err
+	}
+
+	commit = head.Hash.String()
+
+	dir, err := gitFindTree(head, mgr.options.Git.Path)
+
+	if err != nil {
+		return "", err
+	}
+
+	/*
+	 * Load the manifest, and then work out which files are to be mirrored.
+	 */
+
+	manifest := gitManifest{}
+	files := map[string]*object.File{}
+
+	if file, ferr := dir.File(gitManifestName); ferr == nil {
+		data, lerr := gitReadFile(file)
+
+		if lerr == nil {
+			lerr = yaml.Unmarshal(data, &manifest)
+		}
+
+		if lerr != nil {
+			return "", fmt.Errorf("The manifest, %s, is not valid: %w",
+				gitManifestName, lerr)
+		}
+	} else if !errors.Is(ferr, object.ErrFileNotFound) {
+		return "", ferr
+	}
+
+	for _, subdir := range []string{"snapshots", "fixpacks"} {
+		children, terr := dir.Tree(subdir)
+
+		if errors.Is(terr, object.ErrDirectoryNotFound) {
+			continue
+		} else if terr != nil {
+			return "", terr
+		}
+
+		for idx := range children.Entries {
+			child := &children.Entries[idx]
+
+			if !gitIsFile(child.Mode) || strings.HasPrefix(child.Name, ".") {
+				continue
+			}
+
+			if subdir == "snapshots" &&
+				!strings.HasSuffix(child.Name, ".snapshot") {
+				continue
+			}
+
+			file, ferr := children.TreeEntryFile(child)
+
+			if ferr != nil {
+				return "", ferr
+			}
+
+			files[path.Join(subdir, child.Name)] = file
+		}
+	}
+
+	/*
+	 * Save each file which has changed, and restart the deployments which
+	 * use it.
+	 */
+
+	var failed error
+
+	for name, file := range files {
+		data, lerr := gitReadFile(file)
+
+		if lerr == nil {
+			lerr = mgr.syncFile(ctx, name, data, commit,
+				manifest.Modified[name])
+		}
+
+		if lerr != nil {
+			mgr.log.Error(lerr, "Failed to mirror the file", "File", name,
+				"Commit", commit)
+
+			failed = lerr
+		}
+	}
+
+	if failed != nil {
+		return "", failed
+	}
+
+	mgr.log.Info("Mirrored the Git commit", "Commit", commit)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to save a single file from the repository, if it
+ * differs from the stored file, and then to restart the deployments which
+ * use the file.  A gated snapshot is submitted for approval instead, unless
+ * the same snapshot is already waiting to be approved or has been rejected.
+ */
+
+func (mgr *SnapshotMgr) syncFile(ctx context.Context, name string,
+	data []byte, commit string, modified string) (err error) {
+
+	hash := sha256.Sum256(data)
+	digest := hex.EncodeToString(hash[:])
+
+	current, err := mgr.statFile(ctx, name)
+
+	if err == nil && current.Digest == digest {
+		return
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+
+	err = nil
+
+	if mgr.heldSnapshot(ctx, name, digest) != nil {
+		return
+	}
+
+	metadata := &fileMetadata{
+		Client:   fmt.Sprintf("git:%s@%s", mgr.options.Git.URL, commit),
+		Modified: modified,
+	}
+
+	err = mgr.submitFile(ctx, name, bytes.NewReader(data), int64(len(data)),
+		digest, metadata)
+
+	if err != nil {
+		return
+	}
+
+	if metadata.Approval == approvalPending {
+		mgr.log.Info("A snapshot from the Git repository is waiting to be "+
+			"approved", "File", name, "Commit", commit)
+
+		return
+	}
+
+	mgr.log.Info("Mirrored a file from the Git repository", "File", name,
+		"Commit", commit, "Modified", modified)
+
+	mgr.rollingRestart("/"+name, modified, "", metadata.Client)
+
+	return
+}
+
+/*****************************************************************************/
@@ -0,0 +1,377 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*****************************************************************************/
+
+/*
+ * This function is used to split an action (i.e. '/history', '/rollback',
+ * '/approve' or '/reject') from the end of the supplied path.  An action
+ * always follows the name of a file, and so a file which is itself named
+ * after an action, for example '/fixpacks/history', is not mistaken for an
+ * action.  The path is returned unchanged if it does not end with an action.
+ */
+
+func splitAction(urlPath string) (filePath string, action string) {
+	for _, candidate := range []string{historyAction, rollbackAction,
+		approveAction, rejectAction} {
+		trimmed, found := strings.CutSuffix(urlPath, "/"+candidate)
+
+		if found && strings.Count(trimmed, "/") >= 2 {
+			return trimmed, candidate
+		}
+	}
+
+	return urlPath, ""
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the name of the directory, within the
+ * store, which holds the history of the specified file.
+ */
+
+func historyDir(name string) string {
+	return path.Join(historyDirName, name)
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the revisions which are held in the
+ * history of the specified file, in ascending order.
+ */
+
+func (mgr *SnapshotMgr) revisionNumbers(
+	ctx context.Context, name string) (revisions []int) {
+
+	files, err := mgr.store.List(ctx, historyDir(name))
+
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		revision, err := strconv.Atoi(file.Name)
+
+		if err == nil && revision > 0 {
+			revisions = append(revisions, revision)
+		}
+	}
+
+	sort.Ints(revisions)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the number of the next revision of the
+ * specified file, or 0 if the history has been disabled.  A file which is
+ * waiting to be approved has no history.
+ */
+
+func (mgr *SnapshotMgr) nextRevision(ctx context.Context, name string) int {
+	if mgr.options.SnapshotHistory <= 0 || isPendingName(name) {
+		return 0
+	}
+
+	revisions := mgr.revisionNumbers(ctx, name)
+
+	if len(revisions) == 0 {
+		return 1
+	}
+
+	return revisions[len(revisions)-1] + 1
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to add the specified file, which has just been
+ * saved, to the history of the file as the specified revision.  The oldest
+ * revisions are removed so that no more than the configured number of
+ * revisions are kept.  Any failure is logged, but does not cause the upload
+ * to fail.
+ */
+
+func (mgr *SnapshotMgr) addRevision(
+	ctx context.Context, name string, revision int) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "addRevision")
+
+	if revision <= 0 {
+		return
+	}
+
+	dir := historyDir(name)
+
+	err := mgr.store.Copy(ctx, name, path.Join(dir, strconv.Itoa(revision)))
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to add the file to the history",
+			"File", name)
+
+		return
+	}
+
+	mgr.log.V(5).Info("Added a new revision of the file",
+		"File", name, "Revision", revision)
+
+	/*
+	 * Remove the oldest revisions.
+	 */
+
+	revisions := mgr.revisionNumbers(ctx, name)
+
+	for len(revisions) > mgr.options.SnapshotHistory {
+		err = mgr.store.Delete(ctx, path.Join(dir, strconv.Itoa(revisions[0])))
+
+		if err != nil {
+			mgr.log.Error(err, "Failed to remove an old revision of the file",
+				"File", name, "Revision", revisions[0])
+		} else {
+			mgr.log.V(5).Info("Removed an old revision of the file",
+				"File", name, "Revision", revisions[0])
+		}
+
+		revisions = revisions[1:]
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the metadata for each of the revisions
+ * of the specified file, with the most recent revision first.
+ */
+
+func (mgr *SnapshotMgr) listRevisions(
+	ctx context.Context, name string) []*fileMetadata {
+
+	files, _ := mgr.store.List(ctx, historyDir(name))
+
+	history := make([]*fileMetadata, 0, len(files))
+
+	for _, file := range files {
+		revision, err := strconv.Atoi(file.Name)
+
+		if err != nil || revision <= 0 {
+			continue
+		}
+
+		file.Name = path.Base(name)
+		file.Revision = revision
+
+		history = append(history, file)
+	}
+
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Revision > history[j].Revision
+	})
+
+	return history
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to re-publish a previous revision of the specified
+ * file.  The revision is re-published as a new revision, so that the
+ * rollback itself can be undone.  A revision of a gated snapshot is
+ * submitted for approval, in the same way as an upload.  The metadata of the
+ * re-published file is returned.
+ */
+
+func (mgr *SnapshotMgr) rollback(
+	ctx context.Context, name string, revision int, client string) (
+	metadata *fileMetadata, err error) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "rollback")
+
+	mgr.webMutex.RLock()
+	src, revMetadata, err := mgr.store.Get(ctx,
+		path.Join(historyDir(name), strconv.Itoa(revision)))
+	mgr.webMutex.RUnlock()
+
+	if err != nil {
+		return
+	}
+
+	defer src.Close()
+
+	/*
+	 * The file is saved in exactly the same way as an uploaded file.  The
+	 * digest of the revision is checked to ensure that the revision has not
+	 * been corrupted.
+	 */
+
+	metadata = &fileMetadata{
+		Client:     client,
+		Modified:   revMetadata.Modified,
+		RollbackOf: revision,
+	}
+
+	err = mgr.submitFile(ctx, name, src, revMetadata.Size, revMetadata.Digest,
+		metadata)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to handle a request for the history of a file, a
+ * request to roll back a file to a previous revision, or a request to
+ * approve or reject a pending snapshot.
+ */
+
+func (mgr *SnapshotMgr) serveAction(
+	w http.ResponseWriter,
+	r *http.Request,
+	action string,
+	urlPath string,
+	client string) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "serveAction")
+
+	switch {
+
+	/*
+	 * For the history we return the metadata of each of the revisions.
+	 */
+
+	case action == historyAction && r.Method == "GET":
+		mgr.log.Info("Processing a history request",
+			"Path", urlPath, "Client", client)
+
+		mgr.webMutex.RLock()
+		history := mgr.listRevisions(r.Context(), storeName(urlPath))
+		mgr.webMutex.RUnlock()
+
+		jsonStr, err := json.Marshal(history)
+
+		if err != nil {
+			mgr.log.V(5).Error(err, "Error serializing the history")
+
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonStr)
+
+	/*
+	 * For a rollback we re-publish the specified revision, and then trigger
+	 * a rolling restart exactly as if the revision had been uploaded.
+	 */
+
+	case action == rollbackAction && r.Method == "POST":
+		revision, err := strconv.Atoi(r.URL.Query().Get("revision"))
+
+		if err != nil || revision <= 0 {
+			http.Error(w, "A valid revision must be specified",
+				http.StatusBadRequest)
+
+			return
+		}
+
+		mgr.log.Info("Processing a rollback",
+			"Path", urlPath, "Revision", revision, "Client", client)
+
+		metadata, err := mgr.rollback(r.Context(), storeName(urlPath),
+			revision, client)
+
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w,
+				fmt.Sprintf("Revision %d of the file does not exist", revision),
+				http.StatusNotFound)
+
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			mgr.log.Error(err, "Failed to roll back the file",
+				"Path", urlPath, "Revision", revision)
+
+			return
+		}
+
+		modified := r.URL.Query().Get("modified")
+
+		if len(modified) == 0 {
+			modified = metadata.Modified
+		}
+
+		response := jobResponse{fileMetadata: metadata}
+		status := http.StatusAccepted
+
+		/*
+		 * The revision of a gated snapshot is not published until it has
+		 * been approved.
+		 */
+
+		if metadata.Approval != approvalPending {
+			status = http.StatusCreated
+
+			if job := mgr.rollingRestart(filepath.Clean(urlPath), modified,
+				"", client); job != nil {
+				response.Job = job.Id
+			}
+		}
+
+		jsonStr, _ := json.Marshal(response)
+
+		setDigestHeaders(w, metadata)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(jsonStr)
+
+		mgr.log.Info("The file has been rolled back",
+			"Path", urlPath,
+			"Revision", revision,
+			"NewRevision", metadata.Revision)
+
+	/*
+	 * Approving, or rejecting, a pending snapshot is handled separately.
+	 */
+
+	case (action == approveAction || action == rejectAction) &&
+		r.Method == "POST" && strings.HasPrefix(urlPath, "/snapshots/"):
+		mgr.serveReview(w, r, action, urlPath, client)
+
+	default:
+		mgr.log.V(5).Info("Received a request with an invalid method",
+			"Path", r.URL.Path,
+			"Client", client,
+			"Method", r.Method)
+
+		http.Error(w,
+			http.StatusText(http.StatusNotImplemented),
+			http.StatusNotImplemented)
+	}
+}
+
+/*****************************************************************************/
@@ -0,0 +1,49 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+import (
+	"testing"
+)
+
+/*****************************************************************************/
+
+/*
+ * Verify that an action is split from the end of a path, and that a file
+ * which is named after an action can still be reached.
+ */
+
+func TestSplitAction(t *testing.T) {
+	tests := []struct {
+		urlPath  string
+		filePath string
+		action   string
+	}{
+		{"/snapshots/ivia_11.0.0.0_published.snapshot",
+			"/snapshots/ivia_11.0.0.0_published.snapshot", ""},
+		{"/snapshots/ivia_11.0.0.0_published.snapshot/history",
+			"/snapshots/ivia_11.0.0.0_published.snapshot", historyAction},
+		{"/snapshots/ivia_11.0.0.0_published.snapshot/approve",
+			"/snapshots/ivia_11.0.0.0_published.snapshot", approveAction},
+		{"/fixpacks/test.fixpack/rollback", "/fixpacks/test.fixpack",
+			rollbackAction},
+		{"/fixpacks/history", "/fixpacks/history", ""},
+		{"/fixpacks/reject", "/fixpacks/reject", ""},
+		{"/fixpacks/history/history", "/fixpacks/history", historyAction},
+		{"/jobs/approve", "/jobs/approve", ""},
+		{"/history", "/history", ""},
+	}
+
+	for _, test := range tests {
+		filePath, action := splitAction(test.urlPath)
+
+		if filePath != test.filePath || action != test.action {
+			t.Errorf("splitAction(%q) = %q, %q, want %q, %q", test.urlPath,
+				filePath, action, test.filePath, test.action)
+		}
+	}
+}
+
+/*****************************************************************************/
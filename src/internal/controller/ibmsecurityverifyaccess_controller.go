@@ -13,19 +13,21 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/types"
 
 	"context"
 	"fmt"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/go-logr/logr"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	ibmv1 "github.com/ibm-security/verify-access-operator/api/v1"
 )
@@ -40,11 +42,12 @@ import (
 type IBMSecurityVerifyAccessReconciler struct {
 	client.Client
 
-	Log            logr.Logger
-	Scheme         *runtime.Scheme
-	localNamespace string
-	snapshotMgr    SnapshotMgr
-	secretMutex    *sync.Mutex
+	Log                logr.Logger
+	Scheme             *runtime.Scheme
+	SnapshotMgrOptions SnapshotMgrOptions
+	localNamespace     string
+	snapshotMgr        SnapshotMgr
+	secretMutex        *sync.Mutex
 }
 
 /*****************************************************************************/
@@ -53,8 +56,13 @@ type IBMSecurityVerifyAccessReconciler struct {
 //+kubebuilder:rbac:groups=ibm.com,resources=ibmsecurityverifyaccesses/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=ibm.com,resources=ibmsecurityverifyaccesses/finalizers,verbs=update
 //+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
 //+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=cert-manager.io,resources=certificates,verbs=get;list;watch;create;update;patch
 
 /*****************************************************************************/
 
@@ -100,13 +108,81 @@ func (r *IBMSecurityVerifyAccessReconciler) Reconcile(
 		return ctrl.Result{}, err
 	}
 
+	/*
+	 * Approve, or reject, any pending snapshot which has been reviewed by
+	 * annotating the resource.
+	 */
+
+	err = r.reviewSnapshots(ctx, verifyaccess)
+
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	/*
+	 * Start any restart which was deferred until the restart window of the
+	 * resource opened.
+	 */
+
+	windowResult, err := r.reconcileRestartWindow(ctx, verifyaccess)
+
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	/*
+	 * Start a restart which has been requested by a new restart token.
+	 */
+
+	tokenResult, err := r.reconcileRestartToken(ctx, verifyaccess)
+
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	result, err := r.reconcileWorkload(ctx, verifyaccess)
+
+	return earliestResult(result, windowResult, tokenResult), err
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to reconcile the workload of a custom
+ * resource, which is either a StatefulSet, a pair of blue/green deployments
+ * or a single deployment.
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) reconcileWorkload(
+	ctx context.Context,
+	verifyaccess *ibmv1.IBMSecurityVerifyAccess) (ctrl.Result, error) {
+
+	/*
+	 * A configuration container is deployed as a StatefulSet rather than as
+	 * a Deployment.
+	 */
+
+	if serviceNameForVerifyAccess(verifyaccess) == configServiceName {
+		return r.reconcileStatefulSet(ctx, verifyaccess)
+	}
+
+	/*
+	 * With the BlueGreen upgrade strategy the custom resource is deployed as
+	 * a pair of deployments, behind a service which is managed by the
+	 * operator.
+	 */
+
+	if verifyaccess.Spec.UpgradeStrategy == ibmv1.BlueGreen {
+		return r.reconcileBlueGreen(ctx, verifyaccess)
+	}
+
 	/*
 	 * Check if the deployment already exists, and if one doesn't we create a
 	 * new one now.
 	 */
 
 	found := &appsv1.Deployment{}
-	err = r.Get(
+	err := r.Get(
 		ctx,
 		types.NamespacedName{
 			Name:      verifyaccess.Name,
@@ -185,6 +261,107 @@ func (r *IBMSecurityVerifyAccessReconciler) Reconcile(
 		return ctrl.Result{}, err
 	}
 
+	/*
+	 * Reconcile the canary rollout of a candidate snapshot, if any.
+	 */
+
+	return r.reconcileCanary(ctx, verifyaccess, found)
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to reconcile a configuration container.
+ * The configuration container is deployed as a StatefulSet, with a
+ * persistent volume for its data, and at most a single replica.  The
+ * StatefulSet is never restarted when a snapshot is published, as it is the
+ * configuration container which publishes the snapshots.
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) reconcileStatefulSet(
+	ctx context.Context,
+	verifyaccess *ibmv1.IBMSecurityVerifyAccess) (ctrl.Result, error) {
+
+	r.Log.V(9).Info("Entering a function", "Function", "reconcileStatefulSet")
+
+	found := &appsv1.StatefulSet{}
+	err := r.Get(
+		ctx,
+		types.NamespacedName{
+			Name:      verifyaccess.Name,
+			Namespace: verifyaccess.Namespace},
+		found)
+
+	if err != nil {
+		if errors.IsNotFound(err) {
+			/*
+			 * The StatefulSet requires the secret which contains the
+			 * snapshot manager credentials, along with the secret which
+			 * contains the read-write credential.
+			 */
+
+			err = r.createSecret(ctx, verifyaccess)
+
+			if err == nil {
+				err = r.createPublishSecret(ctx, verifyaccess)
+			}
+
+			if err == nil {
+				sts := r.statefulSetForVerifyAccess(verifyaccess)
+
+				r.Log.Info("Creating a new stateful set",
+					"StatefulSet.Namespace", sts.Namespace,
+					"StatefulSet.Name", sts.Name)
+
+				err = r.Create(ctx, sts)
+
+				if err != nil {
+					r.Log.Error(err, "Failed to create the new stateful set",
+						"StatefulSet.Namespace", sts.Namespace,
+						"StatefulSet.Name", sts.Name)
+				}
+			}
+
+		} else {
+			r.Log.Error(err, "Failed to retrieve the StatefulSet resource")
+		}
+
+		r.setCondition(err, true, ctx, verifyaccess)
+
+		return ctrl.Result{}, err
+	}
+
+	/*
+	 * The StatefulSet already exists.  The number of replicas is the only
+	 * field which can be updated.
+	 */
+
+	r.Log.V(5).Info("Found a matching stateful set",
+		"StatefulSet.Namespace", found.Namespace,
+		"StatefulSet.Name", found.Name)
+
+	replicas := configReplicas(verifyaccess)
+
+	if *found.Spec.Replicas != replicas {
+		found.Spec.Replicas = &replicas
+
+		err = r.Update(ctx, found)
+
+		if err != nil {
+			r.Log.Error(err, "Failed to update stateful set",
+				"StatefulSet.Namespace", found.Namespace,
+				"StatefulSet.Name", found.Name)
+		} else {
+			r.Log.Info("Updated an existing stateful set",
+				"StatefulSet.Namespace", found.Namespace,
+				"StatefulSet.Name", found.Name)
+		}
+
+		r.setCondition(err, false, ctx, verifyaccess)
+
+		return ctrl.Result{}, err
+	}
+
 	return ctrl.Result{}, nil
 }
 
@@ -212,26 +389,25 @@ func (r *IBMSecurityVerifyAccessReconciler) setCondition(
 		condMessage = "The deployment has been updated."
 	}
 
-	currentTime := metav1.NewTime(time.Now())
+	/*
+	 * Only the Available condition is replaced, so that the other
+	 * conditions, such as the outcome of the last restart, are retained.
+	 */
 
-	if err == nil {
-		m.Status.Conditions = []metav1.Condition{{
-			Type:               "Available",
-			Status:             metav1.ConditionTrue,
-			Reason:             condReason,
-			Message:            condMessage,
-			LastTransitionTime: currentTime,
-		}}
-	} else {
-		m.Status.Conditions = []metav1.Condition{{
-			Type:               "Available",
-			Status:             metav1.ConditionFalse,
-			Reason:             condReason,
-			Message:            err.Error(),
-			LastTransitionTime: currentTime,
-		}}
+	condition := metav1.Condition{
+		Type:    "Available",
+		Status:  metav1.ConditionTrue,
+		Reason:  condReason,
+		Message: condMessage,
+	}
+
+	if err != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Message = err.Error()
 	}
 
+	apimeta.SetStatusCondition(&m.Status.Conditions, condition)
+
 	if err := r.Status().Update(ctx, m); err != nil {
 		r.Log.Error(err, "Failed to update the condition for the resource",
 			"Deployment.Namespace", m.Namespace,
@@ -254,6 +430,15 @@ func (r *IBMSecurityVerifyAccessReconciler) createSecret(
 	ctx context.Context,
 	m *ibmv1.IBMSecurityVerifyAccess) (err error) {
 
+	/*
+	 * The secret in the namespace of the operator is managed by the snapshot
+	 * manager itself, and already contains all of the required data.
+	 */
+
+	if m.Namespace == r.snapshotMgr.namespace {
+		return
+	}
+
 	r.secretMutex.Lock()
 
 	/*
@@ -286,12 +471,7 @@ func (r *IBMSecurityVerifyAccessReconciler) createSecret(
 					Name:      operatorName,
 					Namespace: m.Namespace,
 				},
-				StringData: map[string]string{
-					userFieldName:  snapshotMgrUser,
-					urlFieldName:   r.snapshotMgr.creds[urlFieldName],
-					roPwdFieldName: r.snapshotMgr.creds[roPwdFieldName],
-					certFieldName:  r.snapshotMgr.creds[certFieldName],
-				},
+				StringData: r.snapshotMgr.namespaceSecretData(),
 			}
 
 			err = r.Create(ctx, secret)
@@ -311,19 +491,17 @@ func (r *IBMSecurityVerifyAccessReconciler) createSecret(
 			"Deployment.Namespace", m.Namespace,
 			"Secret.Name", operatorName)
 		var requireUpdate bool
-		for k, v := range secret.Data {
-			secVal := string(v[:])
-			myVal, ok := r.snapshotMgr.creds[k]
-			if ok {
-				if secVal != myVal {
-					requireUpdate = true
-				}
-			} else {
+		data := r.snapshotMgr.namespaceSecretData()
+		for k := range secret.Data {
+			if _, ok := data[k]; !ok {
 				r.Log.V(1).Info(fmt.Sprintf("Unknown key [%s] found in verify-access-operator secret!", k))
 			}
 		}
-		if len(secret.Data) < 4 { // 5 if rwPwd is defined, legacy is len 3 (missing tls.cert)
-			requireUpdate = true
+		for k, myVal := range data {
+			secVal, ok := secret.Data[k]
+			if !ok || string(secVal[:]) != myVal {
+				requireUpdate = true
+			}
 		}
 		r.Log.V(7).Info(fmt.Sprintf("Secret require update %t", requireUpdate))
 		if requireUpdate == true {
@@ -333,12 +511,7 @@ func (r *IBMSecurityVerifyAccessReconciler) createSecret(
 					Name:      operatorName,
 					Namespace: m.Namespace,
 				},
-				StringData: map[string]string{
-					userFieldName:  snapshotMgrUser,
-					urlFieldName:   r.snapshotMgr.creds[urlFieldName],
-					roPwdFieldName: r.snapshotMgr.creds[roPwdFieldName],
-					certFieldName:  r.snapshotMgr.creds[certFieldName],
-				},
+				StringData: data,
 			}
 
 			err = r.Update(ctx, secret)
@@ -352,6 +525,104 @@ func (r *IBMSecurityVerifyAccessReconciler) createSecret(
 
 /*****************************************************************************/
 
+/*
+ * The following function is used to create, or update, the secret which
+ * holds the read-write credential for a configuration container.  The
+ * secret in the namespace of the operator already contains the credential.
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) createPublishSecret(
+	ctx context.Context,
+	m *ibmv1.IBMSecurityVerifyAccess) (err error) {
+
+	if m.Namespace == r.snapshotMgr.namespace {
+		return
+	}
+
+	r.secretMutex.Lock()
+	defer r.secretMutex.Unlock()
+
+	data := map[string]string{
+		rwPwdFieldName: r.snapshotMgr.getCred(rwPwdFieldName),
+	}
+
+	secret := &corev1.Secret{}
+	err = r.Get(
+		ctx,
+		types.NamespacedName{
+			Name:      publishSecretName,
+			Namespace: m.Namespace,
+		},
+		secret)
+
+	if errors.IsNotFound(err) {
+		r.Log.V(5).Info("Creating the secret",
+			"Deployment.Namespace", m.Namespace,
+			"Secret.Name", publishSecretName)
+
+		secret = &corev1.Secret{
+			Type: apiv1.SecretTypeOpaque,
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      publishSecretName,
+				Namespace: m.Namespace,
+			},
+			StringData: data,
+		}
+
+		err = r.Create(ctx, secret)
+	} else if err == nil &&
+		string(secret.Data[rwPwdFieldName]) != data[rwPwdFieldName] {
+		secret.StringData = data
+
+		err = r.Update(ctx, secret)
+	}
+
+	if err != nil {
+		r.Log.Error(err, "Failed to create the secret",
+			"Deployment.Namespace", m.Namespace,
+			"Secret.Name", publishSecretName)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to work out the name of the service which
+ * is provided by a VerifyAccess resource.  We determine this from the name
+ * of the image, and the value of the INSTANCE environment variable.
+ */
+
+func serviceNameForVerifyAccess(
+	m *ibmv1.IBMSecurityVerifyAccess) (serviceName string) {
+
+	serviceName = "unknown"
+	imageComponent := strings.Split(m.Spec.Image, ":")[0]
+
+	if strings.HasSuffix(imageComponent, "wrp") {
+		if m.Spec.Instance != "" {
+			serviceName = fmt.Sprintf("wrp-%s", m.Spec.Instance)
+		} else {
+			serviceName = "wrp-default"
+		}
+	} else if strings.HasSuffix(imageComponent, "runtime") {
+		serviceName = "runtime"
+	} else if strings.HasSuffix(imageComponent, "dsc") {
+		if m.Spec.Instance != "" {
+			serviceName = fmt.Sprintf("dsc-%s", m.Spec.Instance)
+		} else {
+			serviceName = "dsc-1"
+		}
+	} else if strings.HasSuffix(imageComponent, "config") {
+		serviceName = configServiceName
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
 /*
  * The following function is used to return a VerifyAccess Deployment object.
  *
@@ -385,28 +656,10 @@ func (r *IBMSecurityVerifyAccessReconciler) createSecret(
 func (r *IBMSecurityVerifyAccessReconciler) deploymentForVerifyAccess(
 	m *ibmv1.IBMSecurityVerifyAccess) *appsv1.Deployment {
 	/*
-	 * Work out the name of the service.  We determine this from the name of
-	 * the image, and the value of the INSTANCE environment variable.
+	 * Work out the name of the service.
 	 */
 
-	serviceName := "unknown"
-	imageComponent := strings.Split(m.Spec.Image, ":")[0]
-
-	if strings.HasSuffix(imageComponent, "wrp") {
-		if m.Spec.Instance != "" {
-			serviceName = fmt.Sprintf("wrp-%s", m.Spec.Instance)
-		} else {
-			serviceName = "wrp-default"
-		}
-	} else if strings.HasSuffix(imageComponent, "runtime") {
-		serviceName = "runtime"
-	} else if strings.HasSuffix(imageComponent, "dsc") {
-		if m.Spec.Instance != "" {
-			serviceName = fmt.Sprintf("dsc-%s", m.Spec.Instance)
-		} else {
-			serviceName = "dsc-1"
-		}
-	}
+	serviceName := serviceNameForVerifyAccess(m)
 
 	/*
 	 * The labels which are used in our deployment.
@@ -485,9 +738,24 @@ func (r *IBMSecurityVerifyAccessReconciler) deploymentForVerifyAccess(
 
 	/*
 	 * Set up the environment variables which are used to access the
-	 * embedded snapshot manager.
+	 * embedded snapshot manager.  A configuration container publishes
+	 * snapshots to the snapshot manager, and so is given the read-write
+	 * credential rather than the read-only credential.  The read-write
+	 * credential is held in a separate secret outside of the namespace of
+	 * the operator.
 	 */
 
+	pwdSecretName := operatorName
+	pwdFieldName := roPwdFieldName
+
+	if serviceName == configServiceName {
+		pwdFieldName = rwPwdFieldName
+
+		if m.Namespace != r.snapshotMgr.namespace {
+			pwdSecretName = publishSecretName
+		}
+	}
+
 	maxEnv := 7
 	env := make([]corev1.EnvVar, 0, maxEnv)
 
@@ -522,9 +790,9 @@ func (r *IBMSecurityVerifyAccessReconciler) deploymentForVerifyAccess(
 		ValueFrom: &corev1.EnvVarSource{
 			SecretKeyRef: &corev1.SecretKeySelector{
 				LocalObjectReference: corev1.LocalObjectReference{
-					Name: operatorName,
+					Name: pwdSecretName,
 				},
-				Key:      roPwdFieldName,
+				Key:      pwdFieldName,
 				Optional: &falseVar,
 			},
 		},
@@ -543,18 +811,13 @@ func (r *IBMSecurityVerifyAccessReconciler) deploymentForVerifyAccess(
 	/* Add TLS CAcert properties if they exist, else use kubernetes
 	   PKI as the default
 	*/
-	addSnapMgrCert := false
+	addSnapMgrCert := mountsOperatorCA(m)
 	if m.Spec.SnapshotTLSCacert != "" {
 		env = append(env, corev1.EnvVar{
 			Name:  "CONFIG_SERVICE_TLS_CACERT",
 			Value: m.Spec.SnapshotTLSCacert,
 		})
-		if m.Spec.SnapshotTLSCacert == "operator" {
-			addSnapMgrCert = true
-		}
-
 	} else {
-		addSnapMgrCert = true
 		env = append(env, corev1.EnvVar{
 			Name:  "CONFIG_SERVICE_TLS_CACERT",
 			Value: "operator",
@@ -565,10 +828,10 @@ func (r *IBMSecurityVerifyAccessReconciler) deploymentForVerifyAccess(
 	 * Add the rest of the environment variables (if specified).
 	 */
 
-	if m.Spec.SnapshotId != "" {
+	if snapshotId := activeSnapshotId(m); snapshotId != "" {
 		env = append(env, corev1.EnvVar{
 			Name:  "SNAPSHOT_ID",
-			Value: m.Spec.SnapshotId,
+			Value: snapshotId,
 		})
 	}
 
@@ -600,15 +863,15 @@ func (r *IBMSecurityVerifyAccessReconciler) deploymentForVerifyAccess(
 	vols := make([]corev1.Volume, 0, maxVols+1)
 	copy(vols, m.Spec.Volumes)
 	if addSnapMgrCert == true {
-		r.Log.V(5).Info("Adding snapshot manager service TLS certificate to deployment.")
-		//Mount the operator cert as a file here. This will avoid permissions issues
+		r.Log.V(5).Info("Adding snapshot manager service CA certificate to deployment.")
+		//Mount the operator CA cert as a file here. This will avoid permissions issues
 		//when service accounts try to read the verify-access-operator secret at
 		//runtime.
 		volMnts = append(volMnts, corev1.VolumeMount{
 			Name:      operatorName,
 			ReadOnly:  true,
 			MountPath: k8sSnapMgrCertFile,
-			SubPath:   certFieldName,
+			SubPath:   caCertFieldName,
 		})
 		vols = append(vols, corev1.Volume{
 			Name: operatorName,
@@ -617,8 +880,8 @@ func (r *IBMSecurityVerifyAccessReconciler) deploymentForVerifyAccess(
 					SecretName: operatorName,
 					Items: []corev1.KeyToPath{
 						corev1.KeyToPath{
-							Key:  certFieldName,
-							Path: certFieldName,
+							Key:  caCertFieldName,
+							Path: caCertFieldName,
 						},
 					},
 				},
@@ -742,6 +1005,94 @@ func (r *IBMSecurityVerifyAccessReconciler) deploymentForVerifyAccess(
 
 /*****************************************************************************/
 
+/*
+ * The following function is used to return the number of replicas for a
+ * configuration container, which can only be run with a single replica.
+ */
+
+func configReplicas(m *ibmv1.IBMSecurityVerifyAccess) int32 {
+	return min(m.Spec.Replicas, 1)
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to return a VerifyAccess StatefulSet
+ * object for a configuration container.  The pod template is the same as
+ * that of a Deployment, with the addition of a persistent volume which holds
+ * the data of the configuration container:
+ *
+ *    IBMSecurityVerifyAccess spec | StatefulSet spec
+ *    ---------------------------- | ----------------
+ *    replicas (0 or 1)            | replicas
+ *    storage.size                 | volumeClaimTemplates[0].spec.resources
+ *    storage.storageClassName     | volumeClaimTemplates[0].spec.storageClassName
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) statefulSetForVerifyAccess(
+	m *ibmv1.IBMSecurityVerifyAccess) *appsv1.StatefulSet {
+
+	dep := r.deploymentForVerifyAccess(m)
+	replicas := configReplicas(m)
+
+	/*
+	 * The persistent volume which holds the data of the configuration
+	 * container.
+	 */
+
+	size := resource.MustParse(configDefaultStorageSize)
+
+	var storageClassName *string
+
+	if m.Spec.Storage != nil {
+		if m.Spec.Storage.Size != nil {
+			size = *m.Spec.Storage.Size
+		}
+
+		storageClassName = m.Spec.Storage.StorageClassName
+	}
+
+	claim := corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   configVolumeName,
+			Labels: dep.Labels,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{
+				corev1.ReadWriteOnce,
+			},
+			StorageClassName: storageClassName,
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: size,
+				},
+			},
+		},
+	}
+
+	template := dep.Spec.Template
+	container := &template.Spec.Containers[0]
+
+	container.VolumeMounts = append(container.VolumeMounts,
+		corev1.VolumeMount{
+			Name:      configVolumeName,
+			MountPath: configVolumeMountPath,
+		})
+
+	return &appsv1.StatefulSet{
+		ObjectMeta: dep.ObjectMeta,
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:             &replicas,
+			Selector:             dep.Spec.Selector,
+			ServiceName:          m.Name,
+			Template:             template,
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{claim},
+		},
+	}
+}
+
+/*****************************************************************************/
+
 /*
  * The following function is used to set up the controller with the Manager.
  */
@@ -762,9 +1113,20 @@ func (r *IBMSecurityVerifyAccessReconciler) SetupWithManager(
 	 */
 
 	r.snapshotMgr = SnapshotMgr{
-		config: mgr.GetConfig(),
-		scheme: mgr.GetScheme(),
-		log:    r.Log.WithName("SnapshotMgr"),
+		config:   mgr.GetConfig(),
+		scheme:   mgr.GetScheme(),
+		options:  r.SnapshotMgrOptions,
+		log:      r.Log.WithName("SnapshotMgr"),
+		recorder: mgr.GetEventRecorderFor(operatorName),
+	}
+
+	/*
+	 * When leader election is enabled only the leader is allowed to modify
+	 * the snapshot store and to restart deployments.
+	 */
+
+	if len(r.SnapshotMgrOptions.LeaderElectionID) > 0 {
+		r.snapshotMgr.elected = mgr.Elected()
 	}
 
 	err := r.snapshotMgr.initialize()
@@ -775,6 +1137,32 @@ func (r *IBMSecurityVerifyAccessReconciler) SetupWithManager(
 
 	go r.snapshotMgr.start()
 
+	/*
+	 * Request the certificate from cert-manager, if cert-manager is being
+	 * used.  The certificate is only requested by the leader.
+	 */
+
+	if r.SnapshotMgrOptions.useCertManager() {
+		err = mgr.Add(manager.RunnableFunc(r.snapshotMgr.requestCertificates))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	/*
+	 * Mirror the Git repository, if one has been configured.  The
+	 * repository is only mirrored by the leader.
+	 */
+
+	if len(r.SnapshotMgrOptions.Git.URL) > 0 {
+		err = mgr.Add(manager.RunnableFunc(r.snapshotMgr.syncRepository))
+
+		if err != nil {
+			return err
+		}
+	}
+
 	/*
 	 * Register our controller.
 	 */
@@ -782,7 +1170,20 @@ func (r *IBMSecurityVerifyAccessReconciler) SetupWithManager(
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&ibmv1.IBMSecurityVerifyAccess{}).
 		Owns(&appsv1.Deployment{}).
+		Owns(&appsv1.StatefulSet{}).
+		Owns(&corev1.Service{}).
 		Complete(r)
 }
 
 /*****************************************************************************/
+
+/*
+ * The following function is used to return the snapshot manager, which is
+ * shared with the other controllers of the operator.
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) GetSnapshotMgr() *SnapshotMgr {
+	return &r.snapshotMgr
+}
+
+/*****************************************************************************/
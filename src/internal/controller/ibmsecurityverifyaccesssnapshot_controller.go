@@ -0,0 +1,586 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-logr/logr"
+
+	corev1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	ibmv1 "github.com/ibm-security/verify-access-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * The IBMSecurityVerifyAccessSnapshotReconciler structure reconciles an
+ * IBMSecurityVerifyAccessSnapshot object.  The content of the snapshot is
+ * retrieved from its source and saved in the snapshot store, exactly as if
+ * it had been uploaded to the snapshot manager, and the matching
+ * deployments are then restarted.
+ */
+
+type IBMSecurityVerifyAccessSnapshotReconciler struct {
+	client.Client
+
+	Log         logr.Logger
+	Scheme      *runtime.Scheme
+	SnapshotMgr *SnapshotMgr
+	apiReader   client.Reader
+}
+
+/*****************************************************************************/
+
+//+kubebuilder:rbac:groups=ibm.com,resources=ibmsecurityverifyaccesssnapshots,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=ibm.com,resources=ibmsecurityverifyaccesssnapshots/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=ibm.com,resources=ibmsecurityverifyaccesssnapshots/finalizers,verbs=update
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=create;delete
+
+/*****************************************************************************/
+
+/*
+ * The error which is returned when the file of a snapshot is already owned
+ * by a snapshot resource in another namespace.
+ */
+
+var errSnapshotNameOwned = errors.New("The snapshot is already owned by " +
+	"a snapshot resource in another namespace")
+
+/*****************************************************************************/
+
+/*
+ * Reconcile is part of the main kubernetes reconciliation loop which aims to
+ * move the current state of the cluster closer to the desired state.
+ */
+
+func (r *IBMSecurityVerifyAccessSnapshotReconciler) Reconcile(
+	ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+
+	r.Log.V(9).Info("Entering a function", "Function", "Reconcile")
+
+	/*
+	 * Fetch the definition document.
+	 */
+
+	snapshot := &ibmv1.IBMSecurityVerifyAccessSnapshot{}
+	err := r.Get(ctx, req.NamespacedName, snapshot)
+
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			/*
+			 * The snapshot has been deleted.  The file is left in the store,
+			 * as it may still be in use by running deployments.
+			 */
+
+			r.Log.Info("The VerifyAccess snapshot resource was not found. " +
+				"Ignoring this error since the object must have been deleted")
+
+			err = nil
+		} else {
+			r.Log.Error(err, "Failed to get the VerifyAccess snapshot resource")
+		}
+
+		return ctrl.Result{}, err
+	}
+
+	name := snapshotStoreName(snapshot)
+
+	/*
+	 * The tag of an OCI artifact is checked again after the poll interval.
+	 */
+
+	source := snapshot.Spec.Source
+	result := ctrl.Result{}
+
+	if source.OCI != nil && source.OCI.PollInterval != nil {
+		result.RequeueAfter = source.OCI.PollInterval.Duration
+	}
+
+	/*
+	 * There is nothing to do if the current generation of the resource has
+	 * already been stored, the stored file has not since been replaced and
+	 * the tag of an OCI artifact has not been moved.  Snapshots which are
+	 * held in config maps and secrets are always checked, as they can
+	 * change without a change to the resource.
+	 */
+
+	if snapshot.Status.Ready &&
+		snapshot.Status.ObservedGeneration == snapshot.Generation &&
+		snapshot.Status.Name == name &&
+		source.ConfigMap == nil && source.Secret == nil {
+
+		metadata, err := r.SnapshotMgr.statFile(ctx, name)
+
+		if err == nil && metadata.Digest == snapshot.Status.Digest {
+			if result.RequeueAfter <= 0 {
+				return result, nil
+			}
+
+			revision, err := r.sourceRevision(ctx, snapshot)
+
+			if err != nil {
+				r.Log.Error(err, "Failed to check the tag of the OCI artifact",
+					"Snapshot.Namespace", snapshot.Namespace,
+					"Snapshot.Name", snapshot.Name)
+
+				return result, nil
+			}
+
+			if revision == snapshot.Status.SourceRevision {
+				return result, nil
+			}
+
+			r.Log.Info("The tag of the OCI artifact has been moved",
+				"Snapshot.Namespace", snapshot.Namespace,
+				"Snapshot.Name", snapshot.Name,
+				"Reference", source.OCI.Reference,
+				"Digest", revision)
+		}
+	}
+
+	/*
+	 * The snapshot store is shared by every namespace, and so a file can
+	 * only be written by the snapshot resources of a single namespace.
+	 */
+
+	err = r.checkOwner(ctx, snapshot, name)
+
+	if err != nil {
+		r.Log.Error(err, "Failed to store the snapshot",
+			"Snapshot.Namespace", snapshot.Namespace,
+			"Snapshot.Name", snapshot.Name,
+			"File", name)
+
+		r.setStatus(ctx, snapshot, name, nil, "", err)
+
+		if errors.Is(err, errSnapshotNameOwned) {
+			return ctrl.Result{RequeueAfter: snapshotApprovalInterval}, nil
+		}
+
+		return ctrl.Result{}, err
+	}
+
+	/*
+	 * Retrieve the content of the snapshot, and save it in the store.
+	 */
+
+	metadata, revision, changed, err := r.storeSnapshot(ctx, snapshot, name)
+
+	if errors.Is(err, errSourcePending) {
+		r.Log.V(5).Info("Waiting for the snapshot source",
+			"Snapshot.Namespace", snapshot.Namespace,
+			"Snapshot.Name", snapshot.Name)
+
+		return ctrl.Result{RequeueAfter: snapshotSourceRetryInterval}, nil
+	}
+
+	if source.PersistentVolumeClaim != nil {
+		r.deleteReaderPod(ctx, snapshot)
+	}
+
+	if err != nil {
+		r.Log.Error(err, "Failed to store the snapshot",
+			"Snapshot.Namespace", snapshot.Namespace,
+			"Snapshot.Name", snapshot.Name)
+
+		r.setStatus(ctx, snapshot, name, nil, "", err)
+
+		return ctrl.Result{}, err
+	}
+
+	err = r.setStatus(ctx, snapshot, name, metadata, revision, nil)
+
+	/*
+	 * A snapshot which is waiting to be approved is checked again, so that
+	 * the status is updated once it has been approved.
+	 */
+
+	if metadata.Approval == approvalPending &&
+		(result.RequeueAfter <= 0 ||
+			result.RequeueAfter > snapshotApprovalInterval) {
+		result.RequeueAfter = snapshotApprovalInterval
+	}
+
+	/*
+	 * Request a restart of the deployments which use the snapshot, in the
+	 * same way as for an upload.  Only the deployments in the namespace of
+	 * the resource are restarted.
+	 */
+
+	if changed {
+		r.Log.Info("The snapshot has been stored",
+			"Snapshot.Namespace", snapshot.Namespace,
+			"Snapshot.Name", snapshot.Name,
+			"File", name,
+			"Revision", metadata.Revision)
+
+		r.SnapshotMgr.rollingRestart("/"+name, snapshot.Spec.Modified,
+			snapshot.Namespace, fmt.Sprintf("%s/%s/%s", snapshotKindName,
+				snapshot.Namespace, snapshot.Name))
+	}
+
+	return result, err
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the name of the file, within the store,
+ * which holds the snapshot, or the fixpack.
+ */
+
+func snapshotStoreName(snapshot *ibmv1.IBMSecurityVerifyAccessSnapshot) string {
+	if len(snapshot.Spec.Fixpack) > 0 {
+		return path.Join("fixpacks", path.Base(snapshot.Spec.Fixpack))
+	}
+
+	snapshotId := snapshot.Spec.SnapshotId
+
+	if len(snapshotId) == 0 {
+		snapshotId = "published"
+	}
+
+	return path.Join("snapshots",
+		fmt.Sprintf("ivia_%s_%s.snapshot", snapshot.Spec.Version, snapshotId))
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the namespace of the snapshot resource
+ * which is recorded as the client of a stored file, or an empty string if
+ * the file was not stored by a snapshot resource.
+ */
+
+func snapshotClientNamespace(client string) string {
+	if !strings.HasPrefix(client, snapshotKindName+"/") {
+		return ""
+	}
+
+	namespace, _, _ := strings.Cut(
+		strings.TrimPrefix(client, snapshotKindName+"/"), "/")
+
+	return namespace
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to check that the file of the snapshot is not owned
+ * by a snapshot resource in another namespace.  The file is owned by the
+ * oldest of the snapshot resources which refer to it, and errSnapshotNameOwned
+ * is returned if that resource is in another namespace.
+ */
+
+func (r *IBMSecurityVerifyAccessSnapshotReconciler) checkOwner(
+	ctx context.Context,
+	snapshot *ibmv1.IBMSecurityVerifyAccessSnapshot,
+	name string) (err error) {
+
+	snapshots := &ibmv1.IBMSecurityVerifyAccessSnapshotList{}
+
+	err = r.List(ctx, snapshots)
+
+	if err != nil {
+		return
+	}
+
+	for _, other := range snapshots.Items {
+		if other.Namespace == snapshot.Namespace ||
+			snapshotStoreName(&other) != name {
+			continue
+		}
+
+		if other.CreationTimestamp.Before(&snapshot.CreationTimestamp) ||
+			(other.CreationTimestamp.Equal(&snapshot.CreationTimestamp) &&
+				other.Namespace < snapshot.Namespace) {
+			return fmt.Errorf("%w: %s is owned by %s/%s", errSnapshotNameOwned,
+				name, other.Namespace, other.Name)
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to retrieve the content of the snapshot from its
+ * source and then save it in the store.  The content is staged and
+ * verified first, and is not saved again if the store already holds the
+ * same content, in which case changed is false.  Changed is also false for a
+ * gated snapshot which is waiting to be approved.  The revision of the source
+ * is also returned.
+ */
+
+func (r *IBMSecurityVerifyAccessSnapshotReconciler) storeSnapshot(
+	ctx context.Context,
+	snapshot *ibmv1.IBMSecurityVerifyAccessSnapshot,
+	name string) (
+	metadata *fileMetadata, revision string, changed bool, err error) {
+
+	r.Log.V(9).Info("Entering a function", "Function", "storeSnapshot")
+
+	ctx, cancel := context.WithTimeout(ctx, snapshotSourceTimeout)
+	defer cancel()
+
+	content, err := r.openSource(ctx, snapshot, name)
+
+	if err != nil {
+		return
+	}
+
+	hash := sha256.New()
+
+	staged, err := newStagedReader(name, io.TeeReader(content, hash))
+
+	content.Close()
+
+	if err != nil {
+		return
+	}
+
+	defer staged.Close()
+
+	digest := hex.EncodeToString(hash.Sum(nil))
+
+	if len(content.digest) > 0 && digest != content.digest {
+		err = fmt.Errorf("%w: the SHA-256 digest of the snapshot, %s, does "+
+			"not match the digest published by the source, %s",
+			errInvalidUpload, digest, content.digest)
+
+		return
+	}
+
+	revision = content.revision
+
+	expected := strings.TrimPrefix(
+		strings.ToLower(snapshot.Spec.Digest), "sha256:")
+
+	if len(expected) > 0 && digest != expected {
+		err = fmt.Errorf("%w: the SHA-256 digest of the snapshot, %s, does "+
+			"not match the expected digest, %s", errInvalidUpload, digest,
+			expected)
+
+		return
+	}
+
+	/*
+	 * Check the stored file, which does not need to be replaced if it
+	 * already has the same content.
+	 */
+
+	current, serr := r.SnapshotMgr.statFile(ctx, name)
+
+	if serr == nil && current.Digest == digest {
+		metadata = current
+
+		return
+	} else if serr != nil && !errors.Is(serr, os.ErrNotExist) {
+		err = serr
+
+		return
+	}
+
+	/*
+	 * A gated snapshot is only submitted for approval once.
+	 */
+
+	if held := r.SnapshotMgr.heldSnapshot(ctx, name, digest); held != nil {
+		metadata = held
+
+		return
+	}
+
+	/*
+	 * Save the file, or submit it for approval if the snapshot is gated.
+	 */
+
+	metadata = &fileMetadata{
+		Client: fmt.Sprintf("%s/%s/%s", snapshotKindName,
+			snapshot.Namespace, snapshot.Name),
+		Modified: snapshot.Spec.Modified,
+	}
+
+	err = r.SnapshotMgr.submitFile(ctx, name, staged, 0, digest, metadata)
+
+	if err != nil {
+		metadata = nil
+	} else {
+		changed = metadata.Approval != approvalPending
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to record the outcome of storing the snapshot in
+ * the status of the resource.
+ */
+
+func (r *IBMSecurityVerifyAccessSnapshotReconciler) setStatus(
+	ctx context.Context,
+	snapshot *ibmv1.IBMSecurityVerifyAccessSnapshot,
+	name string,
+	metadata *fileMetadata,
+	revision string,
+	err error) error {
+
+	condition := metav1.Condition{
+		Type:               "Ready",
+		ObservedGeneration: snapshot.Generation,
+	}
+
+	if err == nil {
+		snapshot.Status.Name = name
+		snapshot.Status.Digest = metadata.Digest
+		snapshot.Status.Size = metadata.Size
+		snapshot.Status.Revision = metadata.Revision
+		snapshot.Status.SourceRevision = revision
+		snapshot.Status.Ready = true
+		snapshot.Status.ObservedGeneration = snapshot.Generation
+
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "SnapshotStored"
+		condition.Message = "The snapshot has been stored."
+
+		/*
+		 * A gated snapshot is not ready until it has been approved.
+		 */
+
+		switch metadata.Approval {
+		case approvalPending:
+			snapshot.Status.Ready = false
+
+			condition.Status = metav1.ConditionFalse
+			condition.Reason = "ApprovalPending"
+			condition.Message = "The snapshot is waiting to be approved."
+
+		case approvalRejected:
+			snapshot.Status.Ready = false
+
+			condition.Status = metav1.ConditionFalse
+			condition.Reason = "SnapshotRejected"
+			condition.Message = fmt.Sprintf("The snapshot has been rejected "+
+				"by %s.", metadata.Reviewer)
+		}
+	} else {
+		snapshot.Status.Ready = false
+
+		condition.Status = metav1.ConditionFalse
+		condition.Message = err.Error()
+
+		if errors.Is(err, errInvalidUpload) {
+			condition.Reason = "VerificationFailed"
+		} else if errors.Is(err, errSnapshotNameOwned) {
+			condition.Reason = "SnapshotNameOwned"
+		} else {
+			condition.Reason = "SourceFailed"
+		}
+	}
+
+	apimeta.SetStatusCondition(&snapshot.Status.Conditions, condition)
+
+	if err := r.Status().Update(ctx, snapshot); err != nil {
+		r.Log.Error(err, "Failed to update the status for the resource",
+			"Snapshot.Namespace", snapshot.Namespace,
+			"Snapshot.Name", snapshot.Name)
+
+		return err
+	}
+
+	return nil
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to locate the snapshot resources which refer to a
+ * config map or secret which has changed.
+ */
+
+func (r *IBMSecurityVerifyAccessSnapshotReconciler) snapshotsForObject(
+	ctx context.Context, obj client.Object) (requests []reconcile.Request) {
+
+	snapshots := &ibmv1.IBMSecurityVerifyAccessSnapshotList{}
+
+	err := r.List(ctx, snapshots, client.InNamespace(obj.GetNamespace()))
+
+	if err != nil {
+		r.Log.Error(err, "Failed to list the VerifyAccess snapshot resources")
+
+		return
+	}
+
+	for _, snapshot := range snapshots.Items {
+		source := snapshot.Spec.Source
+
+		if (source.ConfigMap != nil && source.ConfigMap.Name == obj.GetName()) ||
+			(source.Secret != nil && source.Secret.Name == obj.GetName()) {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{
+					Name:      snapshot.Name,
+					Namespace: snapshot.Namespace,
+				},
+			})
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to set up the controller with the Manager.
+ * Config maps and secrets are only watched for their metadata, and their
+ * content is read directly from the API server, so that they are not all
+ * held in the cache of the manager.
+ */
+
+func (r *IBMSecurityVerifyAccessSnapshotReconciler) SetupWithManager(
+	mgr ctrl.Manager) error {
+
+	r.apiReader = mgr.GetAPIReader()
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&ibmv1.IBMSecurityVerifyAccessSnapshot{},
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&corev1.ConfigMap{},
+			handler.EnqueueRequestsFromMapFunc(r.snapshotsForObject),
+			builder.OnlyMetadata).
+		Watches(&corev1.Secret{},
+			handler.EnqueueRequestsFromMapFunc(r.snapshotsForObject),
+			builder.OnlyMetadata).
+		Complete(r)
+}
+
+/*****************************************************************************/
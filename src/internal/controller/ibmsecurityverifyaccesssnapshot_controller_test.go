@@ -0,0 +1,127 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	ibmv1 "github.com/ibm-security/verify-access-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * This function is used to create a scheme which holds the Kubernetes types
+ * and our own custom resources.
+ */
+
+func newTestScheme(t *testing.T) *runtime.Scheme {
+	scheme := runtime.NewScheme()
+
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ibmv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	return scheme
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify that the file of a snapshot can only be written by the snapshot
+ * resources of the namespace which first declared it.
+ */
+
+func TestSnapshotCheckOwner(t *testing.T) {
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	snapshot := func(namespace string, name string, snapshotId string,
+		age time.Duration) *ibmv1.IBMSecurityVerifyAccessSnapshot {
+		return &ibmv1.IBMSecurityVerifyAccessSnapshot{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:         namespace,
+				Name:              name,
+				CreationTimestamp: metav1.NewTime(created.Add(-age)),
+			},
+			Spec: ibmv1.IBMSecurityVerifyAccessSnapshotSpec{
+				SnapshotId: snapshotId,
+				Version:    "11.0.0.0",
+			},
+		}
+	}
+
+	first := snapshot("team-a", "published", "published", time.Hour)
+	second := snapshot("team-b", "published", "published", 0)
+	same := snapshot("team-a", "staged", "published", 0)
+	other := snapshot("team-b", "test", "test", 0)
+
+	r := &IBMSecurityVerifyAccessSnapshotReconciler{
+		Client: fake.NewClientBuilder().
+			WithScheme(newTestScheme(t)).
+			WithObjects(first, second, same, other).
+			Build(),
+		Log: logr.Discard(),
+	}
+
+	tests := []struct {
+		name     string
+		snapshot *ibmv1.IBMSecurityVerifyAccessSnapshot
+		owned    bool
+	}{
+		{"oldest resource", first, false},
+		{"other namespace", second, true},
+		{"same namespace", same, false},
+		{"other file", other, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := r.checkOwner(context.Background(), test.snapshot,
+				snapshotStoreName(test.snapshot))
+
+			if owned := errors.Is(err, errSnapshotNameOwned); owned != test.owned {
+				t.Errorf("checkOwner = %v, want owned %v", err, test.owned)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify that the namespace of a snapshot resource is found in the client
+ * which is recorded against a stored file.
+ */
+
+func TestSnapshotClientNamespace(t *testing.T) {
+	tests := map[string]string{
+		snapshotKindName + "/team-a/published": "team-a",
+		"IBMSecurityVerifyAccess/team-a/wrp":   "",
+		"release-manager":                      "",
+		"":                                     "",
+	}
+
+	for client, want := range tests {
+		if namespace := snapshotClientNamespace(client); namespace != want {
+			t.Errorf("snapshotClientNamespace(%q) = %q, want %q", client,
+				namespace, want)
+		}
+	}
+}
+
+/*****************************************************************************/
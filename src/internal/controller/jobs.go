@@ -0,0 +1,667 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	appsV1 "k8s.io/client-go/kubernetes/typed/apps/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ibmv1 "github.com/ibm-security/verify-access-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * Each rolling restart, whether it is triggered by an upload or explicitly
+ * requested, is tracked as a restart job.  The job records the outcome for
+ * each of the deployments which were considered, and then waits for each of
+ * the restarted deployments to complete its rollout, so that a client can
+ * poll the job until the rollout is complete.  The jobs are only held in
+ * the memory of the leader.
+ */
+
+/*****************************************************************************/
+
+/*
+ * The states of a restart job.
+ */
+
+const (
+	jobStateRunning   string = "Running"
+	jobStateSucceeded string = "Succeeded"
+	jobStateFailed    string = "Failed"
+)
+
+/*
+ * The jobDeployment structure records a deployment, along with the reason
+ * for which it was skipped or failed.
+ */
+
+type jobDeployment struct {
+	Deployment string `json:"deployment"`
+	Reason     string `json:"reason"`
+}
+
+/*
+ * The restartJob structure holds the progress of a restart job.  The
+ * exported fields are returned to the client, and access to the job is
+ * protected by the mutex.
+ */
+
+type restartJob struct {
+	Id         string          `json:"id"`
+	State      string          `json:"state"`
+	Path       string          `json:"path,omitempty"`
+	SnapshotId string          `json:"snapshotId,omitempty"`
+	Services   []string        `json:"services,omitempty"`
+	Namespace  string          `json:"namespace,omitempty"`
+	Name       string          `json:"name,omitempty"`
+	Client     string          `json:"client,omitempty"`
+	Created    time.Time       `json:"created"`
+	Completed  *time.Time      `json:"completed,omitempty"`
+	Matched    []string        `json:"matched"`
+	Skipped    []jobDeployment `json:"skipped"`
+	Patched    []string        `json:"patched"`
+	Ready      []string        `json:"ready"`
+	Failed     []jobDeployment `json:"failed"`
+	Error      string          `json:"error,omitempty"`
+
+	// The revision to which the snapshot was automatically rolled back, and
+	// the job which restarted the deployments after the rollback.
+	RollbackRevision int    `json:"rollbackRevision,omitempty"`
+	RollbackJob      string `json:"rollbackJob,omitempty"`
+
+	// The patched deployments which have not yet completed their rollout.
+	pending map[string]pendingRollout
+
+	// The patched deployments which failed to complete their rollout.
+	rolloutFailures []failedRollout
+
+	// Whether the job restarts the deployments after an automatic rollback.
+	rollback bool
+
+	mutex *sync.Mutex
+}
+
+/*
+ * The pendingRollout structure records the generation of a patched
+ * deployment, along with the name of the custom resource of the deployment.
+ */
+
+type pendingRollout struct {
+	generation int64
+	resource   string
+}
+
+/*
+ * The failedRollout structure records a deployment which failed to complete
+ * its rollout, along with the reason for the failure.
+ */
+
+type failedRollout struct {
+	deployment string
+	resource   string
+	reason     string
+}
+
+/*
+ * The jobResponse structure is returned by an upload, and contains the
+ * metadata of the saved file along with the identifier of the restart job.
+ */
+
+type jobResponse struct {
+	*fileMetadata
+	Job string `json:"job,omitempty"`
+}
+
+/*****************************************************************************/
+
+/*
+ * The following functions are used to record the progress of a job.  The
+ * name of each deployment is of the form '<namespace>/<name>'.
+ */
+
+func (job *restartJob) match(deployment string) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.Matched = append(job.Matched, deployment)
+}
+
+func (job *restartJob) skip(deployment string, reason string) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.Skipped = append(job.Skipped, jobDeployment{deployment, reason})
+}
+
+func (job *restartJob) patch(deployment string, generation int64,
+	resource string) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.Patched = append(job.Patched, deployment)
+	job.pending[deployment] = pendingRollout{generation, resource}
+}
+
+func (job *restartJob) ready(deployment string) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.Ready = append(job.Ready, deployment)
+	delete(job.pending, deployment)
+}
+
+func (job *restartJob) fail(deployment string, reason string) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.Failed = append(job.Failed, jobDeployment{deployment, reason})
+	delete(job.pending, deployment)
+}
+
+func (job *restartJob) failRollout(deployment string,
+	rollout pendingRollout, reason string) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.Failed = append(job.Failed, jobDeployment{deployment, reason})
+	job.rolloutFailures = append(job.rolloutFailures,
+		failedRollout{deployment, rollout.resource, reason})
+	delete(job.pending, deployment)
+}
+
+func (job *restartJob) rolledBack(revision int, rollbackJob string) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.RollbackRevision = revision
+	job.RollbackJob = rollbackJob
+}
+
+func (job *restartJob) failures() int {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	return len(job.Failed)
+}
+
+func (job *restartJob) complete(err error) string {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	now := time.Now()
+
+	job.Completed = &now
+	job.State = jobStateSucceeded
+
+	if err != nil {
+		job.Error = err.Error()
+	}
+
+	if err != nil || len(job.Failed) > 0 {
+		job.State = jobStateFailed
+	}
+
+	return job.State
+}
+
+/*
+ * This function is used to return the deployments which have not yet
+ * completed their rollout.
+ */
+
+func (job *restartJob) pendingDeployments() map[string]pendingRollout {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	pending := make(map[string]pendingRollout, len(job.pending))
+
+	for deployment, rollout := range job.pending {
+		pending[deployment] = rollout
+	}
+
+	return pending
+}
+
+/*
+ * This function is used to return the deployments which failed to complete
+ * their rollout.
+ */
+
+func (job *restartJob) failedRollouts() []failedRollout {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	return slices.Clone(job.rolloutFailures)
+}
+
+/*
+ * This function is used to return the JSON representation of the job.
+ */
+
+func (job *restartJob) marshal() ([]byte, error) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	return json.Marshal(job)
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to create and register a new job for the supplied
+ * request.  Completed jobs are discarded once they have been retained for
+ * long enough, or if there are too many jobs.
+ */
+
+func (mgr *SnapshotMgr) newJob(request restartRequest) (
+	job *restartJob, err error) {
+
+	id, err := mgr.generateRandomString(jobIdLength)
+
+	if err != nil {
+		return
+	}
+
+	job = &restartJob{
+		Id:         id,
+		State:      jobStateRunning,
+		Path:       request.path,
+		SnapshotId: request.snapshotId,
+		Services:   request.services,
+		Namespace:  request.namespace,
+		Name:       request.name,
+		Client:     request.client,
+		Created:    time.Now(),
+		Matched:    []string{},
+		Skipped:    []jobDeployment{},
+		Patched:    []string{},
+		Ready:      []string{},
+		Failed:     []jobDeployment{},
+		pending:    map[string]pendingRollout{},
+		rollback:   request.rollback,
+		mutex:      &sync.Mutex{},
+	}
+
+	mgr.jobsMutex.Lock()
+	defer mgr.jobsMutex.Unlock()
+
+	if mgr.jobs == nil {
+		mgr.jobs = map[string]*restartJob{}
+	}
+
+	/*
+	 * Discard the old jobs, oldest first.
+	 */
+
+	completed := make([]*restartJob, 0, len(mgr.jobs))
+
+	for _, existing := range mgr.jobs {
+		existing.mutex.Lock()
+
+		if existing.Completed != nil {
+			completed = append(completed, existing)
+		}
+
+		existing.mutex.Unlock()
+	}
+
+	sort.Slice(completed, func(i, j int) bool {
+		return completed[i].Created.Before(completed[j].Created)
+	})
+
+	for _, existing := range completed {
+		if len(mgr.jobs) < maxRestartJobs &&
+			time.Since(existing.Created) < restartJobRetention {
+			break
+		}
+
+		delete(mgr.jobs, existing.Id)
+	}
+
+	mgr.jobs[job.Id] = job
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to start a restart job for the supplied request.
+ * The job runs in the background and is returned immediately.  No job is
+ * started, and nil is returned, if this replica is not the leader.
+ */
+
+func (mgr *SnapshotMgr) startRestart(request restartRequest) *restartJob {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "startRestart")
+
+	/*
+	 * Only the leader is allowed to restart deployments.
+	 */
+
+	if !mgr.isLeader() {
+		mgr.log.Info("No deployments will be restarted as this replica is "+
+			"not the leader", "Path", request.path)
+
+		return nil
+	}
+
+	/*
+	 * Determine the digest of an uploaded snapshot, so that a deployment
+	 * which already uses an identical snapshot can be detected, and so that
+	 * only the snapshot which was published for this job is ever rolled
+	 * back.
+	 */
+
+	if strings.HasPrefix(request.path, "/snapshots/") {
+		metadata, serr := mgr.statFile(context.TODO(), storeName(request.path))
+
+		if serr == nil {
+			request.digest = metadata.Digest
+		}
+	}
+
+	job, err := mgr.newJob(request)
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to create the restart job")
+
+		return nil
+	}
+
+	mgr.log.Info("Started a restart job", "Job", job.Id,
+		"Path", request.path, "Client", request.client)
+
+	go func() {
+		err := mgr.restart(request, job)
+
+		if err == nil {
+			err = mgr.waitForRollout(job)
+		}
+
+		if failed := job.failedRollouts(); len(failed) > 0 {
+			mgr.autoRollback(request, job, failed)
+		}
+
+		state := job.complete(err)
+
+		mgr.log.Info("The restart job has completed", "Job", job.Id,
+			"State", state)
+	}()
+
+	return job
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to wait for each of the deployments which were
+ * patched by a job to complete its rollout.  A deployment which exceeds its
+ * progress deadline, or which does not complete its rollout within the
+ * restart timeout, is recorded as a failure.  The outcome is also recorded
+ * in the Restarted condition of the custom resource of the deployment, and
+ * the Degraded condition is removed once a deployment has completed the
+ * rollout of a restart which was not the result of an automatic rollback.
+ */
+
+func (mgr *SnapshotMgr) waitForRollout(job *restartJob) (err error) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "waitForRollout")
+
+	appsV1Client, err := appsV1.NewForConfig(mgr.config)
+
+	if err != nil {
+		return
+	}
+
+	rtClient, err := client.New(mgr.config,
+		client.Options{
+			Scheme: mgr.scheme,
+		})
+
+	if err != nil {
+		return
+	}
+
+	deadline := time.Now().Add(mgr.options.RestartTimeout)
+
+	for {
+		pending := job.pendingDeployments()
+
+		if len(pending) == 0 {
+			return
+		}
+
+		for deployment, rollout := range pending {
+			namespace, name, _ := strings.Cut(deployment, "/")
+
+			current, gerr := appsV1Client.Deployments(namespace).Get(
+				context.TODO(), name, metaV1.GetOptions{})
+
+			if k8serrors.IsNotFound(gerr) {
+				job.fail(deployment, "The deployment no longer exists")
+			} else if gerr != nil {
+				mgr.log.V(5).Error(gerr, "Failed to retrieve the deployment",
+					"Deployment.Namespace", namespace,
+					"Deployment.Name", name)
+			} else if done, failure := rolloutStatus(
+				current, rollout.generation); len(failure) > 0 {
+				job.failRollout(deployment, rollout, failure)
+
+				mgr.setRestartCondition(rtClient, namespace, rollout.resource,
+					metaV1.ConditionFalse, "RolloutFailed", failure, false)
+			} else if done {
+				mgr.log.Info("The rollout of the deployment has completed",
+					"Deployment.Namespace", namespace,
+					"Deployment.Name", name)
+
+				job.ready(deployment)
+
+				mgr.setRestartCondition(rtClient, namespace, rollout.resource,
+					metaV1.ConditionTrue, "RolloutComplete",
+					fmt.Sprintf("The deployment, %s, has completed its "+
+						"rollout.", name), !job.rollback)
+			}
+		}
+
+		if time.Now().After(deadline) {
+			for deployment, rollout := range job.pendingDeployments() {
+				failure := fmt.Sprintf("The rollout of the deployment did "+
+					"not complete within %s", mgr.options.RestartTimeout)
+
+				job.failRollout(deployment, rollout, failure)
+
+				namespace, _, _ := strings.Cut(deployment, "/")
+
+				mgr.setRestartCondition(rtClient, namespace, rollout.resource,
+					metaV1.ConditionFalse, "RolloutTimeout", failure, false)
+			}
+
+			return
+		}
+
+		time.Sleep(restartPollInterval)
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to set the Restarted condition of the specified
+ * custom resource, and optionally to remove the Degraded condition.
+ */
+
+func (mgr *SnapshotMgr) setRestartCondition(
+	rtClient client.Client,
+	namespace string,
+	name string,
+	status metaV1.ConditionStatus,
+	reason string,
+	message string,
+	recovered bool) {
+
+	mgr.updateConditions(rtClient, namespace, name,
+		func(conditions *[]metaV1.Condition) {
+			apimeta.SetStatusCondition(conditions, metaV1.Condition{
+				Type:    restartedConditionType,
+				Status:  status,
+				Reason:  reason,
+				Message: message,
+			})
+
+			if recovered {
+				apimeta.RemoveStatusCondition(conditions,
+					degradedConditionType)
+			}
+		})
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to update the conditions of the specified custom
+ * resource, which is returned.  A failure to update the conditions is
+ * logged, and nil is returned.
+ */
+
+func (mgr *SnapshotMgr) updateConditions(
+	rtClient client.Client,
+	namespace string,
+	name string,
+	update func(conditions *[]metaV1.Condition)) (
+	verifyaccess *ibmv1.IBMSecurityVerifyAccess) {
+
+	if len(name) == 0 {
+		return
+	}
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		verifyaccess = &ibmv1.IBMSecurityVerifyAccess{}
+
+		err := rtClient.Get(context.TODO(),
+			client.ObjectKey{Namespace: namespace, Name: name}, verifyaccess)
+
+		if err != nil {
+			return err
+		}
+
+		update(&verifyaccess.Status.Conditions)
+
+		return rtClient.Status().Update(context.TODO(), verifyaccess)
+	})
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to update the condition for the resource",
+			"CustomResource.Namespace", namespace,
+			"CustomResource.Name", name)
+
+		return nil
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to determine whether a deployment has completed the
+ * rollout of the specified generation, in the same way as 'kubectl rollout
+ * status'.  A reason is returned if the rollout has failed.
+ */
+
+func rolloutStatus(deployment *appsv1.Deployment, generation int64) (
+	done bool, failure string) {
+
+	if deployment.Status.ObservedGeneration < generation {
+		return
+	}
+
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing &&
+			condition.Reason == "ProgressDeadlineExceeded" {
+			failure = fmt.Sprintf("The rollout of the deployment exceeded "+
+				"its progress deadline: %s", condition.Message)
+
+			return
+		}
+	}
+
+	replicas := int32(1)
+
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+
+	done = deployment.Status.UpdatedReplicas >= replicas &&
+		deployment.Status.Replicas <= deployment.Status.UpdatedReplicas &&
+		deployment.Status.AvailableReplicas >= deployment.Status.UpdatedReplicas
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to process a GET of '/jobs/<id>', which returns the
+ * progress of the job.
+ */
+
+func (mgr *SnapshotMgr) serveJob(w http.ResponseWriter, r *http.Request,
+	id string) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "serveJob")
+
+	if r.Method != "GET" {
+		http.Error(w,
+			http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	mgr.jobsMutex.Lock()
+	job := mgr.jobs[id]
+	mgr.jobsMutex.Unlock()
+
+	if job == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+
+		return
+	}
+
+	jsonStr, err := job.marshal()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonStr)
+}
+
+/*****************************************************************************/
@@ -0,0 +1,1058 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	apiV1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	coreV1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * The kubeStore structure is a snapshot store which keeps the files in
+ * Kubernetes objects within the namespace of the operator.  Snapshots are
+ * held in secrets, as they contain sensitive data, and fixpacks are held in
+ * config maps.
+ *
+ * Each file is described by a manifest object, which holds the metadata of
+ * the file along with the ordered list of the chunks which make up the file.
+ * The content of the file is split into chunks, each of which is held in a
+ * separate object so that no object exceeds the size limit of Kubernetes.
+ * Each chunk is owned by the manifests which reference it, and so the chunks
+ * are garbage collected by Kubernetes when the manifests are deleted.  A
+ * chunk can be shared by multiple manifests, which allows a file to be
+ * copied (e.g. to the history of the file) without copying its content.
+ *
+ * As the names of the files are not valid resource names, the name of each
+ * manifest is derived from a hash of the name of the file.
+ */
+
+type kubeStore struct {
+	secrets    kubeObjectClient
+	configMaps kubeObjectClient
+	compress   bool
+	log        logr.Logger
+}
+
+/*****************************************************************************/
+
+/*
+ * The kubeManifest structure describes the chunks which make up a file.
+ */
+
+type kubeManifest struct {
+	// The compression which has been applied to the content, if any.
+	Compression string `json:"compression,omitempty"`
+
+	// The hex encoded SHA-256 digest of the uncompressed content.
+	Digest string `json:"sha256"`
+
+	// The chunks which make up the content, in order.
+	Chunks []kubeChunk `json:"chunks"`
+}
+
+type kubeChunk struct {
+	// The name of the object which holds the chunk.
+	Name string `json:"name"`
+
+	// The size of the chunk, in bytes.
+	Size int `json:"size"`
+
+	// The hex encoded SHA-256 digest of the chunk.
+	Digest string `json:"sha256"`
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to create a new Kubernetes snapshot store.
+ */
+
+func newKubeStore(config *rest.Config, namespace string, compress bool,
+	log logr.Logger) (store *kubeStore, err error) {
+
+	clientset, err := kubernetes.NewForConfig(config)
+
+	if err != nil {
+		return
+	}
+
+	store = &kubeStore{
+		secrets: &kubeSecrets{
+			client:    clientset.CoreV1().Secrets(namespace),
+			namespace: namespace,
+		},
+		configMaps: &kubeConfigMaps{
+			client:    clientset.CoreV1().ConfigMaps(namespace),
+			namespace: namespace,
+		},
+		compress: compress,
+		log:      log,
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following functions are used to derive the name of the manifest which
+ * describes a file, and the label which identifies the directory of a file.
+ */
+
+func storeHash(value string) string {
+	digest := sha256.Sum256([]byte(value))
+
+	return hex.EncodeToString(digest[:])[:16]
+}
+
+func kubeManifestName(name string) string {
+	return fmt.Sprintf("%s-file-%s", operatorName, storeHash(name))
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the client for the type of object which
+ * holds the specified file, or the files in the specified directory.
+ * Fixpacks, and their history, are held in config maps.
+ */
+
+func (s *kubeStore) objects(name string) kubeObjectClient {
+	name = strings.TrimPrefix(name, historyDirName+"/")
+
+	if name == "fixpacks" || strings.HasPrefix(name, "fixpacks/") {
+		return s.configMaps
+	}
+
+	return s.secrets
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to retrieve the manifest of a file, along with the
+ * object which holds the manifest.  An error which wraps os.ErrNotExist is
+ * returned if the file does not exist, or has not been completely stored.
+ */
+
+func (s *kubeStore) getManifest(ctx context.Context, name string) (
+	object *kubeObject, manifest *kubeManifest, err error) {
+
+	object, err = s.objects(name).get(ctx, kubeManifestName(name))
+
+	if k8serrors.IsNotFound(err) {
+		err = fmt.Errorf("%w: %w", os.ErrNotExist, err)
+	}
+
+	if err != nil {
+		return
+	}
+
+	manifest, err = parseKubeManifest(object)
+
+	return
+}
+
+func parseKubeManifest(object *kubeObject) (
+	manifest *kubeManifest, err error) {
+
+	data, ok := object.data[storeManifestKey]
+
+	if !ok {
+		err = fmt.Errorf("%w: the file has not been completely stored",
+			os.ErrNotExist)
+
+		return
+	}
+
+	manifest = &kubeManifest{}
+
+	err = json.Unmarshal(data, manifest)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to retrieve the metadata of a file from the
+ * annotations of the manifest of the file.
+ */
+
+func kubeMetadata(object *kubeObject) *fileMetadata {
+	metadata := &fileMetadata{}
+
+	json.Unmarshal([]byte(object.Annotations[storeMetadataAnnotation]),
+		metadata)
+
+	metadata.Name = path.Base(object.Annotations[storeNameAnnotation])
+
+	return metadata
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to retrieve the object which will hold the manifest
+ * of a file, creating an empty manifest object if the file does not exist.
+ * The manifest object must exist before the chunks are created, as the
+ * chunks are owned by the manifest object.
+ */
+
+func (s *kubeStore) manifestObject(ctx context.Context, name string) (
+	object *kubeObject, err error) {
+
+	objects := s.objects(name)
+
+	object, err = objects.get(ctx, kubeManifestName(name))
+
+	if !k8serrors.IsNotFound(err) {
+		return
+	}
+
+	object = &kubeObject{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name: kubeManifestName(name),
+			Labels: map[string]string{
+				storeDirLabel: storeHash(path.Dir(name)),
+			},
+			Annotations: map[string]string{
+				storeNameAnnotation: name,
+			},
+		},
+	}
+
+	object, err = objects.create(ctx, object)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to save the manifest of a file, and then release
+ * the chunks of the previous version of the file.  The manifest is replaced
+ * with a single update, and so the file is always replaced atomically.
+ */
+
+func (s *kubeStore) saveManifest(
+	ctx context.Context,
+	name string,
+	object *kubeObject,
+	manifest *kubeManifest,
+	metadata *fileMetadata) (err error) {
+
+	objects := s.objects(name)
+
+	/*
+	 * Work out the chunks of the previous version of the file which are no
+	 * longer referenced.
+	 */
+
+	var released []kubeChunk
+
+	if previous, perr := parseKubeManifest(object); perr == nil {
+		current := make(map[string]bool, len(manifest.Chunks))
+
+		for _, chunk := range manifest.Chunks {
+			current[chunk.Name] = true
+		}
+
+		for _, chunk := range previous.Chunks {
+			if !current[chunk.Name] {
+				released = append(released, chunk)
+			}
+		}
+	}
+
+	/*
+	 * Update the manifest.
+	 */
+
+	manifestData, err := json.Marshal(manifest)
+
+	if err != nil {
+		return
+	}
+
+	metadataData, err := json.Marshal(metadata)
+
+	if err != nil {
+		return
+	}
+
+	if object.Labels == nil {
+		object.Labels = make(map[string]string)
+	}
+
+	if object.Annotations == nil {
+		object.Annotations = make(map[string]string)
+	}
+
+	object.Labels[storeDirLabel] = storeHash(path.Dir(name))
+	object.Annotations[storeNameAnnotation] = name
+	object.Annotations[storeMetadataAnnotation] = string(metadataData)
+	object.data = map[string][]byte{storeManifestKey: manifestData}
+
+	_, err = objects.update(ctx, object)
+
+	if err != nil {
+		return
+	}
+
+	s.releaseChunks(ctx, objects, object.UID, released)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to generate a random identifier which is used in
+ * the names of the chunks of a new version of a file.
+ */
+
+func kubeChunkPrefix(manifestName string) (string, error) {
+	id := make([]byte, 4)
+
+	_, err := rand.Read(id)
+
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s-%s", manifestName, hex.EncodeToString(id)), nil
+}
+
+/*****************************************************************************/
+
+/*
+ * The kubeChunkWriter structure is used to split the content of a file into
+ * chunks as it is written.  Each chunk is owned by the manifest object of
+ * the file.
+ */
+
+type kubeChunkWriter struct {
+	ctx     context.Context
+	objects kubeObjectClient
+	owner   *kubeObject
+	prefix  string
+	buffer  []byte
+	chunks  []kubeChunk
+}
+
+func (w *kubeChunkWriter) Write(data []byte) (written int, err error) {
+	for len(data) > 0 {
+		n := copy(w.buffer[len(w.buffer):cap(w.buffer)], data)
+
+		w.buffer = w.buffer[:len(w.buffer)+n]
+		data = data[n:]
+		written += n
+
+		if len(w.buffer) == cap(w.buffer) {
+			err = w.flush()
+
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+func (w *kubeChunkWriter) flush() (err error) {
+	if len(w.buffer) == 0 {
+		return
+	}
+
+	digest := sha256.Sum256(w.buffer)
+
+	chunk := kubeChunk{
+		Name:   fmt.Sprintf("%s-%d", w.prefix, len(w.chunks)),
+		Size:   len(w.buffer),
+		Digest: hex.EncodeToString(digest[:]),
+	}
+
+	object := &kubeObject{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name: chunk.Name,
+			Labels: map[string]string{
+				storeChunkLabel: "true",
+			},
+			OwnerReferences: []metaV1.OwnerReference{
+				w.objects.ownerReference(w.owner),
+			},
+		},
+		data: map[string][]byte{
+			storeDataKey: w.buffer,
+		},
+	}
+
+	_, err = w.objects.create(w.ctx, object)
+
+	if err != nil {
+		return
+	}
+
+	w.chunks = append(w.chunks, chunk)
+	w.buffer = make([]byte, 0, cap(w.buffer))
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to release the specified chunks, which are no
+ * longer referenced by the manifest with the specified owner identifier.
+ * A chunk which is not referenced by any other manifest is deleted.  Any
+ * failure is logged, as a chunk which is not deleted will be removed when
+ * the store is next initialized.
+ */
+
+func (s *kubeStore) releaseChunks(ctx context.Context,
+	objects kubeObjectClient, owner types.UID, chunks []kubeChunk) {
+
+	for _, chunk := range chunks {
+		object, err := objects.get(ctx, chunk.Name)
+
+		if err != nil {
+			continue
+		}
+
+		refs := []metaV1.OwnerReference{}
+
+		for _, ref := range object.OwnerReferences {
+			if ref.UID != owner {
+				refs = append(refs, ref)
+			}
+		}
+
+		if len(refs) == 0 {
+			err = objects.delete(ctx, chunk.Name)
+		} else if len(refs) != len(object.OwnerReferences) {
+			object.OwnerReferences = refs
+
+			_, err = objects.update(ctx, object)
+		}
+
+		if err != nil && !k8serrors.IsNotFound(err) {
+			s.log.Error(err, "Failed to release a chunk", "Chunk", chunk.Name)
+		}
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Any chunks which are not referenced by a manifest, for example as the
+ * result of an upload which was interrupted, are removed.  Recently created
+ * chunks are left alone, as they may be part of an upload which is being
+ * processed by another replica.
+ */
+
+func (s *kubeStore) Initialize(ctx context.Context) (err error) {
+	for _, objects := range []kubeObjectClient{s.secrets, s.configMaps} {
+		var manifests, chunks []*kubeObject
+
+		manifests, err = objects.list(ctx, storeDirLabel)
+
+		if err != nil {
+			return
+		}
+
+		chunks, err = objects.list(ctx, storeChunkLabel)
+
+		if err != nil {
+			return
+		}
+
+		referenced := make(map[string]bool)
+
+		for _, object := range manifests {
+			manifest, merr := parseKubeManifest(object)
+
+			if merr != nil {
+				continue
+			}
+
+			for _, chunk := range manifest.Chunks {
+				referenced[chunk.Name] = true
+			}
+		}
+
+		for _, chunk := range chunks {
+			if referenced[chunk.Name] || time.Since(
+				chunk.CreationTimestamp.Time) < storeChunkGracePeriod {
+				continue
+			}
+
+			s.log.V(5).Info("Removing an unreferenced chunk",
+				"Chunk", chunk.Name)
+
+			objects.delete(ctx, chunk.Name)
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+func (s *kubeStore) Stat(
+	ctx context.Context, name string) (metadata *fileMetadata, err error) {
+
+	object, _, err := s.getManifest(ctx, name)
+
+	if err != nil {
+		return
+	}
+
+	metadata = kubeMetadata(object)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The chunks are assembled, and verified, in a temporary file, so that the
+ * returned reader supports seeking and the chunks do not all need to be
+ * held in memory.
+ */
+
+func (s *kubeStore) Get(ctx context.Context, name string) (
+	reader io.ReadCloser, metadata *fileMetadata, err error) {
+
+	object, manifest, err := s.getManifest(ctx, name)
+
+	if err != nil {
+		return
+	}
+
+	metadata = kubeMetadata(object)
+
+	var src io.Reader = &kubeChunkReader{
+		ctx:     ctx,
+		objects: s.objects(name),
+		chunks:  manifest.Chunks,
+	}
+
+	if manifest.Compression == storeCompressionGzip {
+		var gz *gzip.Reader
+
+		gz, err = gzip.NewReader(src)
+
+		if err != nil {
+			return
+		}
+
+		defer gz.Close()
+
+		src = gz
+	}
+
+	hash := sha256.New()
+
+	staged, err := newStagedReader(name, io.TeeReader(src, hash))
+
+	if err != nil {
+		return
+	}
+
+	if digest := hex.EncodeToString(hash.Sum(nil)); digest != manifest.Digest {
+		staged.Close()
+
+		err = fmt.Errorf("The SHA-256 digest of the file, %s, does not match "+
+			"the digest in the manifest, %s", digest, manifest.Digest)
+
+		return
+	}
+
+	reader = staged
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The kubeChunkReader structure is used to read the content of a file from
+ * its chunks, retrieving each chunk as it is required.  The digest of each
+ * chunk is verified as it is retrieved.
+ */
+
+type kubeChunkReader struct {
+	ctx     context.Context
+	objects kubeObjectClient
+	chunks  []kubeChunk
+	buffer  []byte
+}
+
+func (r *kubeChunkReader) Read(data []byte) (n int, err error) {
+	for len(r.buffer) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+
+		chunk := r.chunks[0]
+		r.chunks = r.chunks[1:]
+
+		object, gerr := r.objects.get(r.ctx, chunk.Name)
+
+		if gerr != nil {
+			return 0, fmt.Errorf("Failed to retrieve the chunk, %s: %w",
+				chunk.Name, gerr)
+		}
+
+		r.buffer = object.data[storeDataKey]
+
+		digest := sha256.Sum256(r.buffer)
+
+		if hex.EncodeToString(digest[:]) != chunk.Digest {
+			return 0, fmt.Errorf("The chunk, %s, is corrupt", chunk.Name)
+		}
+	}
+
+	n = copy(data, r.buffer)
+	r.buffer = r.buffer[n:]
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The content of the file is written to a new set of chunks, and the
+ * manifest is then updated to reference the new chunks.  The previous
+ * version of the file remains intact until the manifest is updated.
+ */
+
+func (s *kubeStore) Put(ctx context.Context, name string, stagedFile string,
+	metadata *fileMetadata) (err error) {
+
+	file, err := os.Open(stagedFile)
+
+	if err != nil {
+		return
+	}
+
+	defer file.Close()
+
+	object, err := s.manifestObject(ctx, name)
+
+	if err != nil {
+		return
+	}
+
+	prefix, err := kubeChunkPrefix(object.Name)
+
+	if err != nil {
+		return
+	}
+
+	writer := &kubeChunkWriter{
+		ctx:     ctx,
+		objects: s.objects(name),
+		owner:   object,
+		prefix:  prefix,
+		buffer:  make([]byte, 0, storeChunkSize),
+	}
+
+	manifest := &kubeManifest{
+		Digest: metadata.Digest,
+	}
+
+	/*
+	 * Write the content to the chunks, compressing the content if required.
+	 */
+
+	if s.compress {
+		manifest.Compression = storeCompressionGzip
+
+		gz := gzip.NewWriter(writer)
+
+		_, err = io.Copy(gz, file)
+
+		if err == nil {
+			err = gz.Close()
+		}
+	} else {
+		_, err = io.Copy(writer, file)
+	}
+
+	if err == nil {
+		err = writer.flush()
+	}
+
+	manifest.Chunks = writer.chunks
+
+	if err == nil {
+		metadata.LastModified = time.Now().UTC()
+
+		err = s.saveManifest(ctx, name, object, manifest, metadata)
+	}
+
+	/*
+	 * Remove the new chunks if the file could not be saved.
+	 */
+
+	if err != nil {
+		s.releaseChunks(ctx, s.objects(name), object.UID, writer.chunks)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The destination manifest is added as an owner of each of the chunks of
+ * the source file, and so the content of the file is not copied.
+ */
+
+func (s *kubeStore) Copy(
+	ctx context.Context, srcName string, dstName string) (err error) {
+
+	srcObject, manifest, err := s.getManifest(ctx, srcName)
+
+	if err != nil {
+		return
+	}
+
+	dstObject, err := s.manifestObject(ctx, dstName)
+
+	if err != nil {
+		return
+	}
+
+	objects := s.objects(srcName)
+	ref := objects.ownerReference(dstObject)
+
+	for _, chunk := range manifest.Chunks {
+		var object *kubeObject
+
+		object, err = objects.get(ctx, chunk.Name)
+
+		if err != nil {
+			return
+		}
+
+		object.OwnerReferences = append(object.OwnerReferences, ref)
+
+		_, err = objects.update(ctx, object)
+
+		if err != nil {
+			return
+		}
+	}
+
+	err = s.saveManifest(ctx, dstName, dstObject, manifest,
+		kubeMetadata(srcObject))
+
+	return
+}
+
+/*****************************************************************************/
+
+func (s *kubeStore) List(
+	ctx context.Context, dir string) (files []*fileMetadata, err error) {
+
+	objects, err := s.objects(dir).list(ctx,
+		fmt.Sprintf("%s=%s", storeDirLabel, storeHash(dir)))
+
+	if err != nil {
+		return
+	}
+
+	files = make([]*fileMetadata, 0, len(objects))
+
+	for _, object := range objects {
+		name := object.Annotations[storeNameAnnotation]
+
+		if path.Dir(name) != dir || strings.HasPrefix(path.Base(name), ".") {
+			continue
+		}
+
+		if _, merr := parseKubeManifest(object); merr != nil {
+			continue
+		}
+
+		files = append(files, kubeMetadata(object))
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The chunks of the file will be garbage collected by Kubernetes once the
+ * manifest has been deleted.
+ */
+
+func (s *kubeStore) Delete(ctx context.Context, name string) (err error) {
+	err = s.objects(name).delete(ctx, kubeManifestName(name))
+
+	if k8serrors.IsNotFound(err) {
+		err = fmt.Errorf("%w: %w", os.ErrNotExist, err)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The kubeObject structure is a generic representation of the secrets and
+ * config maps which are used by the Kubernetes snapshot store, and the
+ * kubeObjectClient interface is used to manage these objects.
+ */
+
+type kubeObject struct {
+	metaV1.ObjectMeta
+
+	data map[string][]byte
+}
+
+type kubeObjectClient interface {
+	get(ctx context.Context, name string) (*kubeObject, error)
+	create(ctx context.Context, object *kubeObject) (*kubeObject, error)
+	update(ctx context.Context, object *kubeObject) (*kubeObject, error)
+	delete(ctx context.Context, name string) error
+	list(ctx context.Context, selector string) ([]*kubeObject, error)
+	ownerReference(owner *kubeObject) metaV1.OwnerReference
+}
+
+/*****************************************************************************/
+
+/*
+ * The kubeSecrets structure is used to hold the objects in secrets.
+ */
+
+type kubeSecrets struct {
+	client    coreV1.SecretInterface
+	namespace string
+}
+
+func (c *kubeSecrets) toObject(secret *apiV1.Secret) *kubeObject {
+	return &kubeObject{ObjectMeta: secret.ObjectMeta, data: secret.Data}
+}
+
+func (c *kubeSecrets) fromObject(object *kubeObject) *apiV1.Secret {
+	meta := object.ObjectMeta
+	meta.Namespace = c.namespace
+
+	return &apiV1.Secret{
+		Type:       apiV1.SecretTypeOpaque,
+		ObjectMeta: meta,
+		Data:       object.data,
+	}
+}
+
+func (c *kubeSecrets) get(
+	ctx context.Context, name string) (*kubeObject, error) {
+
+	secret, err := c.client.Get(ctx, name, metaV1.GetOptions{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toObject(secret), nil
+}
+
+func (c *kubeSecrets) create(
+	ctx context.Context, object *kubeObject) (*kubeObject, error) {
+
+	secret, err := c.client.Create(ctx, c.fromObject(object),
+		metaV1.CreateOptions{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toObject(secret), nil
+}
+
+func (c *kubeSecrets) update(
+	ctx context.Context, object *kubeObject) (*kubeObject, error) {
+
+	secret, err := c.client.Update(ctx, c.fromObject(object),
+		metaV1.UpdateOptions{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toObject(secret), nil
+}
+
+func (c *kubeSecrets) delete(ctx context.Context, name string) error {
+	policy := metaV1.DeletePropagationBackground
+
+	return c.client.Delete(ctx, name,
+		metaV1.DeleteOptions{PropagationPolicy: &policy})
+}
+
+func (c *kubeSecrets) list(
+	ctx context.Context, selector string) ([]*kubeObject, error) {
+
+	secrets, err := c.client.List(ctx,
+		metaV1.ListOptions{LabelSelector: selector})
+
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]*kubeObject, 0, len(secrets.Items))
+
+	for i := range secrets.Items {
+		objects = append(objects, c.toObject(&secrets.Items[i]))
+	}
+
+	return objects, nil
+}
+
+func (c *kubeSecrets) ownerReference(owner *kubeObject) metaV1.OwnerReference {
+	return metaV1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Name:       owner.Name,
+		UID:        owner.UID,
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * The kubeConfigMaps structure is used to hold the objects in config maps.
+ * The content is held as binary data.
+ */
+
+type kubeConfigMaps struct {
+	client    coreV1.ConfigMapInterface
+	namespace string
+}
+
+func (c *kubeConfigMaps) toObject(configMap *apiV1.ConfigMap) *kubeObject {
+	return &kubeObject{
+		ObjectMeta: configMap.ObjectMeta,
+		data:       configMap.BinaryData,
+	}
+}
+
+func (c *kubeConfigMaps) fromObject(object *kubeObject) *apiV1.ConfigMap {
+	meta := object.ObjectMeta
+	meta.Namespace = c.namespace
+
+	return &apiV1.ConfigMap{
+		ObjectMeta: meta,
+		BinaryData: object.data,
+	}
+}
+
+func (c *kubeConfigMaps) get(
+	ctx context.Context, name string) (*kubeObject, error) {
+
+	configMap, err := c.client.Get(ctx, name, metaV1.GetOptions{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toObject(configMap), nil
+}
+
+func (c *kubeConfigMaps) create(
+	ctx context.Context, object *kubeObject) (*kubeObject, error) {
+
+	configMap, err := c.client.Create(ctx, c.fromObject(object),
+		metaV1.CreateOptions{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toObject(configMap), nil
+}
+
+func (c *kubeConfigMaps) update(
+	ctx context.Context, object *kubeObject) (*kubeObject, error) {
+
+	configMap, err := c.client.Update(ctx, c.fromObject(object),
+		metaV1.UpdateOptions{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toObject(configMap), nil
+}
+
+func (c *kubeConfigMaps) delete(ctx context.Context, name string) error {
+	policy := metaV1.DeletePropagationBackground
+
+	return c.client.Delete(ctx, name,
+		metaV1.DeleteOptions{PropagationPolicy: &policy})
+}
+
+func (c *kubeConfigMaps) list(
+	ctx context.Context, selector string) ([]*kubeObject, error) {
+
+	configMaps, err := c.client.List(ctx,
+		metaV1.ListOptions{LabelSelector: selector})
+
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]*kubeObject, 0, len(configMaps.Items))
+
+	for i := range configMaps.Items {
+		objects = append(objects, c.toObject(&configMaps.Items[i]))
+	}
+
+	return objects, nil
+}
+
+func (c *kubeConfigMaps) ownerReference(
+	owner *kubeObject) metaV1.OwnerReference {
+
+	return metaV1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Name:       owner.Name,
+		UID:        owner.UID,
+	}
+}
+
+/*****************************************************************************/
@@ -0,0 +1,266 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * When the operator is run with multiple replicas each replica runs the
+ * snapshot manager, and the snapshot service routes each request to any of
+ * the replicas.  Only the leader (as determined by the leader election of
+ * the controller manager) is allowed to modify the store and to restart
+ * deployments.  Requests which modify the store are forwarded by the other
+ * replicas to the leader, which serializes all of the updates.  Requests
+ * which read the store are served by any replica, unless the store is held
+ * on the local file system of the leader.
+ */
+
+/*****************************************************************************/
+
+/*
+ * This function is used to determine whether this replica is currently the
+ * leader.  A replica is always the leader if leader election is disabled.
+ */
+
+func (mgr *SnapshotMgr) isLeader() bool {
+	if mgr.elected == nil {
+		return true
+	}
+
+	select {
+	case <-mgr.elected:
+		return true
+	default:
+		return false
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to determine whether the specified request needs
+ * to be forwarded to the leader.  Restart jobs are only held by the leader,
+ * and so requests for a job are always forwarded.
+ */
+
+func (mgr *SnapshotMgr) needsForwarding(r *http.Request) bool {
+	if mgr.isLeader() {
+		return false
+	}
+
+	if r.Method != "GET" || strings.HasPrefix(r.URL.Path, "/jobs/") {
+		return true
+	}
+
+	return mgr.options.StoreType == "" ||
+		mgr.options.StoreType == StoreTypeLocal
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to forward a request to the leader.  A request
+ * which has already been forwarded is never forwarded again, so that a
+ * stale view of the leader cannot cause a loop.
+ */
+
+func (mgr *SnapshotMgr) forwardToLeader(w http.ResponseWriter, r *http.Request) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "forwardToLeader")
+
+	if len(r.Header.Get(forwardedHeader)) > 0 {
+		mgr.log.Info("Unable to process a forwarded request as this replica "+
+			"is not the leader", "Path", r.URL.Path)
+
+		w.Header().Set("Retry-After", strconv.Itoa(leaderRetryAfter))
+
+		http.Error(w, "The leader is not available",
+			http.StatusServiceUnavailable)
+
+		return
+	}
+
+	proxy, err := mgr.leaderProxy(r.Context())
+
+	if err != nil {
+		mgr.log.Error(err, "Unable to locate the leader")
+
+		w.Header().Set("Retry-After", strconv.Itoa(leaderRetryAfter))
+
+		http.Error(w, "The leader is not available",
+			http.StatusServiceUnavailable)
+
+		return
+	}
+
+	mgr.log.V(5).Info("Forwarding the request to the leader",
+		"Path", r.URL.Path, "Method", r.Method)
+
+	r.Header.Set(forwardedHeader, mgr.podName)
+
+	proxy.ServeHTTP(w, r)
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return a proxy which forwards requests to the
+ * current leader.  The leader is located from the lease which is used for
+ * leader election, and is cached for a short period of time.
+ */
+
+func (mgr *SnapshotMgr) leaderProxy(
+	ctx context.Context) (proxy *httputil.ReverseProxy, err error) {
+
+	mgr.leaderMutex.Lock()
+	defer mgr.leaderMutex.Unlock()
+
+	if mgr.proxy != nil && time.Now().Before(mgr.proxyExpiry) {
+		return mgr.proxy, nil
+	}
+
+	address, err := mgr.leaderAddress(ctx)
+
+	if err != nil {
+		return
+	}
+
+	/*
+	 * The certificate of the leader is issued for the snapshot service, and
+	 * so we verify the certificate against the service name.
+	 */
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM([]byte(mgr.caBundle())) {
+		err = errors.New("The CA certificate is not available")
+
+		return
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs:    pool,
+		ServerName: fmt.Sprintf("%s.%s.svc", serviceName, mgr.namespace),
+	}
+
+	target := &url.URL{
+		Scheme: "https",
+		Host:   net.JoinHostPort(address, strconv.Itoa(httpsPort)),
+	}
+
+	proxy = httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+
+	/*
+	 * The leader may have changed if we are unable to reach it, and so we
+	 * discard the cached proxy.
+	 */
+
+	proxy.ErrorHandler = func(
+		w http.ResponseWriter, r *http.Request, err error) {
+
+		mgr.log.Error(err, "Failed to forward the request to the leader",
+			"Address", address)
+
+		mgr.leaderMutex.Lock()
+		mgr.proxy = nil
+		mgr.leaderMutex.Unlock()
+
+		w.Header().Set("Retry-After", strconv.Itoa(leaderRetryAfter))
+
+		http.Error(w, "The leader is not available",
+			http.StatusServiceUnavailable)
+	}
+
+	mgr.proxy = proxy
+	mgr.proxyExpiry = time.Now().Add(leaderCacheDuration)
+
+	mgr.log.V(5).Info("Located the leader", "Address", address)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to determine the IP address of the leader.  The
+ * identity of the holder of the lease is of the form <pod name>_<uuid>.
+ */
+
+func (mgr *SnapshotMgr) leaderAddress(
+	ctx context.Context) (address string, err error) {
+
+	clientset, err := kubernetes.NewForConfig(mgr.config)
+
+	if err != nil {
+		return
+	}
+
+	lease, err := clientset.CoordinationV1().Leases(mgr.namespace).Get(
+		ctx, mgr.options.LeaderElectionID, metaV1.GetOptions{})
+
+	if err != nil {
+		return
+	}
+
+	if lease.Spec.HolderIdentity == nil ||
+		len(*lease.Spec.HolderIdentity) == 0 {
+		err = errors.New("The lease does not have a holder")
+
+		return
+	}
+
+	podName, _, _ := strings.Cut(*lease.Spec.HolderIdentity, "_")
+
+	if podName == mgr.podName {
+		err = errors.New("The lease is held by this replica, which is not " +
+			"yet the leader")
+
+		return
+	}
+
+	pod, err := clientset.CoreV1().Pods(mgr.namespace).Get(
+		ctx, podName, metaV1.GetOptions{})
+
+	if err != nil {
+		return
+	}
+
+	if len(pod.Status.PodIP) == 0 {
+		err = fmt.Errorf("The leader, %s, does not have an IP address",
+			podName)
+
+		return
+	}
+
+	address = pod.Status.PodIP
+
+	return
+}
+
+/*****************************************************************************/
@@ -0,0 +1,402 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+/*****************************************************************************/
+
+/*
+ * The localStore structure is a snapshot store which keeps the files on the
+ * local file system of the operator.  The metadata of each file is kept in a
+ * hidden file alongside the file.
+ */
+
+type localStore struct {
+	root string
+	log  logr.Logger
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the path of the specified file.
+ */
+
+func (s *localStore) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to create the directories which will store our
+ * data, removing any temporary files which have been left behind.
+ */
+
+func (s *localStore) Initialize(ctx context.Context) (err error) {
+	dirs := []string{
+		s.root,
+		filepath.Join(s.root, "snapshots"),
+		filepath.Join(s.root, "fixpacks"),
+	}
+
+	for _, dir := range dirs {
+		err = os.Mkdir(dir, 0700)
+
+		if err != nil && !os.IsExist(err) {
+			s.log.Error(err, "Failed to create the data directory",
+				"Directory", dir)
+
+			return
+		}
+
+		err = nil
+
+		for _, tmpFile := range removeTemporaryFiles(dir) {
+			s.log.V(5).Info("Removed an incomplete upload", "File", tmpFile)
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+func (s *localStore) Stat(
+	ctx context.Context, name string) (*fileMetadata, error) {
+	return s.readMetadata(s.path(name))
+}
+
+/*****************************************************************************/
+
+func (s *localStore) Get(ctx context.Context, name string) (
+	reader io.ReadCloser, metadata *fileMetadata, err error) {
+
+	file, err := os.Open(s.path(name))
+
+	if err != nil {
+		return
+	}
+
+	metadata, err = s.readMetadata(file.Name())
+
+	if err != nil {
+		file.Close()
+
+		return
+	}
+
+	reader = file
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The staged file is always held on the same file system as the store, and
+ * so it can simply be renamed to replace the existing file.
+ */
+
+func (s *localStore) Put(ctx context.Context, name string, stagedFile string,
+	metadata *fileMetadata) (err error) {
+
+	fileName := s.path(name)
+
+	err = os.MkdirAll(filepath.Dir(fileName), 0700)
+
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(stagedFile, fileName)
+
+	if err != nil {
+		return
+	}
+
+	info, err := os.Stat(fileName)
+
+	if err != nil {
+		return
+	}
+
+	metadata.LastModified = info.ModTime()
+
+	err = s.writeMetadata(fileName, metadata)
+
+	/*
+	 * Flush the directory entry so that the rename survives a crash.
+	 */
+
+	if dir, derr := os.Open(filepath.Dir(fileName)); derr == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * A hard link is used to copy a file, so that the copy doesn't consume any
+ * additional space, and is unaffected when the original file is replaced.
+ * The link is created with a temporary name, and then renamed over the
+ * existing file, so that the existing file remains intact if the copy
+ * fails.
+ */
+
+func (s *localStore) Copy(
+	ctx context.Context, srcName string, dstName string) (err error) {
+
+	srcFile := s.path(srcName)
+	dstFile := s.path(dstName)
+
+	metadata, err := s.readMetadata(srcFile)
+
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(dstFile), 0700)
+
+	if err != nil {
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dstFile),
+		"."+filepath.Base(dstFile)+".*"+tmpFileSuffix)
+
+	if err != nil {
+		return
+	}
+
+	tmp.Close()
+	os.Remove(tmp.Name())
+
+	err = os.Link(srcFile, tmp.Name())
+
+	if err != nil {
+		return
+	}
+
+	err = s.writeMetadata(dstFile, metadata)
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), dstFile)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+func (s *localStore) List(
+	ctx context.Context, dir string) (files []*fileMetadata, err error) {
+
+	entries, err := os.ReadDir(s.path(dir))
+
+	if err != nil {
+		return
+	}
+
+	files = make([]*fileMetadata, 0, len(entries))
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		metadata, merr := s.readMetadata(
+			filepath.Join(s.path(dir), entry.Name()))
+
+		if merr != nil {
+			continue
+		}
+
+		metadata.Name = entry.Name()
+
+		files = append(files, metadata)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+func (s *localStore) Delete(ctx context.Context, name string) (err error) {
+	fileName := s.path(name)
+
+	err = os.Remove(fileName)
+
+	if err == nil {
+		os.Remove(metadataFileName(fileName))
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the name of the file which holds the
+ * metadata for the specified file.  The name starts with a '.' so that it
+ * can never be requested or listed.
+ */
+
+func metadataFileName(fileName string) string {
+	return filepath.Join(filepath.Dir(fileName),
+		"."+filepath.Base(fileName)+metadataFileSuffix)
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to calculate the SHA-256 digest of the specified
+ * file.
+ */
+
+func computeDigest(fileName string) (digest string, err error) {
+	file, err := os.Open(fileName)
+
+	if err != nil {
+		return
+	}
+
+	defer file.Close()
+
+	hash := sha256.New()
+
+	_, err = io.Copy(hash, file)
+
+	if err != nil {
+		return
+	}
+
+	digest = hex.EncodeToString(hash.Sum(nil))
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to save the metadata for the specified file.  The
+ * metadata is written to a temporary file which is then renamed, so that a
+ * partial metadata file is never read.
+ */
+
+func (s *localStore) writeMetadata(
+	fileName string, metadata *fileMetadata) (err error) {
+
+	data, err := json.Marshal(metadata)
+
+	if err != nil {
+		return
+	}
+
+	metaName := metadataFileName(fileName)
+
+	dst, err := os.CreateTemp(filepath.Dir(metaName),
+		filepath.Base(metaName)+".*"+tmpFileSuffix)
+
+	if err != nil {
+		return
+	}
+
+	_, err = dst.Write(data)
+
+	if err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+
+	if err == nil {
+		err = os.Rename(dst.Name(), metaName)
+	}
+
+	if err != nil {
+		os.Remove(dst.Name())
+
+		s.log.V(5).Error(err, "Failed to save the metadata",
+			"File", fileName)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to retrieve the metadata for the specified file.  If
+ * the metadata is missing or out of date (e.g. for a file which was uploaded
+ * by an earlier version of the operator) the digest is calculated and the
+ * metadata is saved.
+ */
+
+func (s *localStore) readMetadata(
+	fileName string) (metadata *fileMetadata, err error) {
+
+	info, err := os.Stat(fileName)
+
+	if err != nil {
+		return
+	}
+
+	metadata = &fileMetadata{}
+
+	data, rerr := os.ReadFile(metadataFileName(fileName))
+
+	if rerr == nil && json.Unmarshal(data, metadata) == nil &&
+		metadata.Size == info.Size() &&
+		metadata.LastModified.Equal(info.ModTime()) &&
+		len(metadata.Digest) > 0 {
+		return
+	}
+
+	s.log.V(5).Info("Calculating the digest of the file", "File", fileName)
+
+	digest, err := computeDigest(fileName)
+
+	if err != nil {
+		s.log.V(5).Error(err, "Failed to calculate the digest of the file",
+			"File", fileName)
+
+		return
+	}
+
+	metadata = &fileMetadata{
+		Name:         filepath.Base(fileName),
+		Size:         info.Size(),
+		Digest:       digest,
+		LastModified: info.ModTime(),
+	}
+
+	s.writeMetadata(fileName, metadata)
+
+	return
+}
+
+/*****************************************************************************/
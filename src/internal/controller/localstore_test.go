@@ -0,0 +1,109 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+)
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the content of the specified file of the
+ * supplied store.
+ */
+
+func readStoreFile(t *testing.T, store SnapshotStore, name string) string {
+	reader, _, err := store.Get(context.Background(), name)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify that a file is copied, and that the existing file remains intact
+ * if the copy fails.
+ */
+
+func TestLocalStoreCopy(t *testing.T) {
+	ctx := context.Background()
+	store := &localStore{root: t.TempDir(), log: logr.Discard()}
+
+	if err := store.Initialize(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	src := "snapshots/ivia_test.snapshot"
+	dst := "snapshots/ivia_published.snapshot"
+
+	for name, content := range map[string]string{src: "new", dst: "old"} {
+		staged, metadata := stageTestFile(t, content)
+
+		if err := store.Put(ctx, name, staged, metadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	/*
+	 * The metadata of the copy cannot be written while a directory occupies
+	 * the name of the metadata file.
+	 */
+
+	blocker := metadataFileName(store.path(dst))
+
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(blocker, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Copy(ctx, src, dst); err == nil {
+		t.Fatal("the copy succeeded")
+	}
+
+	if content := readStoreFile(t, store, dst); content != "old" {
+		t.Errorf("content after a failed copy = %q, want %q", content, "old")
+	}
+
+	if tmpFiles, _ := filepath.Glob(filepath.Join(store.path("snapshots"),
+		".*"+tmpFileSuffix)); len(tmpFiles) > 0 {
+		t.Errorf("temporary files were left behind: %v", tmpFiles)
+	}
+
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Copy(ctx, src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if content := readStoreFile(t, store, dst); content != "new" {
+		t.Errorf("content after the copy = %q, want %q", content, "new")
+	}
+}
+
+/*****************************************************************************/
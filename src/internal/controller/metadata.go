@@ -0,0 +1,137 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*****************************************************************************/
+
+/*
+ * The fileMetadata structure holds the metadata which is stored for each
+ * uploaded file.
+ */
+
+type fileMetadata struct {
+	// The name of the file.
+	Name string `json:"name"`
+
+	// The size of the file, in bytes.
+	Size int64 `json:"size"`
+
+	// The hex encoded SHA-256 digest of the file.
+	Digest string `json:"sha256"`
+
+	// The time at which the file was last modified.
+	LastModified time.Time `json:"lastModified"`
+
+	// The client which uploaded the file.
+	Client string `json:"client,omitempty"`
+
+	// The services which were modified, as supplied with the upload.
+	Modified string `json:"modified,omitempty"`
+
+	// The revision of the file in the history of the file.
+	Revision int `json:"revision,omitempty"`
+
+	// The revision which was re-published if this file is the result of a
+	// rollback.
+	RollbackOf int `json:"rollbackOf,omitempty"`
+
+	// The approval state of the file, which is only set for a gated
+	// snapshot.
+	Approval string `json:"approval,omitempty"`
+
+	// The principal which approved, or rejected, the file.
+	Reviewer string `json:"reviewer,omitempty"`
+}
+
+/*****************************************************************************/
+
+/*
+ * The error which is returned when an uploaded file is rejected because it
+ * is incomplete, or does not match the expected digest.
+ */
+
+var errInvalidUpload = errors.New("The uploaded file is not valid")
+
+/*****************************************************************************/
+
+/*
+ * This function is used to retrieve the digest which the client expects
+ * the uploaded file to have.  This can be supplied either in the 'sha256'
+ * query string argument as a hex encoded value, or in a 'Digest' header
+ * (RFC 3230) as a base64 encoded 'sha-256' value.  An empty string is
+ * returned if no digest has been supplied.
+ */
+
+func expectedDigest(r *http.Request) (digest string, err error) {
+	digest = strings.ToLower(r.URL.Query().Get("sha256"))
+
+	if len(digest) > 0 {
+		if raw, derr := hex.DecodeString(digest); derr != nil ||
+			len(raw) != sha256.Size {
+			err = fmt.Errorf("%w: the sha256 argument is not a valid SHA-256 "+
+				"digest", errInvalidUpload)
+		}
+
+		return
+	}
+
+	for _, header := range r.Header.Values("Digest") {
+		for _, value := range strings.Split(header, ",") {
+			algorithm, encoded, found := strings.Cut(strings.TrimSpace(value), "=")
+
+			if !found || !strings.EqualFold(algorithm, "sha-256") {
+				continue
+			}
+
+			raw, derr := base64.StdEncoding.DecodeString(encoded)
+
+			if derr != nil || len(raw) != sha256.Size {
+				err = fmt.Errorf("%w: the Digest header does not contain a "+
+					"valid SHA-256 digest", errInvalidUpload)
+
+				return
+			}
+
+			digest = hex.EncodeToString(raw)
+
+			return
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to add the ETag and Digest headers for the
+ * specified file to the response.
+ */
+
+func setDigestHeaders(w http.ResponseWriter, metadata *fileMetadata) {
+	raw, err := hex.DecodeString(metadata.Digest)
+
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", metadata.Digest))
+	w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(raw))
+}
+
+/*****************************************************************************/
@@ -0,0 +1,404 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * Snapshots and fixpacks can be published to a container registry as OCI
+ * artifacts, for example with 'oras push'.  The ociClient structure uses
+ * the ORAS client to pull the manifest of an artifact, and then the layer
+ * which holds the file.
+ */
+
+type ociClient struct {
+	// The repository which holds the artifact.
+	repository *remote.Repository
+
+	// The tag or digest of the artifact.
+	reference string
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to parse an artifact reference.  References which
+ * do not include a registry refer to Docker Hub, and references which do
+ * not include a tag or digest refer to the 'latest' tag.
+ */
+
+func parseOCIReference(value string) (ref registry.Reference, err error) {
+	value = strings.TrimPrefix(value, "oci://")
+
+	/*
+	 * The first component of the name is the registry if it looks like a
+	 * host name.
+	 */
+
+	first, _, found := strings.Cut(value, "/")
+
+	if !found {
+		value = ociDockerHubRegistry + "/library/" + value
+	} else if !strings.ContainsAny(first, ".:") && first != "localhost" {
+		value = ociDockerHubRegistry + "/" + value
+	}
+
+	ref, err = registry.ParseReference(value)
+
+	if err != nil {
+		err = fmt.Errorf("The OCI reference, %s, is not valid: %w", value, err)
+
+		return
+	}
+
+	if len(ref.Reference) == 0 {
+		ref.Reference = "latest"
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to create a client for the repository of the
+ * supplied reference.  The credentials for the registry are located within
+ * the supplied image pull secrets.
+ */
+
+func newOCIRepositoryClient(ref registry.Reference, plainHTTP bool,
+	httpClient *http.Client, secrets []corev1.Secret) (
+	client *ociClient, err error) {
+
+	credential, err := pullSecretCredential(ref.Registry, secrets)
+
+	if err != nil {
+		return
+	}
+
+	repository := &remote.Repository{
+		Client: &auth.Client{
+			Client:     httpClient,
+			Cache:      auth.NewCache(),
+			Credential: auth.StaticCredential(ref.Host(), credential),
+		},
+		Reference: ref,
+		PlainHTTP: plainHTTP,
+		ManifestMediaTypes: []string{
+			ocispec.MediaTypeImageManifest,
+			dockerManifestMediaType,
+		},
+		MaxMetadataBytes: ociMaxManifestSize,
+	}
+
+	client = &ociClient{
+		repository: repository,
+		reference:  ref.Reference,
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to retrieve the manifest of the artifact, along
+ * with the digest of the manifest.  The content of the manifest is verified
+ * against the digest.
+ */
+
+func (c *ociClient) fetchManifest(ctx context.Context) (
+	manifest *ocispec.Manifest, manifestDigest string, err error) {
+
+	desc, reader, err := c.repository.FetchReference(ctx, c.reference)
+
+	if err != nil {
+		return
+	}
+
+	defer reader.Close()
+
+	if desc.Size > ociMaxManifestSize {
+		err = fmt.Errorf("The manifest of the artifact, %s, is larger than "+
+			"%d bytes", c.reference, ociMaxManifestSize)
+
+		return
+	}
+
+	body, err := content.ReadAll(reader, desc)
+
+	if err != nil {
+		return
+	}
+
+	manifest = &ocispec.Manifest{}
+
+	err = json.Unmarshal(body, manifest)
+
+	if err == nil && len(manifest.Layers) == 0 {
+		err = fmt.Errorf("The artifact, %s, does not contain any layers",
+			c.reference)
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	manifestDigest = desc.Digest.String()
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to determine the digest of the manifest which is
+ * currently referenced by the tag of the artifact, without retrieving the
+ * artifact itself.  This is used to detect when a tag has been moved.
+ */
+
+func (c *ociClient) resolveDigest(ctx context.Context) (
+	manifestDigest string, err error) {
+
+	if _, derr := digest.Parse(c.reference); derr == nil {
+		return c.reference, nil
+	}
+
+	desc, err := c.repository.Resolve(ctx, c.reference)
+
+	/*
+	 * The digest header is optional, in which case we need to retrieve the
+	 * manifest and calculate the digest ourselves.
+	 */
+
+	if err != nil {
+		_, manifestDigest, err = c.fetchManifest(ctx)
+
+		return
+	}
+
+	manifestDigest = desc.Digest.String()
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to select the layer of the manifest which holds
+ * the specified file.  An artifact with a single layer is always accepted,
+ * otherwise the layer is selected using the title annotation which is added
+ * by tools such as 'oras'.  The title must either match the name of the
+ * file or, failing that, have the same extension as the file.
+ */
+
+func selectOCILayer(manifest *ocispec.Manifest, fileName string) (
+	*ocispec.Descriptor, error) {
+
+	if len(manifest.Layers) == 1 {
+		return &manifest.Layers[0], nil
+	}
+
+	for idx := range manifest.Layers {
+		if manifest.Layers[idx].Annotations[ocispec.AnnotationTitle] ==
+			fileName {
+			return &manifest.Layers[idx], nil
+		}
+	}
+
+	suffix := path.Ext(fileName)
+
+	for idx := range manifest.Layers {
+		if len(suffix) > 0 && strings.HasSuffix(
+			manifest.Layers[idx].Annotations[ocispec.AnnotationTitle], suffix) {
+			return &manifest.Layers[idx], nil
+		}
+	}
+
+	return nil, fmt.Errorf("The artifact does not contain a layer with a "+
+		"title of %s, or a title which ends with %s", fileName, suffix)
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to retrieve the content of a layer.  The digest, and
+ * size, of the content are verified as the content is read, and an error is
+ * returned in place of the end of the content if they do not match the
+ * layer.
+ */
+
+func (c *ociClient) fetchBlob(ctx context.Context,
+	layer *ocispec.Descriptor) (io.ReadCloser, error) {
+
+	if err := layer.Digest.Validate(); err != nil ||
+		layer.Digest.Algorithm() != digest.SHA256 {
+		return nil, fmt.Errorf("The digest algorithm of the layer, %s, is "+
+			"not supported", layer.Digest)
+	}
+
+	reader, err := c.repository.Fetch(ctx, *layer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ociBlobReader{
+		Closer:   reader,
+		verifier: content.NewVerifyReader(reader, *layer),
+	}, nil
+}
+
+/*****************************************************************************/
+
+/*
+ * The ociBlobReader structure is used to verify the content of a layer as
+ * it is read.
+ */
+
+type ociBlobReader struct {
+	io.Closer
+
+	verifier *content.VerifyReader
+}
+
+func (r *ociBlobReader) Read(data []byte) (n int, err error) {
+	n, err = r.verifier.Read(data)
+
+	if err == io.EOF {
+		if verr := r.verifier.Verify(); verr != nil {
+			err = verr
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The dockerConfig structure holds the parts of a Docker configuration
+ * file, as held in an image pull secret, which are of interest to us.
+ */
+
+type dockerConfig struct {
+	Auths map[string]dockerAuth `json:"auths"`
+}
+
+type dockerAuth struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Auth     string `json:"auth,omitempty"`
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to locate the credentials for a registry within the
+ * supplied image pull secrets.  Both the kubernetes.io/dockerconfigjson and
+ * the older kubernetes.io/dockercfg formats are supported.  The credentials
+ * of the first matching secret are used.
+ */
+
+func pullSecretCredential(server string, secrets []corev1.Secret) (
+	credential auth.Credential, err error) {
+
+	for _, secret := range secrets {
+		config := dockerConfig{}
+
+		if data, ok := secret.Data[corev1.DockerConfigJsonKey]; ok {
+			err = json.Unmarshal(data, &config)
+		} else if data, ok := secret.Data[corev1.DockerConfigKey]; ok {
+			err = json.Unmarshal(data, &config.Auths)
+		} else {
+			err = fmt.Errorf("The image pull secret, %s, does not contain "+
+				"a Docker configuration", secret.Name)
+
+			return
+		}
+
+		if err != nil {
+			err = fmt.Errorf("The image pull secret, %s, is not valid: %w",
+				secret.Name, err)
+
+			return
+		}
+
+		for name, dockerAuth := range config.Auths {
+			if registryHost(name) != registryHost(server) {
+				continue
+			}
+
+			credential.Username = dockerAuth.Username
+			credential.Password = dockerAuth.Password
+
+			if len(dockerAuth.Auth) > 0 {
+				var decoded []byte
+
+				decoded, err = base64.StdEncoding.DecodeString(dockerAuth.Auth)
+
+				if err != nil {
+					err = fmt.Errorf("The image pull secret, %s, is not "+
+						"valid: %w", secret.Name, err)
+
+					return
+				}
+
+				credential.Username, credential.Password, _ = strings.Cut(
+					string(decoded), ":")
+			}
+
+			return
+		}
+	}
+
+	return
+}
+
+/*
+ * This function is used to normalize the name of a registry, as it appears
+ * in a Docker configuration file, so that it can be compared with the
+ * registry of a reference.  The various names of Docker Hub are all treated
+ * as the same registry.
+ */
+
+func registryHost(server string) string {
+	if idx := strings.Index(server, "://"); idx >= 0 {
+		server = server[idx+3:]
+	}
+
+	server, _, _ = strings.Cut(server, "/")
+
+	switch server {
+	case "docker.io", "index.docker.io", ociDockerHubRegistry:
+		return ociDockerHubRegistry
+	}
+
+	return server
+}
+
+/*****************************************************************************/
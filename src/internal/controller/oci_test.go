@@ -0,0 +1,433 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * The fakeRegistry structure is a minimal implementation of a registry,
+ * with a token service, which holds a single artifact.  The registry behaves
+ * in the same way as the 'registry:2' image with token authentication.
+ */
+
+type fakeRegistry struct {
+	server     *httptest.Server
+	repository string
+	tag        string
+	username   string
+	password   string
+	token      string
+	manifest   []byte
+	blobs      map[string][]byte
+
+	// The number of tokens which have been issued.
+	tokens int
+
+	// Whether the Docker-Content-Digest header is returned.
+	contentDigest bool
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to create a registry which holds an artifact with
+ * a layer for each of the supplied files.  The served content of a blob can
+ * be changed after the registry has been created, to simulate a corrupt
+ * blob.
+ */
+
+func newFakeRegistry(t *testing.T, files map[string]string) *fakeRegistry {
+	registry := &fakeRegistry{
+		repository:    "ivia/snapshots",
+		tag:           "11.0.0.0",
+		username:      "user",
+		password:      "passw0rd",
+		token:         "registry-token",
+		blobs:         make(map[string][]byte),
+		contentDigest: true,
+	}
+
+	manifest := ocispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.ibm.ivia.snapshot",
+	}
+
+	for title, content := range files {
+		sum := sha256.Sum256([]byte(content))
+		blobDigest := "sha256:" + hex.EncodeToString(sum[:])
+
+		registry.blobs[blobDigest] = []byte(content)
+
+		manifest.Layers = append(manifest.Layers, ocispec.Descriptor{
+			MediaType:   "application/octet-stream",
+			Digest:      digest.Digest(blobDigest),
+			Size:        int64(len(content)),
+			Annotations: map[string]string{ocispec.AnnotationTitle: title},
+		})
+	}
+
+	registry.manifest, _ = json.Marshal(manifest)
+
+	registry.server = httptest.NewServer(registry)
+
+	t.Cleanup(registry.server.Close)
+
+	return registry
+}
+
+/*****************************************************************************/
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	/*
+	 * The token service.
+	 */
+
+	if r.URL.Path == "/token" {
+		username, password, ok := r.BasicAuth()
+
+		if !ok || username != f.username || password != f.password {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		if r.URL.Query().Get("scope") != "repository:"+f.repository+":pull" ||
+			r.URL.Query().Get("service") != "fake-registry" {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+
+		f.tokens++
+
+		json.NewEncoder(w).Encode(map[string]string{"token": f.token})
+
+		return
+	}
+
+	/*
+	 * The registry, which requires a token.
+	 */
+
+	if r.Header.Get("Authorization") != "Bearer "+f.token {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+			`Bearer realm="%s/token",service="fake-registry",`+
+				`scope="repository:%s:pull"`, f.server.URL, f.repository))
+		w.WriteHeader(http.StatusUnauthorized)
+
+		return
+	}
+
+	prefix := "/v2/" + f.repository + "/"
+
+	resource, found := strings.CutPrefix(r.URL.Path, prefix)
+
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	sum := sha256.Sum256(f.manifest)
+	manifestDigest := "sha256:" + hex.EncodeToString(sum[:])
+
+	/*
+	 * The manifest is returned for any digest, as a compromised registry
+	 * might do.
+	 */
+
+	if resource == "manifests/"+f.tag ||
+		strings.HasPrefix(resource, "manifests/sha256:") {
+		if !strings.Contains(r.Header.Get("Accept"),
+			ocispec.MediaTypeImageManifest) {
+			w.WriteHeader(http.StatusNotAcceptable)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+		w.Header().Set("Content-Length", strconv.Itoa(len(f.manifest)))
+
+		if f.contentDigest {
+			w.Header().Set("Docker-Content-Digest", manifestDigest)
+		}
+
+		if r.Method == http.MethodGet {
+			w.Write(f.manifest)
+		}
+
+		return
+	}
+
+	if blob, ok := f.blobs[strings.TrimPrefix(resource, "blobs/")]; ok {
+		w.Write(blob)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the reference of the artifact in the
+ * registry, either by tag or by the supplied digest.
+ */
+
+func (f *fakeRegistry) reference(manifestDigest string) string {
+	host := strings.TrimPrefix(f.server.URL, "http://")
+
+	if len(manifestDigest) > 0 {
+		return host + "/" + f.repository + "@" + manifestDigest
+	}
+
+	return host + "/" + f.repository + ":" + f.tag
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to create a client for the supplied reference, with
+ * an image pull secret for the registry which contains the supplied
+ * password.
+ */
+
+func (f *fakeRegistry) client(t *testing.T, reference string,
+	password string) *ociClient {
+
+	ref, err := parseOCIReference(reference)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, _ := json.Marshal(dockerConfig{
+		Auths: map[string]dockerAuth{
+			"http://" + ref.Registry: {
+				Username: f.username,
+				Password: password,
+			},
+		},
+	})
+
+	client, err := newOCIRepositoryClient(ref, true, f.server.Client(),
+		[]corev1.Secret{{
+			Data: map[string][]byte{corev1.DockerConfigJsonKey: config},
+		}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify that an artifact is pulled from a registry which requires token
+ * authentication.
+ */
+
+func TestOCIPullWithToken(t *testing.T) {
+	registry := newFakeRegistry(t, map[string]string{
+		"ivia.snapshot":  "snapshot content",
+		"ivia.signature": "signature",
+	})
+
+	ctx := context.Background()
+	client := registry.client(t, registry.reference(""), registry.password)
+
+	manifest, manifestDigest, err := client.fetchManifest(ctx)
+
+	if err != nil {
+		t.Fatalf("fetchManifest: %v", err)
+	}
+
+	if registry.tokens == 0 {
+		t.Errorf("a token was not requested from the token service")
+	}
+
+	layer, err := selectOCILayer(manifest, "ivia.snapshot")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := client.fetchBlob(ctx, layer)
+
+	if err != nil {
+		t.Fatalf("fetchBlob: %v", err)
+	}
+
+	data, err := io.ReadAll(reader)
+	reader.Close()
+
+	if err != nil || string(data) != "snapshot content" {
+		t.Errorf("fetchBlob returned %q, %v", data, err)
+	}
+
+	/*
+	 * The digest of the tag is resolved with and without the
+	 * Docker-Content-Digest header.
+	 */
+
+	for _, contentDigest := range []bool{true, false} {
+		registry.contentDigest = contentDigest
+
+		digest, err := client.resolveDigest(ctx)
+
+		if err != nil || digest != manifestDigest {
+			t.Errorf("resolveDigest(contentDigest=%v) = %q, %v, want %q",
+				contentDigest, digest, err, manifestDigest)
+		}
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify that the token service rejects incorrect credentials.
+ */
+
+func TestOCIPullWithWrongCredentials(t *testing.T) {
+	registry := newFakeRegistry(t, map[string]string{"ivia.snapshot": "x"})
+
+	client := registry.client(t, registry.reference(""), "wrong")
+
+	if _, _, err := client.fetchManifest(context.Background()); err == nil {
+		t.Errorf("fetchManifest succeeded with the wrong credentials")
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify that content which doesn't match its digest is rejected.
+ */
+
+func TestOCIDigestMismatch(t *testing.T) {
+	registry := newFakeRegistry(t, map[string]string{
+		"ivia.snapshot": "snapshot content",
+	})
+
+	ctx := context.Background()
+
+	/*
+	 * A manifest which is requested by digest must match the digest.
+	 */
+
+	wrongDigest := "sha256:" + strings.Repeat("0", 64)
+
+	client := registry.client(t, registry.reference(wrongDigest),
+		registry.password)
+
+	if _, _, err := client.fetchManifest(ctx); err == nil ||
+		!strings.Contains(err.Error(), "mismatch") {
+		t.Errorf("fetchManifest of a modified manifest returned %v", err)
+	}
+
+	/*
+	 * A blob which doesn't match the digest, or the size, of its layer.
+	 */
+
+	client = registry.client(t, registry.reference(""), registry.password)
+
+	manifest, _, err := client.fetchManifest(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layer := manifest.Layers[0]
+
+	tampered := []string{"snapshot CONTENT", "snapshot", "snapshot content!"}
+
+	for _, content := range tampered {
+		registry.blobs[layer.Digest.String()] = []byte(content)
+
+		/*
+		 * A blob whose size doesn't match may be rejected before it is read.
+		 */
+
+		reader, err := client.fetchBlob(ctx, &layer)
+
+		if err == nil {
+			_, err = io.ReadAll(reader)
+			reader.Close()
+		}
+
+		if err == nil {
+			t.Errorf("the blob %q was accepted for the layer %s", content,
+				layer.Digest)
+		}
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify the parsing of artifact references.
+ */
+
+func TestParseOCIReference(t *testing.T) {
+	testDigest := "sha256:" + strings.Repeat("a", 64)
+
+	tests := []struct {
+		value      string
+		registry   string
+		repository string
+		reference  string
+		valid      bool
+	}{
+		{"oci://registry.example.com/ivia/snapshots:11.0", "registry.example.com", "ivia/snapshots", "11.0", true},
+		{"localhost:5000/snapshots", "localhost:5000", "snapshots", "latest", true},
+		{"localhost/snapshots@" + testDigest, "localhost", "snapshots", testDigest, true},
+		{"localhost/snapshots@sha256:abc", "", "", "", false},
+		{"ivia/snapshots:1", ociDockerHubRegistry, "ivia/snapshots", "1", true},
+		{"snapshots", ociDockerHubRegistry, "library/snapshots", "latest", true},
+		{"registry.example.com/IVIA", "", "", "", false},
+	}
+
+	for _, test := range tests {
+		ref, err := parseOCIReference(test.value)
+
+		if (err == nil) != test.valid {
+			t.Errorf("parseOCIReference(%q) error = %v", test.value, err)
+
+			continue
+		}
+
+		if test.valid && (ref.Registry != test.registry ||
+			ref.Repository != test.repository ||
+			ref.Reference != test.reference) {
+			t.Errorf("parseOCIReference(%q) = %+v", test.value, ref)
+		}
+	}
+}
+
+/*****************************************************************************/
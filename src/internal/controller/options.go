@@ -0,0 +1,119 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"time"
+)
+
+/*****************************************************************************/
+
+/*
+ * The supported sources for the certificate of the snapshot manager.
+ */
+
+const (
+	// The certificate is generated and renewed by the operator itself.
+	CertSourceOperator string = "operator"
+
+	// The certificate is requested from cert-manager.
+	CertSourceCertManager string = "cert-manager"
+)
+
+/*****************************************************************************/
+
+/*
+ * The SnapshotMgrOptions structure contains the options which are used to
+ * control the behaviour of the snapshot manager.  The options are usually
+ * set from the command line of the manager.
+ */
+
+type SnapshotMgrOptions struct {
+	// The source of the certificate for the snapshot manager, which is
+	// either 'operator' or 'cert-manager'.
+	CertSource string
+
+	// The name of the cert-manager issuer which will issue the certificate.
+	CertIssuerName string
+
+	// The kind of the cert-manager issuer, either Issuer or ClusterIssuer.
+	CertIssuerKind string
+
+	// The API group of the cert-manager issuer.
+	CertIssuerGroup string
+
+	// The TLS policy for the snapshot manager, which also controls the type
+	// and size of the generated keys.
+	TLSPolicy TLSPolicy
+
+	// The number of revisions of each uploaded file which are kept so that
+	// the file can be rolled back.  The history is disabled if this is 0.
+	SnapshotHistory int
+
+	// The type of store which holds the snapshots and fixpacks, which is
+	// either 'local', 's3' or 'kubernetes'.
+	StoreType string
+
+	// Compress the files which are held in the Kubernetes snapshot store.
+	StoreCompression bool
+
+	// The options for the S3 snapshot store.
+	S3 S3Options
+
+	// The options for mirroring the snapshots and fixpacks from a Git
+	// repository.
+	Git GitOptions
+
+	// The length of time which a restart job waits for the restarted
+	// deployments to complete their rollout.
+	RestartTimeout time.Duration
+
+	// The strategy which is used to restart the deployments, which is either
+	// 'parallel' or 'staged'.
+	RestartStrategy string
+
+	// The number of deployments which are restarted at a time by the staged
+	// restart strategy.
+	RestartBatchSize int
+
+	// The order in which the roles of the deployments, for example 'dsc',
+	// 'runtime' and 'wrp', are restarted when a restart is not limited to a
+	// single service.  Each role is only restarted once the deployments of
+	// the previous role have completed their rollout.
+	RestartOrder []string
+
+	// The length of time for which the restart of a deployment waits for
+	// further restarts of the deployment, which are then coalesced into a
+	// single restart.  The restarts are not coalesced if this is 0.
+	RestartQuietPeriod time.Duration
+
+	// Automatically roll back a snapshot when a deployment which was
+	// restarted for the snapshot fails to complete its rollout.
+	AutoRollback bool
+
+	// The snapshot identifiers, for example 'published', whose uploads are
+	// held as pending until they have been approved, rather than being
+	// published straight away.
+	GatedSnapshots []string
+
+	// The name of the lease which is used for leader election, or an empty
+	// string if leader election is disabled.
+	LeaderElectionID string
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to determine whether the certificate of the
+ * snapshot manager is to be issued by cert-manager.
+ */
+
+func (o SnapshotMgrOptions) useCertManager() bool {
+	return o.CertSource == CertSourceCertManager
+}
+
+/*****************************************************************************/
@@ -0,0 +1,287 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+/*****************************************************************************/
+
+/*
+ * The supported strategies for restarting the deployments.
+ */
+
+const (
+	// All of the matching deployments are restarted at once.
+	RestartStrategyParallel string = "parallel"
+
+	// The matching deployments are restarted one batch at a time, and each
+	// batch must complete its rollout before the next batch is restarted.
+	RestartStrategyStaged string = "staged"
+)
+
+/*****************************************************************************/
+
+/*
+ * The restartRequest structure describes the deployments which are to be
+ * restarted.  A restart is requested either when a file is uploaded, in
+ * which case the path of the file is set, or explicitly by a POST to the
+ * '/restart' endpoint.  Empty fields match all deployments.
+ */
+
+type restartRequest struct {
+	// The path of the file which was uploaded, for example
+	// '/fixpacks/test.fixpack'.
+	path string
+
+	// The snapshot identifier which must be used by the deployment.
+	snapshotId string
+
+	// The services which are to be restarted, for example 'wrp-default'.
+	services []string
+
+	// The namespace of the deployments.
+	namespace string
+
+	// The name of the custom resource of the deployments.
+	name string
+
+	// The client which requested the restart.
+	client string
+
+	// Whether the deployments are being restarted after an automatic
+	// rollback, in which case a failed rollout is not rolled back again.
+	rollback bool
+
+	// Whether the restart has been requested by the restart token of the
+	// custom resource, in which case the AutoRestart field is ignored.
+	manual bool
+
+	// Whether the restart was deferred until the restart window of the
+	// custom resource opened.  The AutoRestart field and the restart policy
+	// were checked when the restart was first requested, and so are not
+	// checked again.
+	deferred bool
+
+	// The SHA-256 digest of the uploaded snapshot, which is recorded in the
+	// deployment so that an identical snapshot can be detected.
+	digest string
+}
+
+/*
+ * The pattern which a snapshot identifier must match.
+ */
+
+var snapshotIdPattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the label selectors which are used to
+ * list the deployments of the request, one for each service.
+ */
+
+func (request restartRequest) selectors() (selectors []string, err error) {
+	services := request.services
+
+	if len(services) == 0 {
+		services = []string{""}
+	}
+
+	for _, service := range services {
+		set := labels.Set{"kind": kindName}
+
+		if len(service) > 0 {
+			set["service"] = service
+		}
+
+		if len(request.name) > 0 {
+			set["VerifyAccess_cr"] = request.name
+		}
+
+		selector, serr := labels.ValidatedSelectorFromSet(set)
+
+		if serr != nil {
+			return nil, serr
+		}
+
+		selectors = append(selectors, selector.String())
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to process a POST to the '/restart' endpoint, which
+ * triggers a rolling restart of the matching deployments without uploading
+ * a file.  The deployments are filtered in the same way as for an upload,
+ * using the following optional arguments, which can be supplied in either
+ * the query string or a form:
+ *   - snapshotId: the snapshot identifier used by the deployments
+ *   - services:   the services, in the same format as the 'modified'
+ *                 argument of an upload, e.g. 'wrp:default,runtime'
+ *   - namespace:  the namespace of the deployments
+ *   - name:       the name of the IBMSecurityVerifyAccess resource
+ *
+ * The restart is performed by a restart job, and a '202 Accepted' response,
+ * which contains the job, is returned immediately.
+ */
+
+func (mgr *SnapshotMgr) serveRestart(
+	w http.ResponseWriter, r *http.Request, client string) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "serveRestart")
+
+	if r.Method != "POST" {
+		http.Error(w,
+			http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	request := restartRequest{
+		snapshotId: r.FormValue("snapshotId"),
+		services:   modifiedServices(r.FormValue("services")),
+		namespace:  r.FormValue("namespace"),
+		name:       r.FormValue("name"),
+		client:     client,
+	}
+
+	mgr.log.Info("Processing a restart",
+		"Snapshot.Id", request.snapshotId,
+		"Services", strings.Join(request.services, ","),
+		"Namespace", request.namespace,
+		"CustomResource.Name", request.name,
+		"Client", client)
+
+	/*
+	 * Validate the arguments.
+	 */
+
+	var err error
+
+	if len(request.snapshotId) > 0 &&
+		!snapshotIdPattern.MatchString(request.snapshotId) {
+		err = fmt.Errorf("The snapshot identifier, %s, is not valid",
+			request.snapshotId)
+	} else if msgs := validation.IsDNS1123Label(request.namespace); len(
+		request.namespace) > 0 && len(msgs) > 0 {
+		err = fmt.Errorf("The namespace, %s, is not valid: %s",
+			request.namespace, strings.Join(msgs, ", "))
+	} else {
+		_, err = request.selectors()
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	/*
+	 * Start the restart job and return the job, along with its location.
+	 */
+
+	job := mgr.startRestart(request)
+
+	if job == nil {
+		http.Error(w, "The restart job could not be started",
+			http.StatusServiceUnavailable)
+
+		return
+	}
+
+	jsonStr, err := job.marshal()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Location", "/jobs/"+job.Id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(jsonStr)
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to divide the deployments which are to be restarted
+ * into stages.  If the request does not name a single service the
+ * deployments are first divided into tiers, based on the role of each
+ * deployment and the configured restart order, with the deployments whose
+ * role is not in the restart order in a final tier.  Each tier is then
+ * divided into batches if the staged restart strategy is being used.
+ */
+
+func (mgr *SnapshotMgr) restartStages(request restartRequest,
+	deployments []appsv1.Deployment) (stages [][]appsv1.Deployment) {
+
+	tiers := [][]appsv1.Deployment{deployments}
+
+	if len(request.services) != 1 && len(mgr.options.RestartOrder) > 0 {
+		tiers = make([][]appsv1.Deployment, len(mgr.options.RestartOrder)+1)
+
+		for _, deployment := range deployments {
+			tier := slices.Index(mgr.options.RestartOrder,
+				deploymentRole(&deployment))
+
+			if tier < 0 {
+				tier = len(mgr.options.RestartOrder)
+			}
+
+			tiers[tier] = append(tiers[tier], deployment)
+		}
+	}
+
+	for _, tier := range tiers {
+		batchSize := len(tier)
+
+		if mgr.options.RestartStrategy == RestartStrategyStaged {
+			batchSize = max(mgr.options.RestartBatchSize, 1)
+		}
+
+		for len(tier) > 0 {
+			batch := tier[:min(batchSize, len(tier))]
+			tier = tier[len(batch):]
+
+			stages = append(stages, batch)
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the role of a deployment, which is the
+ * service label of the deployment without the instance, for example 'wrp'
+ * for the 'wrp-default' service.
+ */
+
+func deploymentRole(deployment *appsv1.Deployment) string {
+	role, _, _ := strings.Cut(deployment.Labels["service"], "-")
+
+	return role
+}
+
+/*****************************************************************************/
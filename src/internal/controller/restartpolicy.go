@@ -0,0 +1,106 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ibmv1 "github.com/ibm-security/verify-access-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * The restart policy of a custom resource controls whether the deployment
+ * of the custom resource is restarted after an upload, and how the
+ * deployment is restarted.  A restart which has been requested by the
+ * restart token of the custom resource, or which was deferred until the
+ * restart window opened, ignores the restart policy, other than the
+ * strategy which is used to restart the deployment.
+ */
+
+/*****************************************************************************/
+
+/*
+ * This function is used to determine whether the restart policy of the
+ * supplied custom resource allows the deployment to be restarted for the
+ * supplied request.  A reason which explains why the deployment is not
+ * restarted is returned if the policy does not allow the restart.
+ */
+
+func (mgr *SnapshotMgr) checkRestartPolicy(
+	request restartRequest,
+	deployment *appsv1.Deployment,
+	verifyaccess *ibmv1.IBMSecurityVerifyAccess,
+	rtClient client.Client) (reason string) {
+
+	if request.manual || request.deferred {
+		return ""
+	}
+
+	switch verifyaccess.Spec.RestartPolicy {
+	case ibmv1.RestartFixpacksOnly:
+		if !strings.HasPrefix(request.path, "/fixpacks/") {
+			return "The restart policy only allows the deployment to be " +
+				"restarted for a new fixpack"
+		}
+
+	case ibmv1.RestartOnlyIfSnapshotChanged:
+		current := deployment.Spec.Template.Annotations[snapshotDigestAnnotation]
+
+		if len(request.digest) > 0 && current == request.digest {
+			return "The snapshot is identical to the snapshot for which the " +
+				"deployment was last restarted"
+		}
+
+	case ibmv1.RestartManual:
+		mgr.updateConditions(rtClient, verifyaccess.Namespace,
+			verifyaccess.Name, func(conditions *[]metav1.Condition) {
+				apimeta.SetStatusCondition(conditions, metav1.Condition{
+					Type:   restartPendingConditionType,
+					Status: metav1.ConditionTrue,
+					Reason: "ManualRestartPolicy",
+					Message: fmt.Sprintf("A restart, requested by %s, is "+
+						"pending.  The deployment is only restarted when the "+
+						"restartToken field, or the %s annotation, is changed.",
+						request.client, restartRequestedAnnotation),
+				})
+			})
+
+		return "The restart policy only allows the deployment to be " +
+			"restarted manually"
+	}
+
+	return ""
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the strategy which is used to restart the
+ * deployment of the supplied custom resource.  The Recreate policy deletes
+ * all of the existing pods before any of the new pods are created, and every
+ * other policy performs a rolling update.
+ */
+
+func restartStrategyType(
+	verifyaccess *ibmv1.IBMSecurityVerifyAccess) appsv1.DeploymentStrategyType {
+
+	if verifyaccess.Spec.RestartPolicy == ibmv1.RestartRecreate {
+		return appsv1.RecreateDeploymentStrategyType
+	}
+
+	return appsv1.RollingUpdateDeploymentStrategyType
+}
+
+/*****************************************************************************/
@@ -0,0 +1,74 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+import (
+	"testing"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+
+	ibmv1 "github.com/ibm-security/verify-access-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * Verify that the restart policy only allows the restarts which it permits,
+ * and that a restart which was deferred until the restart window opened is
+ * not checked against the policy again.
+ */
+
+func TestCheckRestartPolicy(t *testing.T) {
+	mgr := &SnapshotMgr{log: logr.Discard()}
+
+	deployment := &appsv1.Deployment{}
+	deployment.Spec.Template.Annotations = map[string]string{
+		snapshotDigestAnnotation: "current",
+	}
+
+	snapshot := "/snapshots/ivia.snapshot"
+	fixpack := "/fixpacks/test.fixpack"
+
+	tests := []struct {
+		name    string
+		policy  ibmv1.RestartPolicy
+		request restartRequest
+		allowed bool
+	}{
+		{"always", ibmv1.RestartAlways, restartRequest{path: snapshot}, true},
+		{"snapshot for fixpacks only", ibmv1.RestartFixpacksOnly,
+			restartRequest{path: snapshot}, false},
+		{"fixpack for fixpacks only", ibmv1.RestartFixpacksOnly,
+			restartRequest{path: fixpack}, true},
+		{"deferred for fixpacks only", ibmv1.RestartFixpacksOnly,
+			restartRequest{deferred: true}, true},
+		{"manual for fixpacks only", ibmv1.RestartFixpacksOnly,
+			restartRequest{manual: true}, true},
+		{"identical snapshot", ibmv1.RestartOnlyIfSnapshotChanged,
+			restartRequest{path: snapshot, digest: "current"}, false},
+		{"changed snapshot", ibmv1.RestartOnlyIfSnapshotChanged,
+			restartRequest{path: snapshot, digest: "changed"}, true},
+		{"deferred for manual", ibmv1.RestartManual,
+			restartRequest{deferred: true}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifyaccess := &ibmv1.IBMSecurityVerifyAccess{}
+			verifyaccess.Spec.RestartPolicy = test.policy
+
+			reason := mgr.checkRestartPolicy(test.request, deployment,
+				verifyaccess, nil)
+
+			if allowed := len(reason) == 0; allowed != test.allowed {
+				t.Errorf("allowed = %v, want %v: %s", allowed, test.allowed,
+					reason)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
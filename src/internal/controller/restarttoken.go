@@ -0,0 +1,142 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ibmv1 "github.com/ibm-security/verify-access-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to start a rolling restart of the
+ * deployment of a custom resource when the restart token of the custom
+ * resource, or the 'ibm.com/restart-requested-at' annotation, has changed.
+ * The restart is performed by a restart job, in exactly the same way as the
+ * restart which follows an upload, other than the AutoRestart field being
+ * ignored.  The token is recorded in the status of the custom resource once
+ * the job has been started.  A custom resource which is created with a
+ * restart token simply records the token, as its deployment is yet to be
+ * created.
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) reconcileRestartToken(
+	ctx context.Context,
+	m *ibmv1.IBMSecurityVerifyAccess) (ctrl.Result, error) {
+
+	token := m.Spec.RestartToken
+
+	if value := m.Annotations[restartRequestedAnnotation]; len(value) > 0 {
+		token = value
+	}
+
+	if len(token) == 0 || token == m.Status.LastRestartToken {
+		return ctrl.Result{}, nil
+	}
+
+	/*
+	 * If no token has been recorded, and the deployment of the custom
+	 * resource does not yet exist, the custom resource is being created and
+	 * the token is recorded without restarting anything.
+	 */
+
+	if len(m.Status.LastRestartToken) == 0 {
+		deployments := &appsv1.DeploymentList{}
+
+		err := r.List(ctx, deployments,
+			client.InNamespace(m.Namespace),
+			client.MatchingLabels{
+				"kind":            kindName,
+				"VerifyAccess_cr": m.Name,
+			})
+
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		if len(deployments.Items) == 0 {
+			r.Log.Info("Recording the restart token of a new resource",
+				"Deployment.Namespace", m.Namespace,
+				"Deployment.Name", m.Name,
+				"Token", token)
+
+			m.Status.LastRestartToken = token
+
+			return ctrl.Result{}, r.updateRestartTokenStatus(ctx, m)
+		}
+	}
+
+	job := r.snapshotMgr.startRestart(restartRequest{
+		namespace: m.Namespace,
+		name:      m.Name,
+		client:    restartTokenClient,
+		manual:    true,
+	})
+
+	if job == nil {
+		return ctrl.Result{RequeueAfter: restartPollInterval}, nil
+	}
+
+	r.Log.Info("Starting a requested restart",
+		"Deployment.Namespace", m.Namespace,
+		"Deployment.Name", m.Name,
+		"Token", token,
+		"Job", job.Id)
+
+	m.Status.LastRestartToken = token
+
+	/*
+	 * A restart which is pending, for example due to the Manual restart
+	 * policy, is performed by this restart.
+	 */
+
+	if apimeta.IsStatusConditionTrue(m.Status.Conditions,
+		restartPendingConditionType) {
+		apimeta.SetStatusCondition(&m.Status.Conditions, metav1.Condition{
+			Type:   restartPendingConditionType,
+			Status: metav1.ConditionFalse,
+			Reason: "RestartStarted",
+			Message: fmt.Sprintf("The pending restart was started by job %s.",
+				job.Id),
+		})
+	}
+
+	return ctrl.Result{}, r.updateRestartTokenStatus(ctx, m)
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to save the status of a custom resource
+ * once its restart token has been recorded.
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) updateRestartTokenStatus(
+	ctx context.Context,
+	m *ibmv1.IBMSecurityVerifyAccess) (err error) {
+
+	err = r.Status().Update(ctx, m)
+
+	if err != nil {
+		r.Log.Error(err, "Failed to update the status for the resource",
+			"Deployment.Namespace", m.Namespace,
+			"Deployment.Name", m.Name)
+	}
+
+	return
+}
+
+/*****************************************************************************/
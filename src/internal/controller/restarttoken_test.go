@@ -0,0 +1,89 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	ibmv1 "github.com/ibm-security/verify-access-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * Verify that a custom resource which is created with a restart token
+ * records the token, rather than starting a restart of a deployment which
+ * does not yet exist.
+ */
+
+func TestReconcileRestartTokenOnCreation(t *testing.T) {
+	scheme := newTestScheme(t)
+
+	tests := []struct {
+		name        string
+		token       string
+		annotations map[string]string
+		want        string
+	}{
+		{"restart token", "initial", nil, "initial"},
+		{"restart annotation", "",
+			map[string]string{restartRequestedAnnotation: "now"}, "now"},
+		{"no restart token", "", nil, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifyaccess := &ibmv1.IBMSecurityVerifyAccess{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "default",
+					Name:        "wrp",
+					Annotations: test.annotations,
+				},
+				Spec: ibmv1.IBMSecurityVerifyAccessSpec{
+					RestartToken: test.token,
+				},
+			}
+
+			/*
+			 * The snapshot manager is not initialised, and so any attempt to
+			 * start a restart job would panic.
+			 */
+
+			r := &IBMSecurityVerifyAccessReconciler{
+				Client: fake.NewClientBuilder().
+					WithScheme(scheme).
+					WithObjects(verifyaccess).
+					WithStatusSubresource(verifyaccess).
+					Build(),
+				Log: logr.Discard(),
+			}
+
+			if _, err := r.reconcileRestartToken(context.Background(),
+				verifyaccess); err != nil {
+				t.Fatal(err)
+			}
+
+			saved := &ibmv1.IBMSecurityVerifyAccess{}
+
+			if err := r.Get(context.Background(),
+				client.ObjectKeyFromObject(verifyaccess), saved); err != nil {
+				t.Fatal(err)
+			}
+
+			if saved.Status.LastRestartToken != test.want {
+				t.Errorf("LastRestartToken = %q, want %q",
+					saved.Status.LastRestartToken, test.want)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
@@ -0,0 +1,239 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ibmv1 "github.com/ibm-security/verify-access-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * A custom resource can define a restart window, which is a maintenance
+ * window in which the deployment of the custom resource can be restarted.
+ * A restart which is requested outside of the window is deferred: the
+ * RestartPending condition of the custom resource is set, and the custom
+ * resource is requeued for when the window next opens, at which point a
+ * restart job is started for the custom resource.
+ */
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the time at which the restart window next
+ * opens.  The supplied time is returned if the window is currently open, or
+ * if there is no restart window.
+ */
+
+func nextRestartWindow(window *ibmv1.IBMSecurityVerifyAccessRestartWindow,
+	now time.Time) (opens time.Time, err error) {
+
+	if window == nil {
+		return now, nil
+	}
+
+	schedule, err := parseCronSchedule(window.Schedule)
+
+	if err != nil {
+		return
+	}
+
+	loc := time.UTC
+
+	if len(window.TimeZone) > 0 {
+		loc, err = time.LoadLocation(window.TimeZone)
+
+		if err != nil {
+			return
+		}
+	}
+
+	if window.Duration.Duration <= 0 {
+		return opens, errors.New("The duration of the restart window must " +
+			"be greater than 0")
+	}
+
+	/*
+	 * The window is open if it last opened within the duration of the
+	 * window.
+	 */
+
+	opens = schedule.next(now.In(loc).Add(-window.Duration.Duration))
+
+	if opens.IsZero() {
+		return opens, fmt.Errorf("The schedule, %s, never opens the restart "+
+			"window", window.Schedule)
+	}
+
+	if !opens.After(now) {
+		opens = now
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to determine whether the deployment of the supplied
+ * custom resource can be restarted now.  If the restart window is closed the
+ * restart is deferred by setting the RestartPending condition of the custom
+ * resource, and a reason which explains why the deployment has not been
+ * restarted is returned.
+ */
+
+func (mgr *SnapshotMgr) checkRestartWindow(
+	request restartRequest,
+	verifyaccess *ibmv1.IBMSecurityVerifyAccess,
+	rtClient client.Client) (reason string) {
+
+	now := time.Now()
+
+	opens, err := nextRestartWindow(verifyaccess.Spec.RestartWindow, now)
+
+	if err != nil {
+		return fmt.Sprintf("The restart window is not valid: %v", err)
+	}
+
+	if !opens.After(now) {
+		return ""
+	}
+
+	reason = fmt.Sprintf("The restart has been deferred until the restart "+
+		"window opens at %s", opens.Format(time.RFC3339))
+
+	mgr.log.Info("Deferring the restart of the deployment",
+		"CustomResource.Namespace", verifyaccess.Namespace,
+		"CustomResource.Name", verifyaccess.Name,
+		"Opens", opens)
+
+	mgr.updateConditions(rtClient, verifyaccess.Namespace, verifyaccess.Name,
+		func(conditions *[]metav1.Condition) {
+			apimeta.SetStatusCondition(conditions, metav1.Condition{
+				Type:   restartPendingConditionType,
+				Status: metav1.ConditionTrue,
+				Reason: "OutsideRestartWindow",
+				Message: fmt.Sprintf("A restart, requested by %s, has been "+
+					"deferred until the restart window opens at %s.",
+					request.client, opens.Format(time.RFC3339)),
+			})
+		})
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to start a restart which has been
+ * deferred until the restart window of the custom resource opens.  The
+ * custom resource is requeued for when the window opens.
+ */
+
+func (r *IBMSecurityVerifyAccessReconciler) reconcileRestartWindow(
+	ctx context.Context,
+	m *ibmv1.IBMSecurityVerifyAccess) (ctrl.Result, error) {
+
+	/*
+	 * Only a restart which has been deferred by the restart window is
+	 * started, and not one which is pending due to the restart policy.
+	 */
+
+	pending := apimeta.FindStatusCondition(m.Status.Conditions,
+		restartPendingConditionType)
+
+	if pending == nil || pending.Status != metav1.ConditionTrue ||
+		pending.Reason != "OutsideRestartWindow" {
+		return ctrl.Result{}, nil
+	}
+
+	now := time.Now()
+
+	opens, err := nextRestartWindow(m.Spec.RestartWindow, now)
+
+	if err != nil {
+		r.Log.Error(err, "The restart window is not valid",
+			"Deployment.Namespace", m.Namespace,
+			"Deployment.Name", m.Name)
+
+		return ctrl.Result{}, nil
+	}
+
+	if opens.After(now) {
+		return ctrl.Result{RequeueAfter: opens.Sub(now)}, nil
+	}
+
+	/*
+	 * The window is open, and so the deployment of the custom resource is
+	 * restarted.  The deferred restart has already been allowed by the
+	 * restart policy, and so the policy is not checked again.
+	 */
+
+	job := r.snapshotMgr.startRestart(restartRequest{
+		namespace: m.Namespace,
+		name:      m.Name,
+		client:    restartWindowClient,
+		deferred:  true,
+	})
+
+	if job == nil {
+		return ctrl.Result{RequeueAfter: restartPollInterval}, nil
+	}
+
+	r.Log.Info("Starting a deferred restart",
+		"Deployment.Namespace", m.Namespace,
+		"Deployment.Name", m.Name,
+		"Job", job.Id)
+
+	apimeta.SetStatusCondition(&m.Status.Conditions, metav1.Condition{
+		Type:    restartPendingConditionType,
+		Status:  metav1.ConditionFalse,
+		Reason:  "RestartStarted",
+		Message: fmt.Sprintf("The deferred restart was started by job %s.", job.Id),
+	})
+
+	err = r.Status().Update(ctx, m)
+
+	if err != nil {
+		r.Log.Error(err, "Failed to update the status for the resource",
+			"Deployment.Namespace", m.Namespace,
+			"Deployment.Name", m.Name)
+	}
+
+	return ctrl.Result{}, err
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to combine the results of reconciling
+ * different parts of a custom resource, so that the custom resource is
+ * requeued at the earliest requested time.
+ */
+
+func earliestResult(results ...ctrl.Result) (result ctrl.Result) {
+	for _, next := range results {
+		if next.RequeueAfter > 0 && (result.RequeueAfter == 0 ||
+			next.RequeueAfter < result.RequeueAfter) {
+			result.RequeueAfter = next.RequeueAfter
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
@@ -0,0 +1,412 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+/*****************************************************************************/
+
+/*
+ * The S3Options structure contains the options which are used to connect to
+ * an S3 compatible object store.
+ */
+
+type S3Options struct {
+	// The URL of the object store, for example 'http://minio:9000'.  The AWS
+	// endpoint for the region is used if no endpoint is specified.
+	Endpoint string
+
+	// The region of the bucket.
+	Region string
+
+	// The name of the bucket.
+	Bucket string
+
+	// An optional prefix which is added to the name of each object.
+	Prefix string
+
+	// Address the bucket as part of the path of the URL, rather than as part
+	// of the host name.  This is usually required by MinIO.
+	PathStyle bool
+
+	// The file which contains the CA certificates which are used to verify
+	// the certificate of the object store.
+	CAFile string
+
+	// The credentials which are used to access the object store.
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+/*****************************************************************************/
+
+/*
+ * The s3Store structure is a snapshot store which keeps the files in an S3
+ * compatible object store, using the MinIO client.  The metadata of each
+ * file is kept as user metadata of the object.
+ */
+
+type s3Store struct {
+	options S3Options
+	client  *minio.Client
+	log     logr.Logger
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to create a new S3 snapshot store.
+ */
+
+func newS3Store(options S3Options, log logr.Logger) (
+	store *s3Store, err error) {
+
+	if len(options.Bucket) == 0 {
+		err = fmt.Errorf("A bucket must be specified for the S3 snapshot store")
+
+		return
+	}
+
+	if len(options.Region) == 0 {
+		options.Region = s3DefaultRegion
+	}
+
+	if len(options.Endpoint) == 0 {
+		options.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com",
+			options.Region)
+	}
+
+	endpoint, err := url.Parse(options.Endpoint)
+
+	if err != nil {
+		return
+	}
+
+	if (endpoint.Scheme != "http" && endpoint.Scheme != "https") ||
+		strings.Trim(endpoint.Path, "/") != "" {
+		err = fmt.Errorf("The endpoint of the S3 snapshot store, %s, must be "+
+			"an http or https URL without a path", options.Endpoint)
+
+		return
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if len(options.CAFile) > 0 {
+		var pem []byte
+
+		pem, err = os.ReadFile(options.CAFile)
+
+		if err != nil {
+			return
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(pem) {
+			err = fmt.Errorf("The CA file, %s, does not contain any "+
+				"certificates", options.CAFile)
+
+			return
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	lookup := minio.BucketLookupDNS
+
+	if options.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds: credentials.NewStaticV4(options.AccessKey, options.SecretKey,
+			options.SessionToken),
+		Secure:       endpoint.Scheme == "https",
+		Region:       options.Region,
+		BucketLookup: lookup,
+		Transport:    transport,
+	})
+
+	if err != nil {
+		return
+	}
+
+	store = &s3Store{
+		options: options,
+		client:  client,
+		log:     log,
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the key of the object which holds the
+ * specified file.
+ */
+
+func (s *s3Store) key(name string) string {
+	return strings.TrimPrefix(path.Join(s.options.Prefix, name), "/")
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to convert an error which is returned by the MinIO
+ * client into an error which wraps os.ErrNotExist for a '404 Not Found'
+ * response.
+ */
+
+func s3ResponseError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	rsp := minio.ToErrorResponse(err)
+
+	if rsp.StatusCode == http.StatusNotFound || rsp.Code == "NoSuchKey" ||
+		rsp.Code == "NoSuchBucket" {
+		err = fmt.Errorf("%w: %w", os.ErrNotExist, err)
+	}
+
+	return err
+}
+
+/*****************************************************************************/
+
+/*
+ * The following functions are used to convert the metadata of a file to and
+ * from the user metadata of an object.
+ */
+
+func s3EncodeMetadata(metadata *fileMetadata) string {
+	data, _ := json.Marshal(metadata)
+
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func s3DecodeMetadata(name string, info minio.ObjectInfo) *fileMetadata {
+	metadata := &fileMetadata{}
+
+	data, err := base64.StdEncoding.DecodeString(
+		info.UserMetadata[s3MetadataKey])
+
+	if err == nil {
+		json.Unmarshal(data, metadata)
+	}
+
+	metadata.Name = path.Base(name)
+
+	if metadata.Size == 0 {
+		metadata.Size = info.Size
+	}
+
+	if metadata.LastModified.IsZero() {
+		metadata.LastModified = info.LastModified
+	}
+
+	return metadata
+}
+
+/*****************************************************************************/
+
+/*
+ * The bucket is created if it does not already exist.
+ */
+
+func (s *s3Store) Initialize(ctx context.Context) (err error) {
+	exists, err := s.client.BucketExists(ctx, s.options.Bucket)
+
+	if err != nil || exists {
+		return
+	}
+
+	s.log.Info("Creating the bucket", "Bucket", s.options.Bucket)
+
+	err = s.client.MakeBucket(ctx, s.options.Bucket,
+		minio.MakeBucketOptions{Region: s.options.Region})
+
+	return
+}
+
+/*****************************************************************************/
+
+func (s *s3Store) Stat(
+	ctx context.Context, name string) (metadata *fileMetadata, err error) {
+
+	info, err := s.client.StatObject(ctx, s.options.Bucket, s.key(name),
+		minio.StatObjectOptions{})
+
+	if err != nil {
+		return nil, s3ResponseError(err)
+	}
+
+	metadata = s3DecodeMetadata(name, info)
+
+	return
+}
+
+/*****************************************************************************/
+
+func (s *s3Store) Get(ctx context.Context, name string) (
+	reader io.ReadCloser, metadata *fileMetadata, err error) {
+
+	object, err := s.client.GetObject(ctx, s.options.Bucket, s.key(name),
+		minio.GetObjectOptions{})
+
+	if err != nil {
+		return nil, nil, s3ResponseError(err)
+	}
+
+	info, err := object.Stat()
+
+	if err != nil {
+		object.Close()
+
+		return nil, nil, s3ResponseError(err)
+	}
+
+	reader = object
+	metadata = s3DecodeMetadata(name, info)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The digest of the file has already been calculated, and so this is sent
+ * as the SHA-256 checksum of the object.  The object store will reject the
+ * upload if the content does not match.  The checksum covers the whole
+ * object, and so the object is always uploaded in a single request.
+ */
+
+func (s *s3Store) Put(ctx context.Context, name string, stagedFile string,
+	metadata *fileMetadata) (err error) {
+
+	digest, err := hex.DecodeString(metadata.Digest)
+
+	if err != nil {
+		return
+	}
+
+	file, err := os.Open(stagedFile)
+
+	if err != nil {
+		return
+	}
+
+	defer file.Close()
+
+	metadata.LastModified = time.Now().UTC()
+
+	_, err = s.client.PutObject(ctx, s.options.Bucket, s.key(name), file,
+		metadata.Size, minio.PutObjectOptions{
+			ContentType: "application/octet-stream",
+			UserMetadata: map[string]string{
+				s3MetadataKey:           s3EncodeMetadata(metadata),
+				"X-Amz-Checksum-Sha256": base64.StdEncoding.EncodeToString(digest),
+			},
+			DisableMultipart:     true,
+			DisableContentSha256: true,
+		})
+
+	return s3ResponseError(err)
+}
+
+/*****************************************************************************/
+
+/*
+ * The object is copied within the object store.  The user metadata of the
+ * object is copied along with the object.
+ */
+
+func (s *s3Store) Copy(
+	ctx context.Context, srcName string, dstName string) (err error) {
+
+	_, err = s.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: s.options.Bucket, Object: s.key(dstName)},
+		minio.CopySrcOptions{Bucket: s.options.Bucket, Object: s.key(srcName)})
+
+	return s3ResponseError(err)
+}
+
+/*****************************************************************************/
+
+func (s *s3Store) List(
+	ctx context.Context, dir string) (files []*fileMetadata, err error) {
+
+	files = []*fileMetadata{}
+
+	objects := s.client.ListObjects(ctx, s.options.Bucket,
+		minio.ListObjectsOptions{Prefix: s.key(dir) + "/"})
+
+	for object := range objects {
+		if object.Err != nil {
+			return nil, s3ResponseError(object.Err)
+		}
+
+		base := path.Base(object.Key)
+
+		if strings.HasSuffix(object.Key, "/") || strings.HasPrefix(base, ".") {
+			continue
+		}
+
+		metadata, serr := s.Stat(ctx, path.Join(dir, base))
+
+		if serr == nil {
+			files = append(files, metadata)
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The object store doesn't report whether a deleted object existed, and so
+ * we first check that the object exists.
+ */
+
+func (s *s3Store) Delete(ctx context.Context, name string) (err error) {
+	_, err = s.Stat(ctx, name)
+
+	if err != nil {
+		return
+	}
+
+	err = s.client.RemoveObject(ctx, s.options.Bucket, s.key(name),
+		minio.RemoveObjectOptions{})
+
+	return s3ResponseError(err)
+}
+
+/*****************************************************************************/
@@ -0,0 +1,430 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+/*****************************************************************************/
+
+/*
+ * The fakeS3 structure is a minimal, in-memory, implementation of the parts
+ * of the S3 API which are used by the S3 snapshot store.  The list results
+ * are returned a page at a time, so that paging can be tested.
+ */
+
+type fakeS3Object struct {
+	data     []byte
+	metadata string
+}
+
+type fakeS3 struct {
+	bucket   string
+	pageSize int
+	created  bool
+	objects  map[string]fakeS3Object
+	mutex    sync.Mutex
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		http.Error(w, "the request is not signed", http.StatusForbidden)
+
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	digest := sha256.Sum256(body)
+
+	if checksum := r.Header.Get("X-Amz-Checksum-Sha256"); len(checksum) > 0 &&
+		checksum != base64.StdEncoding.EncodeToString(digest[:]) {
+		http.Error(w, "<Error><Code>BadDigest</Code></Error>",
+			http.StatusBadRequest)
+
+		return
+	}
+
+	prefix := "/" + f.bucket
+
+	if r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/") {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>",
+			http.StatusNotFound)
+
+		return
+	}
+
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+
+	if len(key) == 0 {
+		f.serveBucket(w, r)
+
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if source := r.Header.Get("X-Amz-Copy-Source"); len(source) > 0 {
+			source, _ = url.PathUnescape(source)
+			source = strings.TrimPrefix(source, "/")
+
+			object, ok := f.objects[strings.TrimPrefix(source, f.bucket+"/")]
+
+			if !ok {
+				http.Error(w, "<Error><Code>NoSuchKey</Code></Error>",
+					http.StatusNotFound)
+
+				return
+			}
+
+			f.objects[key] = object
+
+			fmt.Fprint(w, "<CopyObjectResult></CopyObjectResult>")
+
+			return
+		}
+
+		f.objects[key] = fakeS3Object{
+			data:     body,
+			metadata: r.Header.Get("X-Amz-Meta-" + s3MetadataKey),
+		}
+
+	case http.MethodGet, http.MethodHead:
+		object, ok := f.objects[key]
+
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>",
+				http.StatusNotFound)
+
+			return
+		}
+
+		digest := sha256.Sum256(object.data)
+
+		w.Header().Set("X-Amz-Meta-"+s3MetadataKey, object.metadata)
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		w.Header().Set("ETag", "\""+hex.EncodeToString(digest[:16])+"\"")
+		w.Header().Set("Last-Modified", time.Unix(0, 0).UTC().Format(
+			http.TimeFormat))
+
+		if r.Method == http.MethodGet {
+			w.Write(object.data)
+		}
+
+	case http.MethodDelete:
+		delete(f.objects, key)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) serveBucket(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodHead:
+		if !f.created {
+			w.WriteHeader(http.StatusNotFound)
+		}
+
+	case http.MethodPut:
+		f.created = true
+
+	case http.MethodGet:
+		query := r.URL.Query()
+		prefix := query.Get("prefix")
+
+		var keys []string
+
+		for key := range f.objects {
+			rest, found := strings.CutPrefix(key, prefix)
+
+			if found && !strings.Contains(rest, "/") {
+				keys = append(keys, key)
+			}
+		}
+
+		sort.Strings(keys)
+
+		start, _ := strconv.Atoi(query.Get("continuation-token"))
+		end := min(start+f.pageSize, len(keys))
+
+		type contents struct {
+			Key string `xml:"Key"`
+		}
+
+		result := struct {
+			XMLName               xml.Name   `xml:"ListBucketResult"`
+			Contents              []contents `xml:"Contents"`
+			IsTruncated           bool       `xml:"IsTruncated"`
+			NextContinuationToken string     `xml:"NextContinuationToken,omitempty"`
+		}{}
+
+		for _, key := range keys[start:end] {
+			result.Contents = append(result.Contents, contents{key})
+		}
+
+		if end < len(keys) {
+			result.IsTruncated = true
+			result.NextContinuationToken = strconv.Itoa(end)
+		}
+
+		xml.NewEncoder(w).Encode(result)
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to stage a file with the supplied content, returning
+ * the name of the file along with its metadata.
+ */
+
+func stageTestFile(t *testing.T, content string) (string, *fileMetadata) {
+	name := filepath.Join(t.TempDir(), "staged")
+
+	if err := os.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256([]byte(content))
+
+	return name, &fileMetadata{
+		Size:   int64(len(content)),
+		Digest: hex.EncodeToString(digest[:]),
+		Client: "test",
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to exercise each of the operations of the supplied
+ * S3 snapshot store.
+ */
+
+func exerciseS3Store(t *testing.T, store *s3Store, files int) {
+	ctx := context.Background()
+
+	if err := store.Initialize(ctx); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	/*
+	 * Store the files, along with a hidden file which must not be listed.
+	 */
+
+	for idx := 0; idx < files; idx++ {
+		staged, metadata := stageTestFile(t, fmt.Sprintf("content %d", idx))
+
+		metadata.Revision = idx + 1
+
+		err := store.Put(ctx, fmt.Sprintf("snapshots/file%02d", idx), staged,
+			metadata)
+
+		if err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	staged, metadata := stageTestFile(t, "hidden")
+
+	if err := store.Put(ctx, "snapshots/.hidden", staged, metadata); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	/*
+	 * Retrieve a file, and its metadata.
+	 */
+
+	reader, metadata, err := store.Get(ctx, "snapshots/file01")
+
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+
+	if string(data) != "content 1" || metadata.Revision != 2 ||
+		metadata.Client != "test" || metadata.Name != "file01" {
+		t.Errorf("Get returned %q, %+v", data, metadata)
+	}
+
+	/*
+	 * Copy a file, and check that the metadata has been copied.
+	 */
+
+	if err = store.Copy(ctx, "snapshots/file01", "history/copy"); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+
+	metadata, err = store.Stat(ctx, "history/copy")
+
+	if err != nil || metadata.Revision != 2 || metadata.Size != 9 {
+		t.Errorf("Stat of the copy returned %+v, %v", metadata, err)
+	}
+
+	/*
+	 * List the files, which requires more than one page.
+	 */
+
+	listed, err := store.List(ctx, "snapshots")
+
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+
+	if len(listed) != files {
+		t.Errorf("List returned %d files, want %d", len(listed), files)
+	}
+
+	/*
+	 * Delete a file, which must then not exist.
+	 */
+
+	if err = store.Delete(ctx, "snapshots/file00"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	if _, err = store.Stat(ctx, "snapshots/file00"); !errors.Is(err,
+		os.ErrNotExist) {
+		t.Errorf("Stat of a deleted file returned %v", err)
+	}
+
+	if err = store.Delete(ctx, "snapshots/file00"); !errors.Is(err,
+		os.ErrNotExist) {
+		t.Errorf("Delete of a deleted file returned %v", err)
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to check that the supplied S3 snapshot store
+ * rejects content which does not match the digest of the file.
+ */
+
+func putCorruptS3File(t *testing.T, store *s3Store) {
+	staged, metadata := stageTestFile(t, "content")
+
+	metadata.Digest = hex.EncodeToString(bytes.Repeat([]byte{0}, 32))
+
+	if err := store.Put(context.Background(), "snapshots/corrupt", staged,
+		metadata); err == nil {
+		t.Errorf("Put of corrupt content succeeded")
+	}
+
+	if _, err := store.Stat(context.Background(),
+		"snapshots/corrupt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat of corrupt content returned %v", err)
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify the S3 snapshot store against an in-memory S3 server.
+ */
+
+func TestS3Store(t *testing.T) {
+	fake := &fakeS3{
+		bucket:   "snapshots",
+		pageSize: 2,
+		objects:  make(map[string]fakeS3Object),
+	}
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	store, err := newS3Store(S3Options{
+		Endpoint:  server.URL,
+		Bucket:    "snapshots",
+		Prefix:    "operator",
+		PathStyle: true,
+		AccessKey: "access",
+		SecretKey: "secret",
+	}, logr.Discard())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exerciseS3Store(t, store, 5)
+
+	if !fake.created {
+		t.Errorf("the bucket was not created")
+	}
+
+	putCorruptS3File(t, store)
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify the S3 snapshot store against a real object store, such as MinIO.
+ * This test is only run if the S3_TEST_ENDPOINT environment variable is
+ * set, for example:
+ *
+ *   docker run -d -p 9000:9000 minio/minio server /data
+ *   S3_TEST_ENDPOINT=http://localhost:9000 S3_TEST_ACCESS_KEY=minioadmin \
+ *     S3_TEST_SECRET_KEY=minioadmin go test -run TestS3StoreEndpoint ./...
+ */
+
+func TestS3StoreEndpoint(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+
+	if len(endpoint) == 0 {
+		t.Skip("S3_TEST_ENDPOINT is not set")
+	}
+
+	bucket := os.Getenv("S3_TEST_BUCKET")
+
+	if len(bucket) == 0 {
+		bucket = "verify-access-operator-test"
+	}
+
+	store, err := newS3Store(S3Options{
+		Endpoint:  endpoint,
+		Region:    os.Getenv("S3_TEST_REGION"),
+		Bucket:    bucket,
+		Prefix:    fmt.Sprintf("test-%d", time.Now().UnixNano()),
+		PathStyle: true,
+		AccessKey: os.Getenv("S3_TEST_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_TEST_SECRET_KEY"),
+	}, logr.Discard())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exerciseS3Store(t, store, 3)
+
+	putCorruptS3File(t, store)
+}
+
+/*****************************************************************************/
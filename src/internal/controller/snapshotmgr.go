@@ -7,23 +7,21 @@ package controllers
 /*****************************************************************************/
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
-	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
-	"crypto/x509"
-	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"math/big"
-	"net"
 	"net/http"
+	"net/http/httputil"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -39,8 +37,11 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 
+	appsv1 "k8s.io/api/apps/v1"
 	apiV1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	appsV1 "k8s.io/client-go/kubernetes/typed/apps/v1"
 	coreV1 "k8s.io/client-go/kubernetes/typed/core/v1"
@@ -51,86 +52,186 @@ import (
 /*****************************************************************************/
 
 type SnapshotMgr struct {
-	config *rest.Config
-	scheme *runtime.Scheme
+	config  *rest.Config
+	scheme  *runtime.Scheme
+	options SnapshotMgrOptions
 
 	log logr.Logger
 
-	server *http.Server
-	creds  map[string]string
+	server      *http.Server
+	namespace   string
+	creds       map[string]string
+	certificate *tls.Certificate
+	store       SnapshotStore
+
+	podName     string
+	elected     <-chan struct{}
+	proxy       *httputil.ReverseProxy
+	proxyExpiry time.Time
+
+	jobs     map[string]*restartJob
+	recorder record.EventRecorder
 
 	restartMutex *sync.Mutex
 	webMutex     *sync.RWMutex
+	credsMutex   *sync.RWMutex
+	leaderMutex  *sync.Mutex
+	jobsMutex    *sync.Mutex
+	reviewMutex  *sync.Mutex
+	saveMutex    *sync.Mutex
+
+	coalesced     map[string]*coalescedRestart
+	coalesceMutex *sync.Mutex
 }
 
 /*****************************************************************************/
 
 /*
- * This function is used to trigger a rolling restart of our deployments.  This
- * will occur whenever a new snapshot is uploaded.
+ * The following functions are used to access our credentials.  The
+ * credentials can be updated at any time (e.g. when a certificate is
+ * renewed) and so access to the credentials is protected by a mutex.
  */
 
-func (mgr *SnapshotMgr) rollingRestart(path string, modified string) {
+func (mgr *SnapshotMgr) getCred(name string) string {
+	mgr.credsMutex.RLock()
+	defer mgr.credsMutex.RUnlock()
 
-	mgr.log.V(9).Info("Entering a function", "Function", "rollingRestart")
+	return mgr.creds[name]
+}
 
-	/*
-	 * Work out the list of modified services.
-	 */
+func (mgr *SnapshotMgr) getCreds() map[string]string {
+	mgr.credsMutex.RLock()
+	defer mgr.credsMutex.RUnlock()
 
-	var services []string
+	creds := make(map[string]string, len(mgr.creds))
 
-	if len(modified) > 0 {
-		services = strings.Split(strings.Replace(modified, ":", "-", -1), ",")
+	for key, value := range mgr.creds {
+		creds[key] = value
 	}
 
-	/*
-	 * Grab a lock to ensure that we don't process multiple simultaneous
-	 * restarts.
-	 */
+	return creds
+}
 
-	mgr.restartMutex.Lock()
+func (mgr *SnapshotMgr) setCreds(updates map[string]string) {
+	mgr.credsMutex.Lock()
+	defer mgr.credsMutex.Unlock()
+
+	if mgr.creds == nil {
+		mgr.creds = make(map[string]string)
+	}
+
+	for key, value := range updates {
+		mgr.creds[key] = value
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to trigger a rolling restart of our deployments.  This
+ * will occur whenever a new snapshot is uploaded.  The restart is limited
+ * to the deployments in the supplied namespace, unless it is empty.  The
+ * restart is performed by a restart job, which is returned, in the
+ * background.
+ */
+
+func (mgr *SnapshotMgr) rollingRestart(path string, modified string,
+	namespace string, client string) *restartJob {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "rollingRestart")
+
+	request := restartRequest{
+		path:      path,
+		services:  modifiedServices(modified),
+		namespace: namespace,
+		client:    client,
+	}
 
 	/*
 	 * Work out the snapshot identifier, if a snapshot has been provided.
 	 */
 
-	snapshotId := ""
-
 	if strings.HasPrefix(path, "/snapshots/") {
 		snapshotName := filepath.Base(filepath.Clean(path))
 
-		/*
-		 * We now need to pull out the snapshot identifier from the
-		 * name of the snapshot.  The snapshot name is of the format:
-		 *    isva_<version>_<snapshotid>.snapshot
-		 */
-
-		parts := strings.Split(snapshotName, "_")
-
-		if len(parts) != 3 {
-			mgr.restartMutex.Unlock()
+		request.snapshotId = snapshotIdFromName(snapshotName)
 
+		if len(request.snapshotId) == 0 {
 			mgr.log.Info("No deployments will be restarted as the "+
 				"snapshot name is invalid", "Snapshot.Name", snapshotName)
 
-			return
+			return nil
 		}
 
-		parts = strings.Split(parts[2], ".")
+		mgr.log.V(5).Info("Processing a snapshot",
+			"Snapshot.Id", request.snapshotId)
+	}
 
-		if len(parts) != 2 {
-			mgr.restartMutex.Unlock()
+	return mgr.startRestart(request)
+}
 
-			mgr.log.Info("No deployments will be restarted as the "+
-				"snapshot name is invalid", "Snapshot.Name", snapshotName)
+/*****************************************************************************/
 
-			return
-		}
+/*
+ * This function is used to pull out the snapshot identifier from the name
+ * of a snapshot.  The snapshot name is of the format:
+ *    isva_<version>_<snapshotid>.snapshot
+ *
+ * An empty string is returned if the name is invalid.
+ */
 
-		snapshotId = parts[0]
+func snapshotIdFromName(snapshotName string) string {
+	parts := strings.Split(snapshotName, "_")
 
-		mgr.log.V(5).Info("Processing a snapshot", "Snapshot.Id", "snapshotId")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	parts = strings.Split(parts[2], ".")
+
+	if len(parts) != 2 {
+		return ""
+	}
+
+	return parts[0]
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to work out the list of services from the
+ * 'modified' argument of a request, for example 'wrp:default,runtime'.
+ */
+
+func modifiedServices(modified string) (services []string) {
+	if len(modified) > 0 {
+		services = strings.Split(strings.Replace(modified, ":", "-", -1), ",")
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to perform a rolling restart of the deployments
+ * which match the supplied request.  The outcome for each deployment is
+ * recorded in the supplied job.  The deployments are restarted in stages,
+ * as determined by the restart order and strategy.
+ */
+
+func (mgr *SnapshotMgr) restart(request restartRequest, job *restartJob) (
+	err error) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "restart")
+
+	selectors, err := request.selectors()
+
+	if err != nil {
+		mgr.log.Error(err, "No deployments will be restarted as the "+
+			"request is invalid")
+
+		return
 	}
 
 	/*
@@ -139,8 +240,6 @@ func (mgr *SnapshotMgr) rollingRestart(path string, modified string) {
 
 	appsV1Client, err := appsV1.NewForConfig(mgr.config)
 	if err != nil {
-		mgr.restartMutex.Unlock()
-
 		mgr.log.Error(err, "Failed to create a new K8S Application client")
 
 		return
@@ -152,61 +251,154 @@ func (mgr *SnapshotMgr) rollingRestart(path string, modified string) {
 		})
 
 	if err != nil {
-		mgr.restartMutex.Unlock()
-
 		mgr.log.Error(err, "Failed to create a new controller runtime client")
 
 		return
 	}
 
 	/*
-	 * Restart the deployments.
+	 * Work out which deployments are to be restarted.
 	 */
 
-	if len(services) > 0 {
-		for _, service := range services {
-			mgr.restartDeployments(
-				path,
-				snapshotId,
-				fmt.Sprintf("kind=%s, service=%s", kindName, service),
-				appsV1Client,
-				rtClient)
-		}
-	} else {
-		mgr.restartDeployments(
-			path,
-			snapshotId,
-			fmt.Sprintf("kind=%s", kindName),
+	var deployments []appsv1.Deployment
+
+	for _, selector := range selectors {
+		selected, serr := mgr.selectDeployments(
+			request,
+			job,
+			selector,
 			appsV1Client,
 			rtClient)
+
+		if serr != nil {
+			return serr
+		}
+
+		deployments = append(deployments, selected...)
 	}
 
 	/*
-	 * Finished, so we can release our lock.
+	 * Coalesce the restart of each deployment with the restarts which are
+	 * requested by other jobs during the quiet period.  This job only
+	 * restarts the deployments which it owns, and waits for the other jobs
+	 * to restart the remaining deployments.
 	 */
 
-	mgr.restartMutex.Unlock()
+	deployments, followed := mgr.coalesceRestarts(request, job,
+		deployments)
+
+	defer mgr.abandonCoalesced(job, "The restart was not performed")
+
+	err = mgr.restartInStages(request, job, deployments, appsV1Client,
+		rtClient)
+
+	for _, done := range followed {
+		<-done
+	}
+
+	return
 }
 
 /*****************************************************************************/
 
 /*
- * This function is used to trigger a rolling restart of the specified
- * deployments.
+ * This function is used to restart the supplied deployments, one stage at a
+ * time.  Each stage, other than the last, must complete its rollout before
+ * the next stage is restarted.
  */
 
-func (mgr *SnapshotMgr) restartDeployments(
-	path string,
-	snapshotId string,
+func (mgr *SnapshotMgr) restartInStages(
+	request restartRequest,
+	job *restartJob,
+	deployments []appsv1.Deployment,
+	appsV1Client *appsV1.AppsV1Client,
+	rtClient client.Client) (err error) {
+
+	/*
+	 * Grab a lock to ensure that we don't process multiple simultaneous
+	 * restarts.
+	 */
+
+	mgr.restartMutex.Lock()
+	defer mgr.restartMutex.Unlock()
+
+	stages := mgr.restartStages(request, deployments)
+
+	for len(stages) > 0 {
+		stage := stages[0]
+		stages = stages[1:]
+
+		failed := job.failures()
+
+		for idx := range stage {
+			err = mgr.restartDeployment(request, job, &stage[idx],
+				appsV1Client, rtClient)
+
+			if err != nil {
+				return
+			}
+		}
+
+		if len(stages) == 0 {
+			break
+		}
+
+		/*
+		 * Wait for the stage to complete its rollout, and halt the restart
+		 * if any of the deployments in the stage failed.
+		 */
+
+		err = mgr.waitForRollout(job)
+
+		if err != nil {
+			return
+		}
+
+		if job.failures() > failed {
+			reason := "The restart was halted as a previous deployment " +
+				"failed to complete its rollout"
+
+			for _, remaining := range stages {
+				for _, deployment := range remaining {
+					job.skip(deployment.Namespace+"/"+deployment.Name, reason)
+				}
+			}
+
+			mgr.abandonCoalesced(job, reason)
+
+			err = errors.New("The restart was halted as a deployment " +
+				"failed to complete its rollout")
+
+			mgr.log.Error(err, "Halting the restart", "Job", job.Id)
+
+			return
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to select the deployments which match the supplied
+ * label selector, and which are to be restarted.  The outcome for each
+ * deployment which is not selected is recorded in the job, and an error is
+ * returned if the deployments could not be listed.
+ */
+
+func (mgr *SnapshotMgr) selectDeployments(
+	request restartRequest,
+	job *restartJob,
 	labels string,
 	appsV1Client *appsV1.AppsV1Client,
-	rtClient client.Client) {
+	rtClient client.Client) (selected []appsv1.Deployment, err error) {
 
 	/*
 	 * Retrieve the existing deployments for our operator.
 	 */
 
-	deployments, err := appsV1Client.Deployments("").List(
+	deployments, err := appsV1Client.Deployments(request.namespace).List(
 		context.TODO(),
 		metaV1.ListOptions{
 			LabelSelector: labels,
@@ -219,8 +411,8 @@ func (mgr *SnapshotMgr) restartDeployments(
 	}
 
 	/*
-	 * Now we need to iterate over each of the deployments, performing
-	 * a rolling restart of the deployment.
+	 * Now we need to iterate over each of the deployments, checking whether
+	 * the deployment is to be restarted.
 	 */
 
 	for _, deployment := range deployments.Items {
@@ -229,6 +421,10 @@ func (mgr *SnapshotMgr) restartDeployments(
 			"Deployment.Namespace", deployment.Namespace,
 			"Deployment.Name", deployment.Name)
 
+		key := deployment.Namespace + "/" + deployment.Name
+
+		job.match(key)
+
 		/*
 		 * Detect and retrieve the custom resource for this deployment.  The
 		 * name of the custom resource is contained in the VerifyAccess_cr
@@ -242,37 +438,47 @@ func (mgr *SnapshotMgr) restartDeployments(
 				"Deployment.Namespace", deployment.Namespace,
 				"Deployment.Name", deployment.Name)
 
+			job.skip(key, "The deployment does not have a VerifyAccess_cr label")
+
 			continue
 		}
 
 		verifyaccess := &ibmv1.IBMSecurityVerifyAccess{}
 
-		err = rtClient.Get(context.TODO(),
+		gerr := rtClient.Get(context.TODO(),
 			client.ObjectKey{
 				Namespace: deployment.Namespace,
 				Name:      crName,
 			},
 			verifyaccess)
 
-		if err != nil {
-			mgr.log.Error(err,
+		if gerr != nil {
+			mgr.log.Error(gerr,
 				"Failed to retrieve the IBMSecurityVerifyAccess resource",
 				"CustomResource.Name", crName)
 
+			job.fail(key, fmt.Sprintf("Failed to retrieve the "+
+				"IBMSecurityVerifyAccess resource, %s: %v", crName, gerr))
+
 			continue
 		}
 
 		/*
 		 * We don't bother to restart the deployment if the AutoRestart field
-		 * has been set to false.
+		 * has been set to false, unless the restart has been requested by
+		 * the restart token of the custom resource, or was deferred until
+		 * the restart window opened.
 		 */
 
-		if !verifyaccess.Spec.AutoRestart {
+		if !verifyaccess.Spec.AutoRestart && !request.manual &&
+			!request.deferred {
 			mgr.log.Info("Not performing an autorestart of the deployment as "+
 				"the AutoRestart field is set to false",
 				"Deployment.Namespace", deployment.Namespace,
 				"Deployment.Name", deployment.Name)
 
+			job.skip(key, "The AutoRestart field is set to false")
+
 			continue
 		}
 
@@ -281,14 +487,14 @@ func (mgr *SnapshotMgr) restartDeployments(
 		 * deployment.
 		 */
 
-		if strings.HasPrefix(path, "/fixpacks/") {
+		if strings.HasPrefix(request.path, "/fixpacks/") {
 			/*
 			 * A new fixpack has been supplied and so we only worry about
 			 * restarting the deployment if it is currently using this
 			 * fixpack.
 			 */
 
-			fixpackName := filepath.Base(filepath.Clean(path))
+			fixpackName := filepath.Base(filepath.Clean(request.path))
 
 			fixpackInUse := false
 
@@ -306,80 +512,490 @@ func (mgr *SnapshotMgr) restartDeployments(
 					"Deployment.Name", deployment.Name,
 					"Fixpack.Name", fixpackName)
 
+				job.skip(key, fmt.Sprintf("The fixpack, %s, is not used by "+
+					"the deployment", fixpackName))
+
 				continue
 			}
 
-		} else if strings.HasPrefix(path, "/snapshots/") {
+		} else if len(request.snapshotId) > 0 {
 			/*
-			 * A new snapshot has been uploaded.  We need to see if the
-			 * snapshot identifier for the deployment matches our supplied
-			 * snapshot identifier.
+			 * A new snapshot has been uploaded, or a snapshot identifier
+			 * has been requested.  We need to see if the snapshot
+			 * identifier for the deployment matches our supplied snapshot
+			 * identifier.
 			 */
 
-			if snapshotId != verifyaccess.Spec.SnapshotId {
+			snapshotId := activeSnapshotId(verifyaccess)
+
+			if request.snapshotId != snapshotId {
 				mgr.log.Info("Not performing an autorestart as the "+
 					"supplied snapshot is not used by the deployment",
 					"Deployment.Namespace", deployment.Namespace,
 					"Deployment.Name", deployment.Name,
-					"Deployment.Snapshot.Id", verifyaccess.Spec.SnapshotId,
-					"Snapshot.Id", snapshotId)
+					"Deployment.Snapshot.Id", snapshotId,
+					"Snapshot.Id", request.snapshotId)
+
+				job.skip(key, fmt.Sprintf("The deployment uses the %s "+
+					"snapshot rather than the %s snapshot", snapshotId,
+					request.snapshotId))
 
 				continue
 			}
 		}
 
 		/*
-		 * Determine the revision number of the deployment.  This is incremented
-		 * to trigger a rolling update.
+		 * Check whether the restart policy of the custom resource allows
+		 * the deployment to be restarted.
 		 */
 
-		mgr.log.Info("Performing a rolling restart of the deployment",
-			"Deployment.Namespace", deployment.Namespace,
+		if reason := mgr.checkRestartPolicy(request, &deployment, verifyaccess,
+			rtClient); len(reason) > 0 {
+			mgr.log.Info("Not performing an autorestart due to the restart "+
+				"policy of the deployment",
+				"Deployment.Namespace", deployment.Namespace,
+				"Deployment.Name", deployment.Name,
+				"RestartPolicy", verifyaccess.Spec.RestartPolicy)
+
+			job.skip(key, reason)
+
+			continue
+		}
+
+		/*
+		 * The restart is deferred if the restart window of the deployment
+		 * is closed.
+		 */
+
+		if reason := mgr.checkRestartWindow(request, verifyaccess,
+			rtClient); len(reason) > 0 {
+			job.skip(key, reason)
+
+			continue
+		}
+
+		/*
+		 * The strategy of the selected deployment is set to the strategy
+		 * which is required by the restart policy, and is applied when the
+		 * deployment is restarted.
+		 */
+
+		deployment.Spec.Strategy.Type = restartStrategyType(verifyaccess)
+
+		selected = append(selected, deployment)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to trigger a rolling restart of a single deployment
+ * by incrementing the revision annotation of the pod template.  The outcome
+ * is recorded in the job.  The restart window of the deployment is checked
+ * again, as the window may have closed while the restart waited for the
+ * quiet period or for a previous stage, in which case the restart is
+ * deferred.
+ */
+
+func (mgr *SnapshotMgr) restartDeployment(
+	request restartRequest,
+	job *restartJob,
+	deployment *appsv1.Deployment,
+	appsV1Client *appsV1.AppsV1Client,
+	rtClient client.Client) (err error) {
+
+	key := deployment.Namespace + "/" + deployment.Name
+
+	verifyaccess := &ibmv1.IBMSecurityVerifyAccess{}
+
+	err = rtClient.Get(context.TODO(),
+		client.ObjectKey{
+			Namespace: deployment.Namespace,
+			Name:      deployment.Labels["VerifyAccess_cr"],
+		},
+		verifyaccess)
+
+	if err != nil {
+		reason := fmt.Sprintf("Failed to retrieve the "+
+			"IBMSecurityVerifyAccess resource, %s: %v",
+			deployment.Labels["VerifyAccess_cr"], err)
+
+		job.fail(key, reason)
+
+		mgr.settleCoalesced(job, key, 0, "", reason)
+
+		return
+	}
+
+	if reason := mgr.checkRestartWindow(request, verifyaccess,
+		rtClient); len(reason) > 0 {
+		job.skip(key, reason)
+
+		mgr.settleCoalesced(job, key, 0, "", reason)
+
+		return
+	}
+
+	/*
+	 * Determine the revision number of the deployment.  This is incremented
+	 * to trigger a rolling update.
+	 */
+
+	mgr.log.Info("Performing a rolling restart of the deployment",
+		"Deployment.Namespace", deployment.Namespace,
+		"Deployment.Name", deployment.Name)
+
+	/*
+	 * The deployment is retrieved again, as it may have been restarted by
+	 * another job since it was selected.
+	 */
+
+	latest, err := appsV1Client.Deployments(deployment.Namespace).Get(
+		context.TODO(), deployment.Name, metaV1.GetOptions{})
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to retrieve the deployment",
 			"Deployment.Name", deployment.Name)
 
-		revision, err := strconv.Atoi(
-			deployment.Spec.Template.Annotations["revision"])
+		reason := fmt.Sprintf("Failed to retrieve the deployment: %v", err)
+
+		job.fail(key, reason)
+
+		mgr.settleCoalesced(job, key, 0, "", reason)
+
+		return
+	}
+
+	revision, err := strconv.Atoi(
+		latest.Spec.Template.Annotations["revision"])
+
+	if err != nil {
+		revision = 1
+	} else {
+		revision++
+	}
+
+	mgr.log.V(5).Info("New revision number", "Revision", revision)
+
+	/*
+	 * Patch the deployment descriptor with the incremented revision
+	 * number, and the digest of the most recent snapshot of the coalesced
+	 * restarts.  The strategy of the deployment is also patched if it
+	 * differs from the strategy which is required by the restart policy.
+	 */
+
+	annotations := map[string]string{
+		"revision": strconv.Itoa(revision),
+	}
+
+	if digest := mgr.coalescedDigest(job, key,
+		request.digest); len(digest) > 0 {
+		annotations[snapshotDigestAnnotation] = digest
+	}
+
+	spec := map[string]interface{}{
+		"template": map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": annotations,
+			},
+		},
+	}
+
+	if latest.Spec.Strategy.Type != deployment.Spec.Strategy.Type {
+		strategy := map[string]interface{}{
+			"type": deployment.Spec.Strategy.Type,
+		}
+
+		if deployment.Spec.Strategy.Type == appsv1.RecreateDeploymentStrategyType {
+			strategy["rollingUpdate"] = nil
+		}
+
+		spec["strategy"] = strategy
+	}
+
+	payloadBytes, err := json.Marshal(map[string]interface{}{"spec": spec})
+
+	if err != nil {
+		reason := fmt.Sprintf("Failed to create the patch: %v", err)
+
+		job.fail(key, reason)
+
+		mgr.settleCoalesced(job, key, 0, "", reason)
+
+		return
+	}
+
+	patched, err := appsV1Client.Deployments(deployment.Namespace).Patch(
+		context.TODO(),
+		deployment.Name,
+		types.StrategicMergePatchType,
+		payloadBytes,
+		metaV1.PatchOptions{})
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to update the deployment",
+			"Deployment.Name", deployment.Name)
+
+		reason := fmt.Sprintf("Failed to update the deployment: %v", err)
+
+		job.fail(key, reason)
+
+		mgr.settleCoalesced(job, key, 0, "", reason)
+
+		return
+	}
+
+	job.patch(key, patched.Generation, deployment.Labels["VerifyAccess_cr"])
+
+	mgr.settleCoalesced(job, key, patched.Generation,
+		deployment.Labels["VerifyAccess_cr"], "")
+
+	mgr.log.V(5).Info("Successfully updated the deployment")
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to save an uploaded file.  The file is first
+ * written to a temporary staging file, which is then flushed to disk and
+ * verified before it is passed to the snapshot store.  This ensures that a
+ * failed or slow upload never truncates the existing file, and that a
+ * partial file is never served.  The SHA-256 digest of the file is
+ * calculated as the file is written and, if an expected digest has been
+ * supplied, is checked before the file is committed.  The supplied metadata
+ * is completed and saved alongside the file.  A gated snapshot is refused
+ * unless it has been approved.
+ */
+
+func (mgr *SnapshotMgr) saveFile(
+	ctx context.Context,
+	name string,
+	src io.Reader,
+	expectedSize int64,
+	expectedDigest string,
+	metadata *fileMetadata) (err error) {
+
+	mgr.log.V(9).Info("Entering a function", "Function", "saveFile")
+
+	/*
+	 * A gated snapshot can only be published once it has been approved,
+	 * however it was supplied.
+	 */
+
+	if mgr.isGated(name) && metadata.Approval != approvalApproved {
+		err = fmt.Errorf("%w: %s", errNotApproved, name)
+
+		mgr.log.Error(err, "Refused to publish the file", "File", name)
+
+		return
+	}
+
+	/*
+	 * Create the staging file.  The staging file is always removed, as it
+	 * will either have been moved or copied by the store, or is no longer
+	 * required.
+	 */
 
+	dst, err := createStagedFile(name)
+
+	if err != nil {
+		mgr.log.V(5).Error(err, "Failed to create the file",
+			"File", name)
+
+		return
+	}
+
+	tmpName := dst.Name()
+
+	defer func() {
 		if err != nil {
-			revision = 1
-		} else {
-			revision++
+			dst.Close()
 		}
 
-		mgr.log.V(5).Info("New revision number", "Revision", revision)
+		os.Remove(tmpName)
+	}()
+
+	/*
+	 * Save the file, and make sure that it has been written to disk.
+	 */
+
+	hash := sha256.New()
+
+	size, err := io.Copy(io.MultiWriter(dst, hash), src)
+
+	if err != nil {
+		mgr.log.V(5).Error(err, "Failed to copy the file",
+			"File", name)
+
+		return
+	}
+
+	err = dst.Sync()
+
+	if err != nil {
+		mgr.log.V(5).Error(err, "Failed to sync the file",
+			"File", name)
+
+		return
+	}
+
+	err = dst.Close()
+
+	if err != nil {
+		mgr.log.V(5).Error(err, "Failed to close the file",
+			"File", name)
+
+		return
+	}
+
+	/*
+	 * Verify that we have received the complete file.
+	 */
+
+	if size == 0 || (expectedSize > 0 && size != expectedSize) {
+		err = fmt.Errorf("%w: received %d bytes, expected %d bytes",
+			errInvalidUpload, size, expectedSize)
+
+		mgr.log.V(5).Error(err, "Failed to verify the file",
+			"File", name)
+
+		return
+	}
+
+	digest := hex.EncodeToString(hash.Sum(nil))
+
+	if len(expectedDigest) > 0 && digest != expectedDigest {
+		err = fmt.Errorf("%w: the SHA-256 digest of the file, %s, does not "+
+			"match the expected digest, %s", errInvalidUpload, digest,
+			expectedDigest)
+
+		mgr.log.V(5).Error(err, "Failed to verify the file",
+			"File", name)
+
+		return
+	}
+
+	metadata.Name = path.Base(name)
+	metadata.Size = size
+	metadata.Digest = digest
+
+	/*
+	 * The files are saved one at a time, so that the revisions of a file
+	 * are stored in order.
+	 */
+
+	mgr.saveMutex.Lock()
+	defer mgr.saveMutex.Unlock()
+
+	metadata.Revision = mgr.nextRevision(ctx, name)
+
+	/*
+	 * The content is transferred to the store under a hidden name, without
+	 * holding the Web lock, as this can take some time for a remote store.
+	 * The existing file, along with its metadata, is then replaced by
+	 * copying the hidden file, which is cheap for each of the stores, while
+	 * holding the Web lock.
+	 */
+
+	stagingName := path.Join(path.Dir(name), path.Base(tmpName))
+
+	err = mgr.store.Put(ctx, stagingName, tmpName, metadata)
+
+	if err != nil {
+		mgr.log.V(5).Error(err, "Failed to store the file",
+			"File", name)
+
+		return
+	}
+
+	mgr.webMutex.Lock()
+	err = mgr.store.Copy(ctx, stagingName, name)
+	mgr.webMutex.Unlock()
+
+	if derr := mgr.store.Delete(ctx, stagingName); derr != nil {
+		mgr.log.Error(derr, "Failed to remove the staged file",
+			"File", stagingName)
+	}
+
+	if err != nil {
+		mgr.log.V(5).Error(err, "Failed to replace the file",
+			"File", name)
+
+		return
+	}
+
+	/*
+	 * Add the new file to the history of the file.
+	 */
+
+	mgr.addRevision(ctx, name, metadata.Revision)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the content of a file.  If the store
+ * supports seeking the ServeContent function will take care of constructing
+ * the response, including the handling of range requests.  Otherwise the
+ * content is simply copied to the response.
+ */
+
+func (mgr *SnapshotMgr) serveContent(
+	w http.ResponseWriter, r *http.Request, name string) {
+
+	mgr.webMutex.RLock()
+	reader, metadata, err := mgr.store.Get(r.Context(), name)
+	mgr.webMutex.RUnlock()
+
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+
+		return
+	} else if err != nil {
+		mgr.log.Error(err, "Failed to retrieve the file", "File", name)
+
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+
+		return
+	}
+
+	defer reader.Close()
 
-		/*
-		 * Patch the deployment descriptor with the incremented revision
-		 * number.
-		 */
+	/*
+	 * The ETag header allows the ServeContent function to honour the
+	 * If-None-Match header of the request.
+	 */
 
-		payloadBytes := fmt.Sprintf(
-			"{\"spec\":"+
-				"{\"template\":"+
-				"{\"metadata\":"+
-				"{\"annotations\":{"+
-				"\"revision\":\"%d\"}"+
-				"}"+
-				"}"+
-				"}"+
-				"}", revision)
-
-		_, err = appsV1Client.Deployments(deployment.Namespace).Patch(
-			context.TODO(),
-			deployment.Name,
-			types.StrategicMergePatchType,
-			[]byte(payloadBytes),
-			metaV1.PatchOptions{})
+	setDigestHeaders(w, metadata)
 
-		if err != nil {
-			mgr.log.Error(err, "Failed to update the deployment",
-				"Deployment.Name", deployment.Name)
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, metadata.Name, metadata.LastModified, seeker)
 
-			return
-		}
+		return
+	}
+
+	if match := r.Header.Get("If-None-Match"); len(match) > 0 &&
+		match == w.Header().Get("ETag") {
+		w.WriteHeader(http.StatusNotModified)
 
-		mgr.log.V(5).Info("Successfully updated the deployment")
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(metadata.Size, 10))
+	w.Header().Set("Last-Modified",
+		metadata.LastModified.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+
+	io.Copy(w, reader)
 }
 
 /*****************************************************************************/
@@ -400,9 +1016,29 @@ func (mgr *SnapshotMgr) serve(w http.ResponseWriter, r *http.Request) {
 
 	username, password, _ := r.BasicAuth()
 
-	authOk := mgr.creds[userFieldName] == username &&
-		(mgr.creds[rwPwdFieldName] == password ||
-			(r.Method == "GET" && mgr.creds[roPwdFieldName] == password))
+	authOk := mgr.getCred(userFieldName) == username &&
+		(mgr.getCred(rwPwdFieldName) == password ||
+			(r.Method == "GET" && mgr.getCred(roPwdFieldName) == password))
+
+	/*
+	 * A pending snapshot can only be approved, or rejected, with the
+	 * approver credentials, so that the principal which uploads a snapshot
+	 * cannot also approve it.
+	 */
+
+	if _, action := splitAction(r.URL.Path); action == approveAction ||
+		action == rejectAction {
+		if authOk {
+			http.Error(w, errNotApprover.Error(), http.StatusForbidden)
+
+			mgr.log.V(5).Info("A review was not made with the approver "+
+				"credentials", "Path", r.URL.Path)
+
+			return
+		}
+
+		authOk = mgr.isApprover(username, password)
+	}
 
 	if !authOk {
 		w.Header().Set("WWW-Authenticate",
@@ -420,32 +1056,45 @@ func (mgr *SnapshotMgr) serve(w http.ResponseWriter, r *http.Request) {
 	 * Validate the supplied path, and from this determine the name of the
 	 * file which will be used.  We need to ensure that we don't traverse
 	 * out of our data path.  The only valid directories are: '/fixpacks',
-	 * and '/snapshots'.
+	 * and '/snapshots'.  The path of a file can also be followed by an
+	 * action, which is either '/history' or '/rollback'.
 	 */
 
 	isValid := false
 	listFiles := false
 
-	if strings.HasPrefix(r.URL.Path, "/fixpacks/") {
-		basePath := filepath.Base(filepath.Clean(r.URL.Path))
+	urlPath, action := splitAction(r.URL.Path)
+
+	if strings.HasPrefix(urlPath, "/fixpacks/") {
+		basePath := filepath.Base(filepath.Clean(urlPath))
 
-		if r.URL.Path == "/fixpacks/"+basePath {
+		if urlPath == "/fixpacks/"+basePath &&
+			!strings.HasPrefix(basePath, ".") {
 			isValid = true
 		}
-	} else if strings.HasPrefix(r.URL.Path, "/snapshots/") {
-		basePath := filepath.Base(filepath.Clean(r.URL.Path))
+	} else if strings.HasPrefix(urlPath, "/snapshots/") {
+		basePath := filepath.Base(filepath.Clean(urlPath))
 		hasValidPrefix := (strings.HasPrefix(basePath, "ivia_") || strings.HasPrefix(basePath, "isva_"))
-		if r.URL.Path == "/snapshots/"+basePath &&
+		if urlPath == "/snapshots/"+basePath &&
 			hasValidPrefix &&
 			strings.HasSuffix(basePath, ".snapshot") {
 			isValid = true
 		}
-	} else if strings.HasPrefix(r.URL.Path, "/snapshots") &&
-		r.Method == "GET" {
+	} else if strings.HasPrefix(urlPath, "/snapshots") &&
+		r.Method == "GET" && len(action) == 0 {
 		//If we are making a get request to the snapshots base URI then we want to return a list
 		// of known snapshots
 		isValid = true
 		listFiles = true
+	} else if urlPath == "/restart" && len(action) == 0 {
+		isValid = true
+	} else if strings.HasPrefix(urlPath, "/jobs/") && len(action) == 0 {
+		basePath := filepath.Base(filepath.Clean(urlPath))
+
+		if urlPath == "/jobs/"+basePath &&
+			!strings.HasPrefix(basePath, ".") {
+			isValid = true
+		}
 	}
 
 	if !isValid {
@@ -458,7 +1107,18 @@ func (mgr *SnapshotMgr) serve(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fileName := filepath.Join(dataRoot, r.URL.Path)
+	name := storeName(urlPath)
+
+	/*
+	 * Forward the request to the leader if this replica is unable to
+	 * process the request.
+	 */
+
+	if mgr.needsForwarding(r) {
+		mgr.forwardToLeader(w, r)
+
+		return
+	}
 
 	/*
 	 * Work out the client of the request.
@@ -478,6 +1138,30 @@ func (mgr *SnapshotMgr) serve(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	/*
+	 * Explicit restart requests, requests for the progress of a restart
+	 * job, and requests for the history of a file, or to roll back a file,
+	 * are handled separately.
+	 */
+
+	if urlPath == "/restart" {
+		mgr.serveRestart(w, r, client)
+
+		return
+	}
+
+	if strings.HasPrefix(urlPath, "/jobs/") {
+		mgr.serveJob(w, r, filepath.Base(urlPath))
+
+		return
+	}
+
+	if len(action) > 0 {
+		mgr.serveAction(w, r, action, urlPath, client)
+
+		return
+	}
+
 	/*
 	 * Process the request based on the specified method.
 	 */
@@ -492,31 +1176,34 @@ func (mgr *SnapshotMgr) serve(w http.ResponseWriter, r *http.Request) {
 		mgr.log.Info("Processing a GET", "Path", r.URL.Path, "Client", client)
 		if listFiles == true {
 			mgr.webMutex.RLock()
-			fp, err := os.Open(fileName)
-			if err != nil {
-				mgr.webMutex.RUnlock()
-				mgr.log.V(5).Error(err, "Error reading snapshot directory")
-				http.Error(w,
-					http.StatusText(http.StatusBadRequest),
-					http.StatusBadRequest)
-				return
-			}
-			fileList, err := fp.Readdir(0)
+			fileList, err := mgr.store.List(r.Context(), name)
+			mgr.webMutex.RUnlock()
 			if err != nil {
-				mgr.webMutex.RUnlock()
 				mgr.log.V(5).Error(err, "Error listing files in snapshot diectory")
 				http.Error(w,
 					http.StatusText(http.StatusBadRequest),
 					http.StatusBadRequest)
 				return
 			}
+			// Snapshots which are waiting to be approved, or which have been
+			// rejected, are listed along with the published snapshots.
+			mgr.webMutex.RLock()
+			fileList = append(fileList, mgr.listPending(r.Context(), name)...)
+			mgr.webMutex.RUnlock()
 			type SnapshotProperties map[string]interface{}
 			var snapshots []SnapshotProperties
 			for _, snapshot := range fileList {
-				snapshots = append(snapshots, SnapshotProperties{"name": snapshot.Name(), "size": snapshot.Size(),
-					"lastModified": snapshot.ModTime().String()})
+				properties := SnapshotProperties{"name": snapshot.Name, "size": snapshot.Size,
+					"lastModified": snapshot.LastModified.String(), "sha256": snapshot.Digest}
+				if len(snapshot.Approval) > 0 {
+					properties["approval"] = snapshot.Approval
+					properties["client"] = snapshot.Client
+				}
+				if len(snapshot.Reviewer) > 0 {
+					properties["reviewer"] = snapshot.Reviewer
+				}
+				snapshots = append(snapshots, properties)
 			}
-			mgr.webMutex.RUnlock()
 			jsonStr, err := json.Marshal(snapshots)
 			if err != nil {
 				mgr.log.V(5).Error(err, "Error serializing snapshot properties")
@@ -529,9 +1216,7 @@ func (mgr *SnapshotMgr) serve(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusOK)
 			w.Write(jsonStr)
 		} else {
-			mgr.webMutex.RLock()
-			http.ServeFile(w, r, fileName)
-			mgr.webMutex.RUnlock()
+			mgr.serveContent(w, r, name)
 		}
 
 	/*
@@ -551,9 +1236,30 @@ func (mgr *SnapshotMgr) serve(w http.ResponseWriter, r *http.Request) {
 			modifiedStr = "all"
 		}
 
+		/*
+		 * The deployments are restarted once the file has been saved unless
+		 * the 'publish' argument is set to false.
+		 */
+
+		publish := true
+
+		if value := r.URL.Query().Get("publish"); len(value) > 0 {
+			var perr error
+
+			publish, perr = strconv.ParseBool(value)
+
+			if perr != nil {
+				http.Error(w, "The publish argument must be either true "+
+					"or false", http.StatusBadRequest)
+
+				return
+			}
+		}
+
 		mgr.log.Info("Processing a POST",
 			"Path", r.URL.Path,
 			"Modified", modifiedStr,
+			"Publish", publish,
 			"Client", client)
 
 		/*
@@ -562,7 +1268,7 @@ func (mgr *SnapshotMgr) serve(w http.ResponseWriter, r *http.Request) {
 
 		r.ParseMultipartForm(maxMemory)
 
-		file, _, err := r.FormFile("file")
+		file, header, err := r.FormFile("file")
 
 		if err != nil {
 			http.Error(w,
@@ -577,59 +1283,93 @@ func (mgr *SnapshotMgr) serve(w http.ResponseWriter, r *http.Request) {
 		defer file.Close()
 
 		/*
-		 * Create the file which is to be uploaded.
+		 * Work out the digest which the client expects the file to have.
 		 */
 
-		mgr.webMutex.Lock()
-
-		dst, err := os.Create(fileName)
+		digest, err := expectedDigest(r)
 
 		if err != nil {
-			mgr.webMutex.Unlock()
-
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 
-			mgr.log.V(5).Error(err, "Failed to create the file",
-				"File", fileName)
+			mgr.log.V(5).Error(err, "An invalid POST has been received")
 
 			return
 		}
 
-		defer dst.Close()
-
 		/*
-		 * Save the file.
+		 * Save the file.  The previous version of the file will remain
+		 * intact, and continue to be served, if the upload fails.
 		 */
 
-		_, err = io.Copy(dst, file)
+		metadata := &fileMetadata{
+			Client:   client,
+			Modified: modified,
+		}
+
+		err = mgr.submitFile(r.Context(), name, file, header.Size, digest,
+			metadata)
 
-		if err != nil {
-			mgr.webMutex.Unlock()
+		if errors.Is(err, errInvalidUpload) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 
+			return
+		} else if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 
-			mgr.log.V(5).Error(err, "Failed to copy the file",
-				"File", fileName)
-
 			return
 		}
 
-		mgr.webMutex.Unlock()
+		/*
+		 * A gated snapshot is not published until it has been approved, and
+		 * so a '202 Accepted' response is returned.
+		 */
+
+		response := jobResponse{fileMetadata: metadata}
+
+		if metadata.Approval == approvalPending {
+			jsonStr, _ := json.Marshal(response)
+
+			setDigestHeaders(w, metadata)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			w.Write(jsonStr)
+
+			mgr.log.Info("The snapshot is waiting to be approved",
+				"File", name)
+
+			return
+		}
 
 		/*
-		 * Request a restart of all running containers in a separate
-		 * thread.
+		 * Start a job to restart all running containers, unless the file
+		 * is not to be published yet.
 		 */
 
-		go mgr.rollingRestart(filepath.Clean(r.URL.Path), modified)
+		if publish {
+			job := mgr.rollingRestart(filepath.Clean(urlPath), modified,
+				"", client)
+
+			if job != nil {
+				response.Job = job.Id
+			}
+		} else {
+			mgr.log.Info("No deployments will be restarted as the file "+
+				"has not been published", "File", name)
+		}
 
 		/*
-		 *  Return a '201 Created' response.
+		 *  Return a '201 Created' response, which contains the metadata
+		 *  of the saved file, along with the identifier of the restart job.
 		 */
 
-		http.Error(w, "", http.StatusCreated)
+		jsonStr, _ := json.Marshal(response)
 
-		mgr.log.V(5).Info("The file has been saved", "File", fileName)
+		setDigestHeaders(w, metadata)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(jsonStr)
+
+		mgr.log.V(5).Info("The file has been saved", "File", name)
 
 	/*
 	 * For a DELETE we want to attempt to delete the specified file.  The
@@ -642,7 +1382,7 @@ func (mgr *SnapshotMgr) serve(w http.ResponseWriter, r *http.Request) {
 			"Path", r.URL.Path, "Client", client)
 
 		mgr.webMutex.Lock()
-		err := os.Remove(fileName)
+		err := mgr.store.Delete(r.Context(), name)
 		mgr.webMutex.Unlock()
 
 		var rspCode int
@@ -651,7 +1391,7 @@ func (mgr *SnapshotMgr) serve(w http.ResponseWriter, r *http.Request) {
 		if err == nil {
 			rspCode = http.StatusNoContent
 			rspText = ""
-		} else if os.IsNotExist(err) {
+		} else if errors.Is(err, os.ErrNotExist) {
 			rspCode = http.StatusNotFound
 			rspText = http.StatusText(http.StatusNotFound)
 		} else {
@@ -661,10 +1401,10 @@ func (mgr *SnapshotMgr) serve(w http.ResponseWriter, r *http.Request) {
 
 		if err == nil {
 			mgr.log.V(5).Error(err, "Failed to delete the file",
-				"File", fileName)
+				"File", name)
 		} else {
 			mgr.log.V(5).Info("Successfully deleted the file",
-				"File", fileName)
+				"File", name)
 		}
 
 		http.Error(w, rspText, rspCode)
@@ -713,111 +1453,12 @@ func (mgr *SnapshotMgr) generateRandomString(length int) (string, error) {
 
 /*****************************************************************************/
 
-/*
- * The following function is used to generate a new public/private key
- * pair.
- */
-
-func (mgr *SnapshotMgr) generateKey() (cert string, key string, err error) {
-
-	mgr.log.V(9).Info("Entering a function", "Function", "generateKey")
-
-	/*
-	 * Generate the RSA key.
-	 */
-
-	priv, err := rsa.GenerateKey(rand.Reader, keyLength)
-
-	if err != nil {
-		mgr.log.Error(err, "Failed to generate an RSA key")
-		return
-	}
-
-	/*
-	 * Construct the x509 certificate.
-	 */
-
-	host, _ := os.Hostname()
-
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			CommonName:   host,
-			Organization: []string{"IBM"},
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(time.Hour * 24 * 365 * 20),
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-		IsCA:                  true,
-	}
-
-	if ip := net.ParseIP(host); ip != nil {
-		template.IPAddresses = append(template.IPAddresses, ip)
-	} else {
-		template.DNSNames = append(template.DNSNames, host)
-	}
-
-	//Hard code the service name as a SAN as this is what will be put in the generated secret
-	namespace, err := getLocalNamespace(mgr.log)
-	if err != nil {
-		namespace = "default"
-	}
-	template.DNSNames = append(template.DNSNames, fmt.Sprintf("%s.%s.svc.cluster.local:%d",
-		serviceName, namespace, httpsPort))
-	template.DNSNames = append(template.DNSNames, fmt.Sprintf("%s.%s.svc.cluster.local",
-		serviceName, namespace))
-
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template,
-		&priv.PublicKey, priv)
-
-	if err != nil {
-		mgr.log.Error(err, "Failed to generate the certificate")
-		return
-	}
-
-	/*
-	 * Convert the certificate.
-	 */
-
-	out := &bytes.Buffer{}
-
-	pem.Encode(out, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: derBytes,
-	})
-
-	cert = strings.TrimSuffix(out.String(), "\n")
-
-	/*
-	 * Convert the key.
-	 */
-
-	out.Reset()
-
-	pem.Encode(out, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(priv),
-	})
-
-	/*
-	 * For some reason when creating a secret from this value, sometimes the trailing new line
-	 * is removed. . . this breaks the update checking done when re-deploying containers, so lets
-	 * try and fix it here
-	 */
-	key = strings.TrimSuffix(out.String(), "\n")
-
-	return
-}
-
-/*****************************************************************************/
-
 /*
  * This function is used to create our secret and populate the secret with
  * our required data.  This data includes:
  *     - the read-only credentials
  *     - the read-write credentials
+ *     - the CA certificate and key
  *     - the server certificate and key
  */
 
@@ -847,17 +1488,39 @@ func (mgr *SnapshotMgr) createSecret(
 		return
 	}
 
+	url := fmt.Sprintf("https://%s.%s.svc.cluster.local:%d",
+		serviceName, namespace, httpsPort)
+
+	data := map[string]string{
+		userFieldName:  snapshotMgrUser,
+		urlFieldName:   url,
+		rwPwdFieldName: rw_pwd,
+		roPwdFieldName: ro_pwd,
+	}
+
 	/*
-	 * Generate a self signed certificate and key.
+	 * Generate the CA, and the server certificate signed by the CA.  This
+	 * is not required if the certificate is to be issued by cert-manager.
 	 */
 
-	cert, key, err := mgr.generateKey()
-	if err != nil {
-		return
-	}
+	if !mgr.options.useCertManager() {
+		var caCert, caKey, cert, key string
 
-	url := fmt.Sprintf("https://%s.%s.svc.cluster.local:%d",
-		serviceName, namespace, httpsPort)
+		caCert, caKey, err = mgr.generateCA()
+		if err != nil {
+			return
+		}
+
+		cert, key, err = mgr.generateServingCert(caCert, caKey)
+		if err != nil {
+			return
+		}
+
+		data[caCertFieldName] = caCert
+		data[caKeyFieldName] = caKey
+		data[certFieldName] = cert
+		data[keyFieldName] = key
+	}
 
 	/*
 	 * Create the secret.
@@ -868,14 +1531,7 @@ func (mgr *SnapshotMgr) createSecret(
 		ObjectMeta: metaV1.ObjectMeta{
 			Name: operatorName,
 		},
-		StringData: map[string]string{
-			userFieldName:  snapshotMgrUser,
-			urlFieldName:   url,
-			rwPwdFieldName: rw_pwd,
-			roPwdFieldName: ro_pwd,
-			certFieldName:  cert,
-			keyFieldName:   key,
-		},
+		StringData: data,
 	}
 
 	secret, err = client.Create(context.TODO(), secret, metaV1.CreateOptions{})
@@ -898,6 +1554,7 @@ func (mgr *SnapshotMgr) createSecret(
  *     - the read-only credentials
  *     - the read-write credentials
  *     - the server certificate and key
+ *     - the CA certificate and key (if present)
  */
 
 func (mgr *SnapshotMgr) loadSecret() (err error) {
@@ -917,6 +1574,8 @@ func (mgr *SnapshotMgr) loadSecret() (err error) {
 		return
 	}
 
+	mgr.namespace = namespace
+
 	/*
 	 * Create a new client based on our current configuration.
 	 */
@@ -946,6 +1605,16 @@ func (mgr *SnapshotMgr) loadSecret() (err error) {
 
 		secret, err = mgr.createSecret(secretsClient, namespace)
 
+		/*
+		 * Another replica may have created the secret at the same time, in
+		 * which case we use the secret which it created.
+		 */
+
+		if k8serrors.IsAlreadyExists(err) {
+			secret, err = secretsClient.Get(
+				context.TODO(), operatorName, metaV1.GetOptions{})
+		}
+
 		if err != nil {
 			return
 		}
@@ -958,13 +1627,25 @@ func (mgr *SnapshotMgr) loadSecret() (err error) {
 	 * checking that all of the required data exists.
 	 */
 
-	mgr.creds = make(map[string]string)
+	creds := make(map[string]string)
 
 	keys := []string{
 		userFieldName,
 		urlFieldName,
 		roPwdFieldName,
 		rwPwdFieldName,
+	}
+
+	/*
+	 * The certificate and key will be obtained from the cert-manager
+	 * secret if cert-manager is being used, and are otherwise generated by
+	 * checkCertificates if they are missing, for example because
+	 * cert-manager was previously being used.
+	 */
+
+	optionalKeys := []string{
+		caCertFieldName,
+		caKeyFieldName,
 		certFieldName,
 		keyFieldName,
 	}
@@ -981,9 +1662,54 @@ func (mgr *SnapshotMgr) loadSecret() (err error) {
 			return
 		}
 
-		mgr.creds[key] = string(value)
+		creds[key] = string(value)
+	}
+
+	for _, key := range optionalKeys {
+		if value, ok := secret.Data[key]; ok {
+			creds[key] = string(value)
+		}
+	}
+
+	mgr.setCreds(creds)
+
+	/*
+	 * The cert-manager Certificate resource is only saved by the leader,
+	 * from requestCertificates, and every replica simply loads the
+	 * certificate from the cert-manager secret.
+	 */
+
+	if mgr.options.useCertManager() {
+		if len(mgr.options.CertIssuerName) == 0 {
+			err = errors.New("A cert-manager issuer must be specified")
+
+			mgr.log.Error(err, "Unable to request the certificate")
+		}
+
+		return
+	}
+
+	/*
+	 * Check whether our certificates need to be generated or renewed
+	 * before they are used.
+	 */
+
+	updates, err := mgr.checkCertificates(creds)
+
+	if err != nil {
+		return
+	}
+
+	if len(updates) > 0 {
+		err = mgr.updateSecret(updates)
+
+		if err != nil {
+			return
+		}
 	}
 
+	err = mgr.loadCertificate()
+
 	return
 }
 
@@ -998,36 +1724,68 @@ func (mgr *SnapshotMgr) initialize() (err error) {
 	 * Initialise this object.
 	 */
 
+	mgr.restartMutex = &sync.Mutex{}
+	mgr.webMutex = &sync.RWMutex{}
+	mgr.credsMutex = &sync.RWMutex{}
+	mgr.leaderMutex = &sync.Mutex{}
+	mgr.jobsMutex = &sync.Mutex{}
+	mgr.reviewMutex = &sync.Mutex{}
+	mgr.saveMutex = &sync.Mutex{}
+	mgr.coalesceMutex = &sync.Mutex{}
+	mgr.coalesced = map[string]*coalescedRestart{}
+
+	mgr.podName, _ = os.Hostname()
+
+	err = mgr.options.TLSPolicy.Validate()
+	if err != nil {
+		mgr.log.Error(err, "The TLS policy is not valid")
+
+		return
+	}
+
 	err = mgr.loadSecret()
 	if err != nil {
 		return
 	}
 
-	mgr.restartMutex = &sync.Mutex{}
-	mgr.webMutex = &sync.RWMutex{}
+	if len(mgr.options.GatedSnapshots) > 0 {
+		err = mgr.loadApproverSecret()
+		if err != nil {
+			return
+		}
+	}
 
 	/*
-	 * Create the directories which will store our data.
+	 * Create the directory which is used to stage uploaded files, and then
+	 * initialize the store which will hold our data.
 	 */
 
-	dirs := []string{
-		dataRoot,
-		filepath.Join(dataRoot, "snapshots"),
-		filepath.Join(dataRoot, "fixpacks"),
+	err = os.MkdirAll(stagingDir, 0700)
+
+	if err != nil {
+		mgr.log.Error(err, "Failed to create the staging directory",
+			"Directory", stagingDir)
+
+		return
 	}
 
-	for _, dir := range dirs {
-		err = os.Mkdir(dir, 0700)
+	for _, tmpFile := range removeTemporaryFiles(stagingDir) {
+		mgr.log.V(5).Info("Removed an incomplete upload", "File", tmpFile)
+	}
 
-		if err != nil && !os.IsExist(err) {
-			mgr.log.Error(err, "Failed to create the data directory",
-				"Directory", dir)
+	mgr.store, err = mgr.newSnapshotStore()
 
-			return
-		} else {
-			err = nil
-		}
+	if err != nil {
+		mgr.log.Error(err, "Failed to create the snapshot store")
+
+		return
+	}
+
+	err = mgr.store.Initialize(context.TODO())
 
+	if err != nil {
+		mgr.log.Error(err, "Failed to initialize the snapshot store",
+			"Store.Type", mgr.options.StoreType)
 	}
 
 	return
@@ -1041,27 +1799,21 @@ func (mgr *SnapshotMgr) initialize() (err error) {
  */
 
 func (mgr *SnapshotMgr) start() {
-	var err error
-
 	mgr.log.Info("Starting the snapshot manager", "Port", httpsPort)
 
 	/*
-	 * Define the http server and server handler.
+	 * Define the http server and server handler.  The certificate is
+	 * retrieved on each handshake so that it can be renewed while the
+	 * server is running.
 	 */
 
-	pair, err := tls.X509KeyPair(
-		[]byte(mgr.creds[certFieldName]),
-		[]byte(mgr.creds[keyFieldName]))
+	tlsConfig := &tls.Config{GetCertificate: mgr.getCertificate}
 
-	if err != nil {
-		mgr.log.Error(err, "Failed to generate the X509 key pair")
-
-		return
-	}
+	mgr.options.TLSPolicy.Apply(tlsConfig)
 
 	mgr.server = &http.Server{
 		Addr:      fmt.Sprintf(":%v", httpsPort),
-		TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
+		TLSConfig: tlsConfig,
 	}
 
 	mux := http.NewServeMux()
@@ -1082,6 +1834,19 @@ func (mgr *SnapshotMgr) start() {
 		}
 	}()
 
+	/*
+	 * Periodically check whether our certificates need to be renewed, or
+	 * watch for a new certificate if cert-manager is being used.
+	 */
+
+	stopChan := make(chan struct{})
+
+	if mgr.options.useCertManager() {
+		go mgr.watchCertificateSecret(stopChan)
+	} else {
+		go mgr.certificateRenewalLoop(stopChan)
+	}
+
 	/*
 	 * Wait and listen for the OS shutdown singal.
 	 */
@@ -1093,6 +1858,8 @@ func (mgr *SnapshotMgr) start() {
 	mgr.log.Info("Received a shutdown signal, shutting down the snapshot " +
 		"manager gracefully")
 
+	close(stopChan)
+
 	mgr.server.Shutdown(context.Background())
 }
 
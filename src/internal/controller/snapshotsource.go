@@ -0,0 +1,674 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	ibmv1 "github.com/ibm-security/verify-access-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * The error which is returned when the source of a snapshot is not yet
+ * ready to be read, in which case the request should be retried shortly.
+ */
+
+var errSourcePending = errors.New("The snapshot source is not yet available")
+
+/*****************************************************************************/
+
+/*
+ * The sourceContent structure holds the content of a snapshot which has
+ * been opened, along with the information which the source publishes about
+ * the content.
+ */
+
+type sourceContent struct {
+	io.ReadCloser
+
+	// The SHA-256 digest which the source publishes for the content, if any.
+	digest string
+
+	// The revision of the source, such as the digest of the manifest of an
+	// OCI artifact, if the source has revisions.
+	revision string
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to open the source of the snapshot which is to be
+ * stored with the specified name.
+ */
+
+func (r *IBMSecurityVerifyAccessSnapshotReconciler) openSource(
+	ctx context.Context,
+	snapshot *ibmv1.IBMSecurityVerifyAccessSnapshot,
+	name string) (content *sourceContent, err error) {
+
+	r.Log.V(9).Info("Entering a function", "Function", "openSource")
+
+	source := snapshot.Spec.Source
+
+	count := 0
+
+	for _, present := range []bool{
+		source.ConfigMap != nil,
+		source.Secret != nil,
+		source.PersistentVolumeClaim != nil,
+		source.HTTP != nil,
+		source.OCI != nil,
+	} {
+		if present {
+			count++
+		}
+	}
+
+	if count != 1 {
+		err = errors.New("Exactly one snapshot source must be specified")
+
+		return
+	}
+
+	var reader io.ReadCloser
+
+	switch {
+	case source.ConfigMap != nil:
+		reader, err = r.openConfigMap(ctx, snapshot.Namespace,
+			source.ConfigMap)
+
+	case source.Secret != nil:
+		reader, err = r.openSecret(ctx, snapshot.Namespace, source.Secret)
+
+	case source.PersistentVolumeClaim != nil:
+		reader, err = r.openVolume(ctx, snapshot)
+
+	case source.HTTP != nil:
+		reader, err = r.openURL(ctx, snapshot.Namespace, source.HTTP)
+
+	case source.OCI != nil:
+		return r.openArtifact(ctx, snapshot.Namespace, source.OCI,
+			path.Base(name))
+	}
+
+	if err == nil {
+		content = &sourceContent{ReadCloser: reader}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to open a snapshot which is held in a config map.
+ * The key is looked up in the binary data of the config map, and then in
+ * the text data.
+ */
+
+func (r *IBMSecurityVerifyAccessSnapshotReconciler) openConfigMap(
+	ctx context.Context,
+	namespace string,
+	selector *corev1.ConfigMapKeySelector) (io.ReadCloser, error) {
+
+	configMap := &corev1.ConfigMap{}
+
+	err := r.apiReader.Get(ctx, types.NamespacedName{
+		Name:      selector.Name,
+		Namespace: namespace,
+	}, configMap)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if data, ok := configMap.BinaryData[selector.Key]; ok {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	if data, ok := configMap.Data[selector.Key]; ok {
+		return io.NopCloser(strings.NewReader(data)), nil
+	}
+
+	return nil, fmt.Errorf("The config map, %s, does not contain the key %s",
+		selector.Name, selector.Key)
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to open a snapshot which is held in a secret.
+ */
+
+func (r *IBMSecurityVerifyAccessSnapshotReconciler) openSecret(
+	ctx context.Context,
+	namespace string,
+	selector *corev1.SecretKeySelector) (io.ReadCloser, error) {
+
+	data, err := r.secretData(ctx, namespace, selector)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+/*
+ * This function is used to retrieve the value of a key of a secret.
+ */
+
+func (r *IBMSecurityVerifyAccessSnapshotReconciler) secretData(
+	ctx context.Context,
+	namespace string,
+	selector *corev1.SecretKeySelector) ([]byte, error) {
+
+	secret := &corev1.Secret{}
+
+	err := r.apiReader.Get(ctx, types.NamespacedName{
+		Name:      selector.Name,
+		Namespace: namespace,
+	}, secret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := secret.Data[selector.Key]
+
+	if !ok {
+		return nil, fmt.Errorf("The secret, %s, does not contain the key %s",
+			selector.Name, selector.Key)
+	}
+
+	return data, nil
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to open a snapshot which is available from an HTTP
+ * server.
+ */
+
+func (r *IBMSecurityVerifyAccessSnapshotReconciler) openURL(
+	ctx context.Context,
+	namespace string,
+	source *ibmv1.SnapshotURLSource) (io.ReadCloser, error) {
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if source.CACert != nil {
+		caCert, err := r.secretData(ctx, namespace, source.CACert)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("The secret, %s, does not contain a valid "+
+				"CA certificate", source.CACert.Name)
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return fetchURL(ctx, &http.Client{Transport: transport}, source.URL, "")
+}
+
+/*
+ * This function is used to retrieve the content of a URL.  The caller is
+ * responsible for closing the returned reader.
+ */
+
+func fetchURL(ctx context.Context, client *http.Client, rawURL string,
+	token string) (io.ReadCloser, error) {
+
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rsp, err := client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+		rsp.Body.Close()
+
+		return nil, fmt.Errorf("The request for %s returned '%s'",
+			req.URL.Redacted(), rsp.Status)
+	}
+
+	return rsp.Body, nil
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to open a file which has been published as an OCI
+ * artifact.  The digest of the layer which holds the file, and the digest
+ * of the manifest of the artifact, are returned with the content.
+ */
+
+func (r *IBMSecurityVerifyAccessSnapshotReconciler) openArtifact(
+	ctx context.Context,
+	namespace string,
+	source *ibmv1.SnapshotOCISource,
+	fileName string) (content *sourceContent, err error) {
+
+	client, err := r.newOCIClient(ctx, namespace, source)
+
+	if err != nil {
+		return
+	}
+
+	manifest, manifestDigest, err := client.fetchManifest(ctx)
+
+	if err != nil {
+		return
+	}
+
+	layer, err := selectOCILayer(manifest, fileName)
+
+	if err != nil {
+		return
+	}
+
+	reader, err := client.fetchBlob(ctx, layer)
+
+	if err == nil {
+		content = &sourceContent{
+			ReadCloser: reader,
+			digest:     layer.Digest.Encoded(),
+			revision:   manifestDigest,
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to create a client for the registry which holds an
+ * OCI artifact, using the credentials from the image pull secrets of the
+ * source.
+ */
+
+func (r *IBMSecurityVerifyAccessSnapshotReconciler) newOCIClient(
+	ctx context.Context,
+	namespace string,
+	source *ibmv1.SnapshotOCISource) (client *ociClient, err error) {
+
+	ref, err := parseOCIReference(source.Reference)
+
+	if err != nil {
+		return
+	}
+
+	var secrets []corev1.Secret
+
+	for _, pullSecret := range source.ImagePullSecrets {
+		secret := corev1.Secret{}
+
+		err = r.apiReader.Get(ctx, types.NamespacedName{
+			Name:      pullSecret.Name,
+			Namespace: namespace,
+		}, &secret)
+
+		if err != nil {
+			return
+		}
+
+		secrets = append(secrets, secret)
+	}
+
+	return newOCIRepositoryClient(ref, source.PlainHTTP, &http.Client{},
+		secrets)
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to determine the current revision of the source of
+ * a snapshot, without retrieving the snapshot.  Only OCI artifacts have
+ * revisions, in which case the digest of the manifest which is referenced
+ * by the tag is returned.
+ */
+
+func (r *IBMSecurityVerifyAccessSnapshotReconciler) sourceRevision(
+	ctx context.Context,
+	snapshot *ibmv1.IBMSecurityVerifyAccessSnapshot) (string, error) {
+
+	source := snapshot.Spec.Source.OCI
+
+	if source == nil {
+		return "", nil
+	}
+
+	client, err := r.newOCIClient(ctx, snapshot.Namespace, source)
+
+	if err != nil {
+		return "", err
+	}
+
+	return client.resolveDigest(ctx)
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to open a snapshot which is held on a persistent
+ * volume.  The file is served by a reader pod which mounts the volume, and
+ * errSourcePending is returned until the pod is ready.
+ */
+
+func (r *IBMSecurityVerifyAccessSnapshotReconciler) openVolume(
+	ctx context.Context,
+	snapshot *ibmv1.IBMSecurityVerifyAccessSnapshot) (io.ReadCloser, error) {
+
+	pod := &corev1.Pod{}
+
+	err := r.apiReader.Get(ctx, types.NamespacedName{
+		Name:      readerPodName(snapshot),
+		Namespace: snapshot.Namespace,
+	}, pod)
+
+	if k8serrors.IsNotFound(err) {
+		err = r.createReaderPod(ctx, snapshot)
+
+		if err == nil {
+			err = errSourcePending
+		}
+
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	/*
+	 * A pod which was created for an earlier generation of the snapshot
+	 * might be reading the wrong file, and so it is replaced.
+	 */
+
+	generation := strconv.FormatInt(snapshot.Generation, 10)
+
+	if pod.Annotations[snapshotGenerationAnnotation] != generation {
+		r.deleteReaderPod(ctx, snapshot)
+
+		return nil, errSourcePending
+	}
+
+	switch pod.Status.Phase {
+	case corev1.PodFailed, corev1.PodSucceeded:
+		r.deleteReaderPod(ctx, snapshot)
+
+		return nil, fmt.Errorf("The snapshot reader pod, %s, has terminated",
+			pod.Name)
+
+	case corev1.PodRunning:
+
+	default:
+		return nil, errSourcePending
+	}
+
+	ready := false
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			ready = condition.Status == corev1.ConditionTrue
+		}
+	}
+
+	if !ready || len(pod.Status.PodIP) == 0 {
+		return nil, errSourcePending
+	}
+
+	token := ""
+
+	for _, env := range pod.Spec.Containers[0].Env {
+		if env.Name == fileServerTokenEnv {
+			token = env.Value
+		}
+	}
+
+	rawURL := fmt.Sprintf("http://%s/",
+		net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(fileServerPort)))
+
+	return fetchURL(ctx, &http.Client{}, rawURL, token)
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the name of the reader pod for a
+ * snapshot.
+ */
+
+func readerPodName(snapshot *ibmv1.IBMSecurityVerifyAccessSnapshot) string {
+	return snapshot.Name + snapshotReaderSuffix
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to create the reader pod for a snapshot which is
+ * held on a persistent volume.  The pod runs the operator image, which
+ * serves the file from the read-only volume, and is owned by the snapshot
+ * resource.
+ */
+
+func (r *IBMSecurityVerifyAccessSnapshotReconciler) createReaderPod(
+	ctx context.Context,
+	snapshot *ibmv1.IBMSecurityVerifyAccessSnapshot) error {
+
+	r.Log.V(9).Info("Entering a function", "Function", "createReaderPod")
+
+	source := snapshot.Spec.Source.PersistentVolumeClaim
+
+	image, err := r.SnapshotMgr.operatorImage(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	token, err := r.SnapshotMgr.generateRandomString(pwdLength)
+
+	if err != nil {
+		return err
+	}
+
+	/*
+	 * The path is cleaned as an absolute path so that it cannot refer to a
+	 * file outside of the volume.
+	 */
+
+	fileName := fileServerMountPath + path.Clean("/"+source.Path)
+
+	trueVar := true
+	falseVar := false
+	deadline := int64(snapshotReaderDeadline.Seconds())
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      readerPodName(snapshot),
+			Namespace: snapshot.Namespace,
+			Labels: map[string]string{
+				"kind": snapshotKindName,
+				"app":  readerPodName(snapshot),
+			},
+			Annotations: map[string]string{
+				snapshotGenerationAnnotation: strconv.FormatInt(
+					snapshot.Generation, 10),
+			},
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy:                corev1.RestartPolicyNever,
+			ActiveDeadlineSeconds:        &deadline,
+			AutomountServiceAccountToken: &falseVar,
+			SecurityContext: &corev1.PodSecurityContext{
+				RunAsNonRoot: &trueVar,
+				SeccompProfile: &corev1.SeccompProfile{
+					Type: corev1.SeccompProfileTypeRuntimeDefault,
+				},
+			},
+			Containers: []corev1.Container{{
+				Name:            "reader",
+				Image:           image,
+				ImagePullPolicy: corev1.PullIfNotPresent,
+				Command:         []string{"/manager"},
+				Args:            []string{"--serve-file=" + fileName},
+				Env: []corev1.EnvVar{{
+					Name:  fileServerTokenEnv,
+					Value: token,
+				}},
+				Ports: []corev1.ContainerPort{{
+					Name:          "http",
+					ContainerPort: int32(fileServerPort),
+					Protocol:      corev1.ProtocolTCP,
+				}},
+				ReadinessProbe: &corev1.Probe{
+					ProbeHandler: corev1.ProbeHandler{
+						HTTPGet: &corev1.HTTPGetAction{
+							Path: "/healthz",
+							Port: intstr.FromInt32(int32(fileServerPort)),
+						},
+					},
+				},
+				SecurityContext: &corev1.SecurityContext{
+					AllowPrivilegeEscalation: &falseVar,
+					ReadOnlyRootFilesystem:   &trueVar,
+					Capabilities: &corev1.Capabilities{
+						Drop: []corev1.Capability{"ALL"},
+					},
+				},
+				VolumeMounts: []corev1.VolumeMount{{
+					Name:      "source",
+					MountPath: fileServerMountPath,
+					ReadOnly:  true,
+				}},
+			}},
+			Volumes: []corev1.Volume{{
+				Name: "source",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: source.ClaimName,
+						ReadOnly:  true,
+					},
+				},
+			}},
+		},
+	}
+
+	err = ctrl.SetControllerReference(snapshot, pod, r.Scheme)
+
+	if err != nil {
+		return err
+	}
+
+	r.Log.Info("Creating a snapshot reader pod",
+		"Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name)
+
+	err = r.Create(ctx, pod)
+
+	if k8serrors.IsAlreadyExists(err) {
+		err = nil
+	}
+
+	return err
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to delete the reader pod of a snapshot, if one
+ * exists.
+ */
+
+func (r *IBMSecurityVerifyAccessSnapshotReconciler) deleteReaderPod(
+	ctx context.Context,
+	snapshot *ibmv1.IBMSecurityVerifyAccessSnapshot) {
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      readerPodName(snapshot),
+			Namespace: snapshot.Namespace,
+		},
+	}
+
+	err := r.Delete(ctx, pod)
+
+	if err != nil && !k8serrors.IsNotFound(err) {
+		r.Log.Error(err, "Failed to delete the snapshot reader pod",
+			"Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name)
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to determine the image of the operator, which is
+ * also used for the snapshot reader pods.
+ */
+
+func (mgr *SnapshotMgr) operatorImage(ctx context.Context) (string, error) {
+	clientset, err := kubernetes.NewForConfig(mgr.config)
+
+	if err != nil {
+		return "", err
+	}
+
+	pod, err := clientset.CoreV1().Pods(mgr.namespace).Get(
+		ctx, mgr.podName, metav1.GetOptions{})
+
+	if err != nil {
+		return "", fmt.Errorf("Unable to determine the image of the "+
+			"operator: %w", err)
+	}
+
+	for _, container := range pod.Spec.Containers {
+		if container.Name == "manager" {
+			return container.Image, nil
+		}
+	}
+
+	return pod.Spec.Containers[0].Image, nil
+}
+
+/*****************************************************************************/
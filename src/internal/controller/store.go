@@ -0,0 +1,210 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+/*****************************************************************************/
+
+/*
+ * The supported types of snapshot store.
+ */
+
+const (
+	// The files are stored on the local file system of the operator.
+	StoreTypeLocal string = "local"
+
+	// The files are stored in an S3 compatible object store.
+	StoreTypeS3 string = "s3"
+
+	// The files are stored in Kubernetes secrets and config maps.
+	StoreTypeKubernetes string = "kubernetes"
+)
+
+/*****************************************************************************/
+
+/*
+ * The SnapshotStore interface is implemented by each of the backends which
+ * can be used to store the files which are managed by the snapshot manager.
+ * Files are identified by a relative, slash separated, name, for example
+ * 'snapshots/ivia_11.0.0.0_published.snapshot'.  A store must return an
+ * error which wraps os.ErrNotExist if a file does not exist.
+ */
+
+type SnapshotStore interface {
+	// Prepare the store for use.
+	Initialize(ctx context.Context) error
+
+	// Retrieve the metadata of a file.
+	Stat(ctx context.Context, name string) (*fileMetadata, error)
+
+	// Retrieve the content and the metadata of a file.  The caller must
+	// close the returned reader, which also implements io.Seeker if the
+	// store supports it.
+	Get(ctx context.Context, name string) (io.ReadCloser, *fileMetadata, error)
+
+	// Store a file which has been staged on the local file system, along
+	// with its metadata.  The store takes ownership of the staged file, which
+	// may be moved rather than copied.  The existing file, if any, must be
+	// replaced atomically.  The LastModified time of the metadata is set by
+	// the store.
+	Put(ctx context.Context, name string, stagedFile string,
+		metadata *fileMetadata) error
+
+	// Copy a file, along with its metadata, to a new name.
+	Copy(ctx context.Context, srcName string, dstName string) error
+
+	// Retrieve the metadata of each of the files which are held directly
+	// within the specified directory, excluding hidden files.
+	List(ctx context.Context, dir string) ([]*fileMetadata, error)
+
+	// Delete a file, along with its metadata.
+	Delete(ctx context.Context, name string) error
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to create the snapshot store which has been
+ * selected in the options of the snapshot manager.
+ */
+
+func (mgr *SnapshotMgr) newSnapshotStore() (store SnapshotStore, err error) {
+	switch mgr.options.StoreType {
+	case "", StoreTypeLocal:
+		store = &localStore{
+			root: dataRoot,
+			log:  mgr.log.WithName("local-store"),
+		}
+
+	case StoreTypeS3:
+		store, err = newS3Store(mgr.options.S3, mgr.log.WithName("s3-store"))
+
+	case StoreTypeKubernetes:
+		store, err = newKubeStore(mgr.config, mgr.namespace,
+			mgr.options.StoreCompression, mgr.log.WithName("kubernetes-store"))
+
+	default:
+		err = fmt.Errorf("The snapshot store type, %s, is not supported",
+			mgr.options.StoreType)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the name of a file within the store from
+ * the path of a request.
+ */
+
+func storeName(urlPath string) string {
+	return path.Clean(urlPath)[1:]
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to retrieve the metadata of a stored file.
+ */
+
+func (mgr *SnapshotMgr) statFile(ctx context.Context, name string) (
+	*fileMetadata, error) {
+
+	mgr.webMutex.RLock()
+	defer mgr.webMutex.RUnlock()
+
+	return mgr.store.Stat(ctx, name)
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to stage the content of the supplied reader in a
+ * temporary file, so that it can be verified before it is stored.
+ */
+
+func createStagedFile(name string) (*os.File, error) {
+	return os.CreateTemp(stagingDir, "."+path.Base(name)+".*"+tmpFileSuffix)
+}
+
+/*****************************************************************************/
+
+/*
+ * The stagedReader structure is used to return the content of a file which
+ * has been assembled in a temporary file.  The temporary file is removed
+ * when the reader is closed.
+ */
+
+type stagedReader struct {
+	*os.File
+}
+
+func (r *stagedReader) Close() error {
+	err := r.File.Close()
+
+	os.Remove(r.File.Name())
+
+	return err
+}
+
+/*
+ * This function is used to copy the supplied reader into a temporary file,
+ * which is returned ready to be read from the start.
+ */
+
+func newStagedReader(name string, src io.Reader) (
+	reader *stagedReader, err error) {
+
+	file, err := createStagedFile(name)
+
+	if err != nil {
+		return
+	}
+
+	reader = &stagedReader{File: file}
+
+	_, err = io.Copy(file, src)
+
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		reader.Close()
+		reader = nil
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to remove any temporary files which have been left
+ * behind in the specified directory by an upload which was interrupted.
+ */
+
+func removeTemporaryFiles(dir string) []string {
+	tmpFiles, _ := filepath.Glob(filepath.Join(dir, ".*"+tmpFileSuffix))
+
+	for _, tmpFile := range tmpFiles {
+		os.Remove(tmpFile)
+	}
+
+	return tmpFiles
+}
+
+/*****************************************************************************/
@@ -0,0 +1,314 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+/*****************************************************************************/
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+/*****************************************************************************/
+
+/*
+ * The supported key types for generated certificates.
+ */
+
+const (
+	KeyTypeRSA   string = "rsa"
+	KeyTypeECDSA string = "ecdsa"
+)
+
+/*****************************************************************************/
+
+/*
+ * The TLS versions which can be specified as the minimum TLS version.
+ */
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+/*
+ * The cipher suites, key sizes and curves which are approved for use in
+ * FIPS mode.
+ */
+
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+var fipsCurves = []tls.CurveID{
+	tls.CurveP256,
+	tls.CurveP384,
+}
+
+var rsaKeySizes = map[int]bool{2048: true, 3072: true, 4096: true}
+
+var ecdsaCurves = map[int]elliptic.Curve{
+	256: elliptic.P256(),
+	384: elliptic.P384(),
+	521: elliptic.P521(),
+}
+
+var fipsECDSAKeySizes = map[int]bool{256: true, 384: true}
+
+/*****************************************************************************/
+
+/*
+ * The TLSPolicy structure defines the TLS policy which is applied to the
+ * snapshot manager and the metrics endpoint, along with the type and size
+ * of the keys which are generated by the operator.
+ */
+
+type TLSPolicy struct {
+	// The minimum TLS version, for example '1.2'.
+	MinVersion string
+
+	// The names of the allowed TLS 1.0-1.2 cipher suites.  The Go defaults
+	// are used if no cipher suites are specified.
+	CipherSuites []string
+
+	// The type of key to be generated, either 'rsa' or 'ecdsa'.
+	KeyType string
+
+	// The size of the key to be generated, in bits.  For ECDSA keys this is
+	// the size of the curve.  A default size is used if this is 0.
+	KeySize int
+
+	// Restrict the policy to FIPS approved algorithms.
+	FIPS bool
+
+	cipherSuites []uint16
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to validate the policy, resolving the names of the
+ * cipher suites and filling in default values.  It must be called before
+ * the policy is used.
+ */
+
+func (p *TLSPolicy) Validate() error {
+	if len(p.MinVersion) == 0 {
+		p.MinVersion = "1.2"
+	}
+
+	version, ok := tlsVersions[p.MinVersion]
+
+	if !ok {
+		return fmt.Errorf("The TLS version, %s, is not supported", p.MinVersion)
+	}
+
+	/*
+	 * TLS 1.3 is disabled in FIPS mode (see Apply), and so TLS 1.2 is the
+	 * only version which can be used.
+	 */
+
+	if p.FIPS && version != tls.VersionTLS12 {
+		return fmt.Errorf("The TLS version, %s, is not allowed in FIPS mode, "+
+			"which only supports TLS 1.2", p.MinVersion)
+	}
+
+	/*
+	 * Resolve the cipher suites.  Only the secure cipher suites which are
+	 * known to Go can be used.
+	 */
+
+	p.cipherSuites = nil
+
+	known := make(map[string]uint16)
+
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	for _, name := range p.CipherSuites {
+		name = strings.TrimSpace(name)
+
+		if len(name) == 0 {
+			continue
+		}
+
+		id, ok := known[name]
+
+		if !ok {
+			return fmt.Errorf("The cipher suite, %s, is not supported", name)
+		}
+
+		if p.FIPS && !containsSuite(fipsCipherSuites, id) {
+			return fmt.Errorf("The cipher suite, %s, is not allowed in FIPS "+
+				"mode", name)
+		}
+
+		p.cipherSuites = append(p.cipherSuites, id)
+	}
+
+	if p.FIPS && len(p.cipherSuites) == 0 {
+		p.cipherSuites = fipsCipherSuites
+	}
+
+	/*
+	 * Validate the key type and size.
+	 */
+
+	if len(p.KeyType) == 0 {
+		p.KeyType = KeyTypeRSA
+	}
+
+	switch p.KeyType {
+	case KeyTypeRSA:
+		if p.KeySize == 0 {
+			p.KeySize = keyLength
+		}
+
+		if !rsaKeySizes[p.KeySize] {
+			return fmt.Errorf("The RSA key size, %d, is not supported", p.KeySize)
+		}
+
+	case KeyTypeECDSA:
+		if p.KeySize == 0 {
+			p.KeySize = ecdsaKeyLength
+		}
+
+		if _, ok := ecdsaCurves[p.KeySize]; !ok {
+			return fmt.Errorf("The ECDSA key size, %d, is not supported",
+				p.KeySize)
+		}
+
+		if p.FIPS && !fipsECDSAKeySizes[p.KeySize] {
+			return fmt.Errorf("The ECDSA key size, %d, is not allowed in FIPS "+
+				"mode", p.KeySize)
+		}
+
+	default:
+		return fmt.Errorf("The key type, %s, is not supported", p.KeyType)
+	}
+
+	return nil
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to apply the policy to the supplied TLS
+ * configuration.
+ */
+
+func (p *TLSPolicy) Apply(c *tls.Config) {
+	if version, ok := tlsVersions[p.MinVersion]; ok {
+		c.MinVersion = version
+	}
+
+	if len(p.cipherSuites) > 0 {
+		c.CipherSuites = p.cipherSuites
+	}
+
+	if p.FIPS {
+		/*
+		 * The TLS 1.3 cipher suites cannot be configured in Go, and may
+		 * include algorithms which are not FIPS approved, and so TLS 1.3 is
+		 * disabled in FIPS mode.
+		 */
+
+		c.MaxVersion = tls.VersionTLS12
+		c.CurvePreferences = fipsCurves
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to generate a new private key based on the key type
+ * and size of the policy.
+ */
+
+func (p *TLSPolicy) generateKey() (crypto.Signer, error) {
+	if p.KeyType == KeyTypeECDSA {
+		return ecdsa.GenerateKey(ecdsaCurves[p.KeySize], rand.Reader)
+	}
+
+	return rsa.GenerateKey(rand.Reader, p.KeySize)
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to determine whether the key of the supplied
+ * certificate matches the key type and size of the policy.
+ */
+
+func (p *TLSPolicy) matchesKey(cert *x509.Certificate) bool {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return p.KeyType == KeyTypeRSA && key.N.BitLen() == p.KeySize
+	case *ecdsa.PublicKey:
+		return p.KeyType == KeyTypeECDSA && key.Curve.Params().BitSize == p.KeySize
+	}
+
+	return false
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the name of the key algorithm of the
+ * policy, as used by cert-manager.
+ */
+
+func (p *TLSPolicy) certManagerAlgorithm() string {
+	if p.KeyType == KeyTypeECDSA {
+		return "ECDSA"
+	}
+
+	return "RSA"
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to return the key usages of a certificate which is
+ * requested from cert-manager.  Key encipherment is only used with an RSA
+ * key.
+ */
+
+func (p *TLSPolicy) certManagerUsages() (usages []interface{}) {
+	usages = []interface{}{"server auth", "digital signature"}
+
+	if p.KeyType != KeyTypeECDSA {
+		usages = append(usages, "key encipherment")
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+func containsSuite(suites []uint16, id uint16) bool {
+	for _, suite := range suites {
+		if suite == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*****************************************************************************/
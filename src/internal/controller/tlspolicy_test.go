@@ -0,0 +1,94 @@
+/*
+ * Copyright contributors to the IBM Verify Identity Access Operator project
+ */
+
+package controllers
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+/*****************************************************************************/
+
+/*
+ * Verify that the TLS versions which are allowed in FIPS mode can be
+ * applied, and that the other versions are rejected rather than producing a
+ * configuration in which no TLS version can be negotiated.
+ */
+
+func TestTLSPolicyFIPSVersions(t *testing.T) {
+	tests := []struct {
+		minVersion string
+		valid      bool
+	}{
+		{"", true},
+		{"1.2", true},
+		{"1.0", false},
+		{"1.1", false},
+		{"1.3", false},
+	}
+
+	for _, test := range tests {
+		policy := TLSPolicy{MinVersion: test.minVersion, FIPS: true}
+
+		err := policy.Validate()
+
+		if (err == nil) != test.valid {
+			t.Errorf("MinVersion %q: error = %v, want valid = %v",
+				test.minVersion, err, test.valid)
+
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		config := &tls.Config{}
+
+		policy.Apply(config)
+
+		if config.MaxVersion != 0 && config.MinVersion > config.MaxVersion {
+			t.Errorf("MinVersion %q: the minimum version, %x, is greater "+
+				"than the maximum version, %x", test.minVersion,
+				config.MinVersion, config.MaxVersion)
+		}
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Verify that a certificate which is requested from cert-manager only
+ * includes the key encipherment usage for an RSA key.
+ */
+
+func TestTLSPolicyCertManagerUsages(t *testing.T) {
+	tests := []struct {
+		keyType      string
+		encipherment bool
+	}{
+		{KeyTypeRSA, true},
+		{KeyTypeECDSA, false},
+	}
+
+	for _, test := range tests {
+		policy := TLSPolicy{KeyType: test.keyType}
+
+		encipherment := false
+
+		for _, usage := range policy.certManagerUsages() {
+			if usage == "key encipherment" {
+				encipherment = true
+			}
+		}
+
+		if encipherment != test.encipherment {
+			t.Errorf("%s: key encipherment = %v, want %v", test.keyType,
+				encipherment, test.encipherment)
+		}
+	}
+}
+
+/*****************************************************************************/